@@ -32,6 +32,10 @@ const (
 	ShippingsStatusShipping   = "shipping"
 	ShippingsStatusDone       = "done"
 
+	OfferStatusPending   = "pending"
+	OfferStatusCountered = "countered"
+	OfferStatusAccepted  = "accepted"
+
 	ItemsPerPage             = 48
 	ItemsTransactionsPerPage = 10
 
@@ -115,6 +119,12 @@ var (
 	indexImageFile       int
 	indexActiveSellerID  int32
 	indexBuyerID         int32
+	// addedItemKeys はベンチマーカーが出品した商品のキー。古い順に並ぶ
+	addedItemKeys []string
+	// reuseUsers が true ならユーザーを使い切ったら最初から使い回す
+	reuseUsers atomic.Bool
+	// passwordUserID はパスワード変更を確認するためのユーザー。他のシナリオでは使わない
+	passwordUserID int64
 )
 
 // Initialize is a function to load initial data
@@ -341,6 +351,9 @@ func Initialize(dataDir, staticDir string) {
 
 	rand.Shuffle(len(activeSellerIDs), func(i, j int) { activeSellerIDs[i], activeSellerIDs[j] = activeSellerIDs[j], activeSellerIDs[i] })
 	rand.Shuffle(len(buyerIDs), func(i, j int) { buyerIDs[i], buyerIDs[j] = buyerIDs[j], buyerIDs[i] })
+	// パスワードを変えると他のセッションが無効になるので、パスワード変更用のユーザーは購入者から外しておく
+	passwordUserID = buyerIDs[0]
+	buyerIDs = buyerIDs[1:]
 	rand.Shuffle(len(imageFiles), func(i, j int) { imageFiles[i], imageFiles[j] = imageFiles[j], imageFiles[i] })
 }
 
@@ -352,7 +365,20 @@ func GetRandomActiveSeller() AppUser {
 	muUser.RLock()
 	defer muUser.RUnlock()
 	// 全部使い切ったらpanicするので十分なユーザー数を用意しておく
-	return users[activeSellerIDs[len(activeSellerIDs)-int(atomic.AddInt32(&indexActiveSellerID, 1))]]
+	return users[activeSellerIDs[nextUserIndex(&indexActiveSellerID, len(activeSellerIDs))]]
+}
+
+// SetReuseUsers は長時間負荷をかけるときに、ユーザーを使い切ったら最初から使い回すようにする
+func SetReuseUsers(reuse bool) {
+	reuseUsers.Store(reuse)
+}
+
+func nextUserIndex(index *int32, n int) int {
+	i := int(atomic.AddInt32(index, 1))
+	if reuseUsers.Load() {
+		i = (i-1)%n + 1
+	}
+	return n - i
 }
 
 func GetRandomActiveSellerIDs(num int) []int64 {
@@ -376,7 +402,7 @@ func GetRandomBuyer() AppUser {
 	muUser.RLock()
 	defer muUser.RUnlock()
 	// 全部使い切ったらpanicするので十分なユーザー数を用意しておく
-	return users[buyerIDs[len(buyerIDs)-int(atomic.AddInt32(&indexBuyerID, 1))]]
+	return users[buyerIDs[nextUserIndex(&indexBuyerID, len(buyerIDs))]]
 }
 
 func GetRandomBuyerIDs(num int) []int64 {
@@ -402,6 +428,22 @@ func GetUser(sellerID int64) AppUser {
 	return users[sellerID]
 }
 
+// GetPasswordUser はパスワード変更とセッションの失効を確認するためのユーザーを返す
+func GetPasswordUser() AppUser {
+	muUser.RLock()
+	defer muUser.RUnlock()
+	return users[passwordUserID]
+}
+
+// SetUserPassword はパスワードを変更したユーザーの新しいパスワードを覚えておく
+func SetUserPassword(userID int64, password string) {
+	muUser.Lock()
+	defer muUser.Unlock()
+	user := users[userID]
+	user.Password = password
+	users[userID] = user
+}
+
 func UserBuyItem(sellerID int64) AppUser {
 	muUser.Lock()
 	defer muUser.Unlock()
@@ -456,6 +498,7 @@ func SetItem(sellerID int64, itemID int64, name string, price int, description s
 
 	// imageName は更新できない
 	key := fmt.Sprintf("%d_%d", sellerID, itemID)
+	addedItemKeys = append(addedItemKeys, key)
 	items[key] = AppItem{
 		ID:          itemID,
 		SellerID:    sellerID,
@@ -472,6 +515,40 @@ func SetItem(sellerID int64, itemID int64, name string, price int, description s
 	users[sellerID] = user
 }
 
+// PruneItems はベンチマーカーが出品した商品が max 件を超えたら古いものから忘れて、忘れた件数を返す
+// 初期データの商品は残す。忘れた商品は一覧に出てきてもチェックしない
+func PruneItems(max int) int {
+	muItem.Lock()
+	defer muItem.Unlock()
+
+	n := len(addedItemKeys) - max
+	if n <= 0 {
+		return 0
+	}
+
+	pruned := make(map[int64]map[int64]bool)
+	for _, key := range addedItemKeys[:n] {
+		item := items[key]
+		delete(items, key)
+		if pruned[item.SellerID] == nil {
+			pruned[item.SellerID] = make(map[int64]bool)
+		}
+		pruned[item.SellerID][item.ID] = true
+	}
+	addedItemKeys = append([]string{}, addedItemKeys[n:]...)
+
+	for sellerID, itemIDs := range pruned {
+		kept := make([]int64, 0, len(userItems[sellerID]))
+		for _, id := range userItems[sellerID] {
+			if !itemIDs[id] {
+				kept = append(kept, id)
+			}
+		}
+		userItems[sellerID] = kept
+	}
+	return n
+}
+
 func SetItemPrice(sellerID int64, itemID int64, price int) {
 	muItem.Lock()
 	defer muItem.Unlock()
@@ -483,6 +560,34 @@ func SetItemPrice(sellerID int64, itemID int64, price int) {
 	items[key] = item
 }
 
+// SetItemStatus は出品者による商品の状態の変更を反映する
+// ユーザーページに表示される状態から外れたら出品数を減らし、戻ったら増やす
+func SetItemStatus(sellerID int64, itemID int64, status string) {
+	muItem.Lock()
+	defer muItem.Unlock()
+	muUser.Lock()
+	defer muUser.Unlock()
+
+	key := fmt.Sprintf("%d_%d", sellerID, itemID)
+	item := items[key]
+	before := item.Status
+	item.Status = status
+	items[key] = item
+
+	user := users[sellerID]
+	if isListedItemStatus(before) {
+		user.NumSellItems = user.NumSellItems - 1
+	}
+	if isListedItemStatus(status) {
+		user.NumSellItems = user.NumSellItems + 1
+	}
+	users[sellerID] = user
+}
+
+func isListedItemStatus(status string) bool {
+	return status == ItemStatusOnSale || status == ItemStatusTrading || status == ItemStatusSoldOut
+}
+
 func SetItemCreatedAt(sellerID int64, itemID int64, createdAt int64) AppItem {
 	muItem.Lock()
 	defer muItem.Unlock()
@@ -304,6 +304,11 @@ func buyComplete(ctx context.Context, s1, s2 *session.Session, targetItemID int6
 	}
 	asset.UserBuyItem(s2.UserID)
 
+	return shipComplete(ctx, s1, s2, targetItemID)
+}
+
+// shipComplete は購入済みの商品を発送して取引を完了させる
+func shipComplete(ctx context.Context, s1, s2 *session.Session, targetItemID int64) error {
 	findItem, err := findItemFromUsersByID(ctx, s1, s1.UserID, targetItemID, 1)
 	if err != nil {
 		return err
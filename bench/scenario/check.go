@@ -2,6 +2,10 @@ package scenario
 
 import (
 	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
 	"sync"
 	"time"
 
@@ -11,6 +15,21 @@ import (
 	"github.com/morikuni/failure"
 )
 
+const (
+	checkWrongPasswordInterval = 8 * time.Second
+	// ロックを確かめるたびに LoginAccountLimit 回失敗するので、IPごとの制限に掛からないように間隔を空ける
+	checkLoginLockoutInterval = 30 * time.Second
+)
+
+// checkLoginFailuresPerWindow は verify と check のシナリオが1つのIPから window の間に失敗するログインの最大回数
+// verify scenario #7 で1回、check scenario #1 はログインとパスワード変更で1回ずつ、#5 は LoginAccountLimit 回失敗する
+func checkLoginFailuresPerWindow(window time.Duration) int {
+	iterations := func(interval time.Duration) int {
+		return int((window + interval - 1) / interval)
+	}
+	return 1 + 2*iterations(checkWrongPasswordInterval) + session.LoginAccountLimit*iterations(checkLoginLockoutInterval)
+}
+
 func Check(ctx context.Context) {
 	var wg sync.WaitGroup
 	closed := make(chan struct{})
@@ -20,20 +39,31 @@ func Check(ctx context.Context) {
 	// check scenario #1
 	// 間違ったパスワードでログインができないことをチェックする
 	// これがないとパスワードチェックを外して常にログイン成功させるチートが可能になる
+	// ログアウトとパスワード変更の異常系と、専用のユーザーでパスワード変更とセッションの失効もチェックする
 	// 出品・購入はしない
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
 	L:
-		for range ExecutionSeconds / 8 {
-			ch := time.After(8 * time.Second)
+		for range ExecutionSeconds * time.Second / checkWrongPasswordInterval {
+			ch := time.After(checkWrongPasswordInterval)
 
 			err := irregularLoginWrongPassword(ctx, user3)
 			if err != nil {
 				fails.ErrorsForCheck.Add(err)
 			}
 
+			err = irregularLogout(ctx, user3)
+			if err != nil {
+				fails.ErrorsForCheck.Add(err)
+			}
+
+			err = checkPasswordChange(ctx)
+			if err != nil {
+				fails.ErrorsForCheck.Add(err)
+			}
+
 			select {
 			case <-ch:
 			case <-ctx.Done():
@@ -251,6 +281,138 @@ func Check(ctx context.Context) {
 		}
 	}()
 
+	// check scenario #5
+	// ログインに失敗し続けるとロックされることをチェックする
+	// 正しいユーザーが巻き込まれてロックされないことも確認する
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+	L:
+		for range ExecutionSeconds * time.Second / checkLoginLockoutInterval {
+			ch := time.After(checkLoginLockoutInterval)
+
+			err := irregularLoginLockout(ctx, asset.GetRandomBuyer())
+			if err != nil {
+				fails.ErrorsForCheck.Add(err)
+			}
+
+			select {
+			case <-ch:
+			case <-ctx.Done():
+				break L
+			}
+		}
+	}()
+
+	// check scenario #6
+	// 出品の一時停止・再開・取り消しをチェックする
+	// 停止中と取り消し後は他のユーザーから見えず、買えないことを確認する
+	// まとめて出品をチェックする
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		var s1, s2 *session.Session
+		var err error
+
+	L:
+		for range ExecutionSeconds / 10 {
+			ch := time.After(10 * time.Second)
+
+			s1, err = activeSellerSession(ctx)
+			if err != nil {
+				fails.ErrorsForCheck.Add(err)
+				goto Final
+			}
+
+			s2, err = buyerSession(ctx)
+			if err != nil {
+				fails.ErrorsForCheck.Add(err)
+				goto Final
+			}
+
+			err = checkItemLifecycle(ctx, s1, s2)
+			if err != nil {
+				fails.ErrorsForCheck.Add(err)
+				goto Final
+			}
+
+			err = checkSellBulk(ctx, s1, s2)
+			if err != nil {
+				fails.ErrorsForCheck.Add(err)
+				goto Final
+			}
+
+			ActiveSellerPool.Enqueue(s1)
+			BuyerPool.Enqueue(s2)
+
+		Final:
+			select {
+			case <-ch:
+			case <-ctx.Done():
+				break L
+			}
+		}
+	}()
+
+	// check scenario #7
+	// 値下げ交渉をして合意した価格で購入する
+	// 取引を完了させた出品者の売上の集計を確認する
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		var s1, s2, s3 *session.Session
+		var err error
+
+	L:
+		for range ExecutionSeconds / 10 {
+			ch := time.After(10 * time.Second)
+
+			s1, err = activeSellerSession(ctx)
+			if err != nil {
+				fails.ErrorsForCheck.Add(err)
+				goto Final
+			}
+
+			s2, err = buyerSession(ctx)
+			if err != nil {
+				fails.ErrorsForCheck.Add(err)
+				goto Final
+			}
+
+			s3, err = buyerSession(ctx)
+			if err != nil {
+				fails.ErrorsForCheck.Add(err)
+				goto Final
+			}
+
+			err = checkOffer(ctx, s1, s2, s3)
+			if err != nil {
+				fails.ErrorsForCheck.Add(err)
+				goto Final
+			}
+
+			err = checkUserStats(ctx, s1)
+			if err != nil {
+				fails.ErrorsForCheck.Add(err)
+				goto Final
+			}
+
+			ActiveSellerPool.Enqueue(s1)
+			BuyerPool.Enqueue(s2)
+			BuyerPool.Enqueue(s3)
+
+		Final:
+			select {
+			case <-ch:
+			case <-ctx.Done():
+				break L
+			}
+		}
+	}()
+
 	go func() {
 		wg.Wait()
 		close(closed)
@@ -516,3 +678,336 @@ func checkGetItem(ctx context.Context, s *session.Session, targetItemID int64) e
 
 	return nil
 }
+
+func checkItemLifecycle(ctx context.Context, s1, s2 *session.Session) error {
+	price := priceStoreCache.Get()
+	targetItem, err := sell(ctx, s1, price)
+	if err != nil {
+		return err
+	}
+
+	status, err := s1.ItemStop(ctx, targetItem.ID)
+	if err != nil {
+		return err
+	}
+	if status != asset.ItemStatusStop {
+		return failure.New(fails.ErrApplication, failure.Messagef("POST /items/stop: 商品の状態が正しくありません (item_id: %d)", targetItem.ID))
+	}
+	asset.SetItemStatus(s1.UserID, targetItem.ID, status)
+
+	item, err := s1.Item(ctx, targetItem.ID)
+	if err != nil {
+		return err
+	}
+	if item.Status != asset.ItemStatusStop {
+		return failure.New(fails.ErrApplication, failure.Messagef("/items/%d.json の商品の状態が正しくありません", targetItem.ID))
+	}
+
+	listed, userAfterStop, err := isItemInFirstUserItems(ctx, s2, s1.UserID, targetItem.ID)
+	if err != nil {
+		return err
+	}
+	if listed {
+		return failure.New(fails.ErrApplication, failure.Messagef("/users/%d.json に出品を停止した商品があります (item_id: %d)", s1.UserID, targetItem.ID))
+	}
+
+	// 停止中の商品は他のユーザーから見えず、買えない
+	err = s2.ItemWithNotFound(ctx, targetItem.ID)
+	if err != nil {
+		return err
+	}
+
+	token := sPayment.ForceSet(CorrectCardNumber, targetItem.ID, price)
+	err = s2.BuyWithFailed(ctx, targetItem.ID, token, http.StatusForbidden, "item is not for sale")
+	if err != nil {
+		return err
+	}
+
+	status, err = s1.ItemResume(ctx, targetItem.ID)
+	if err != nil {
+		return err
+	}
+	if status != asset.ItemStatusOnSale {
+		return failure.New(fails.ErrApplication, failure.Messagef("POST /items/resume: 商品の状態が正しくありません (item_id: %d)", targetItem.ID))
+	}
+	asset.SetItemStatus(s1.UserID, targetItem.ID, status)
+
+	listed, userAfterResume, err := isItemInFirstUserItems(ctx, s2, s1.UserID, targetItem.ID)
+	if err != nil {
+		return err
+	}
+	if !listed {
+		return failure.New(fails.ErrApplication, failure.Messagef("/users/%d.json に出品を再開した商品がありません (item_id: %d)", s1.UserID, targetItem.ID))
+	}
+	// 他のシナリオで出品されることはあっても減ることはない
+	if !(userAfterResume.NumSellItems > userAfterStop.NumSellItems) {
+		return failure.New(fails.ErrApplication, failure.Messagef("出品を再開してもユーザの出品数が更新されていません (user_id: %d)", s1.UserID))
+	}
+
+	status, err = s1.ItemCancel(ctx, targetItem.ID)
+	if err != nil {
+		return err
+	}
+	if status != asset.ItemStatusCancel {
+		return failure.New(fails.ErrApplication, failure.Messagef("POST /items/cancel: 商品の状態が正しくありません (item_id: %d)", targetItem.ID))
+	}
+	asset.SetItemStatus(s1.UserID, targetItem.ID, status)
+
+	// 取り消した商品は元に戻せない
+	err = s1.ItemResumeWithFailed(ctx, targetItem.ID, http.StatusForbidden, "この商品の状態は変更できません")
+	if err != nil {
+		return err
+	}
+
+	err = s2.ItemWithNotFound(ctx, targetItem.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// isItemInFirstUserItems はユーザーページの1ページ目に商品があるかを返す
+// 出品した直後の商品なので1ページ目だけ見ればよい
+func isItemInFirstUserItems(ctx context.Context, s *session.Session, sellerID, itemID int64) (bool, *session.UserSimple, error) {
+	_, user, items, err := s.UserItems(ctx, sellerID)
+	if err != nil {
+		return false, nil, err
+	}
+	if user == nil {
+		return false, nil, failure.New(fails.ErrApplication, failure.Messagef("/users/%d.json の出品者情報が返っていません", sellerID))
+	}
+
+	for _, item := range items {
+		if item.ID == itemID {
+			return true, user, nil
+		}
+	}
+	return false, user, nil
+}
+
+// checkOffer は値下げ交渉をチェックする
+// 交渉が成立した商品は交渉相手以外は買えず、交渉相手は合意した価格で買えることを確認する
+func checkOffer(ctx context.Context, s1, s2, s3 *session.Session) error {
+	// 出品価格より安い価格で交渉するので最低価格より高く出品する
+	listPrice := priceStoreCache.Get() + 100
+	targetItem, err := sell(ctx, s1, listPrice)
+	if err != nil {
+		return err
+	}
+
+	err = s2.MakeOfferWithFailed(ctx, targetItem.ID, session.ItemMinPrice-1, http.StatusBadRequest, session.ItemPriceErrMsg)
+	if err != nil {
+		return err
+	}
+
+	offer, err := s2.MakeOffer(ctx, targetItem.ID, listPrice-100)
+	if err != nil {
+		return err
+	}
+	if offer.Status != asset.OfferStatusPending || offer.Price != listPrice-100 || offer.ItemID != targetItem.ID {
+		return failure.New(fails.ErrApplication, failure.Messagef("POST /offers: 交渉の内容が正しくありません (item_id: %d)", targetItem.ID))
+	}
+
+	agreedPrice := listPrice - 50
+	offer, err = s1.CounterOffer(ctx, offer.ID, agreedPrice)
+	if err != nil {
+		return err
+	}
+	if offer.Status != asset.OfferStatusCountered || offer.Price != agreedPrice {
+		return failure.New(fails.ErrApplication, failure.Messagef("POST /offers/counter: 交渉の内容が正しくありません (offer_id: %d)", offer.ID))
+	}
+
+	offer, err = s2.AcceptOffer(ctx, offer.ID)
+	if err != nil {
+		return err
+	}
+	if offer.Status != asset.OfferStatusAccepted || offer.Price != agreedPrice || offer.ReservedUntil == 0 {
+		return failure.New(fails.ErrApplication, failure.Messagef("POST /offers/accept: 交渉の内容が正しくありません (offer_id: %d)", offer.ID))
+	}
+
+	// 取り置き中は交渉相手以外は買えない
+	token := sPayment.ForceSet(CorrectCardNumber, targetItem.ID, listPrice)
+	err = s3.BuyWithFailed(ctx, targetItem.ID, token, http.StatusForbidden, "この商品は他の購入者に取り置き中です")
+	if err != nil {
+		return err
+	}
+
+	// 決済額は決済サービスで、購入実績の価格はFinalCheckで合意した価格になっているか確認する
+	token = sPayment.ForceSetWithOffer(CorrectCardNumber, targetItem.ID, listPrice, agreedPrice)
+	_, err = s2.Buy(ctx, targetItem.ID, token)
+	if err != nil {
+		return err
+	}
+	asset.UserBuyItem(s2.UserID)
+
+	return shipComplete(ctx, s1, s2, targetItem.ID)
+}
+
+// checkSellBulk はまとめて出品をチェックする
+// 誤りのある行があれば1件も出品されず、なければすべて出品されて出品数が増えることを確認する
+func checkSellBulk(ctx context.Context, s1, s2 *session.Session) error {
+	price := priceStoreCache.Get()
+	items := make([]session.BulkSellItem, 3)
+	for i := range items {
+		items[i] = session.BulkSellItem{
+			FileName:    asset.GetRandomImageFileName(),
+			Name:        asset.GenText(8, false),
+			Price:       price,
+			Description: asset.GenText(200, true),
+			CategoryID:  asset.GetRandomChildCategory().ID,
+		}
+	}
+
+	_, userBefore, _, err := s2.UserItems(ctx, s1.UserID)
+	if err != nil {
+		return err
+	}
+	if userBefore == nil {
+		return failure.New(fails.ErrApplication, failure.Messagef("/users/%d.json の出品者情報が返っていません", s1.UserID))
+	}
+
+	// 2行目だけ価格を範囲外にする
+	wrongItems := slices.Clone(items)
+	wrongItems[1].Price = session.ItemMinPrice - 1
+	err = s1.SellBulkWithFailed(ctx, wrongItems, 2, session.ItemPriceErrMsg)
+	if err != nil {
+		return err
+	}
+
+	itemIDs, err := s1.SellBulk(ctx, items)
+	if err != nil {
+		return err
+	}
+	for i, itemID := range itemIDs {
+		asset.SetItem(s1.UserID, itemID, items[i].Name, items[i].Price, items[i].Description, items[i].CategoryID)
+	}
+
+	_, userAfter, userItems, err := s2.UserItems(ctx, s1.UserID)
+	if err != nil {
+		return err
+	}
+	if userAfter == nil {
+		return failure.New(fails.ErrApplication, failure.Messagef("/users/%d.json の出品者情報が返っていません", s1.UserID))
+	}
+	for _, itemID := range itemIDs {
+		if !slices.ContainsFunc(userItems, func(item session.ItemSimple) bool { return item.ID == itemID }) {
+			return failure.New(fails.ErrApplication, failure.Messagef("/users/%d.json にまとめて出品した商品がありません (item_id: %d)", s1.UserID, itemID))
+		}
+	}
+	// 他のシナリオで出品されることはあっても減ることはない
+	if userAfter.NumSellItems < userBefore.NumSellItems+len(items) {
+		return failure.New(fails.ErrApplication, failure.Messagef("まとめて出品してもユーザの出品数が正しく更新されていません (user_id: %d)", s1.UserID))
+	}
+
+	return nil
+}
+
+// checkUserStats は出品者の売上の集計をチェックする
+// 取引を完了させた直後に呼ぶので、完了した取引と売上が少なくとも1件分はある
+func checkUserStats(ctx context.Context, s1 *session.Session) error {
+	stats, err := s1.UserStats(ctx)
+	if err != nil {
+		return err
+	}
+
+	if stats.TransactionStatusCounts[asset.TransactionEvidenceStatusDone] < 1 ||
+		stats.ShippingStatusCounts[asset.ShippingsStatusDone] < 1 {
+		return failure.New(fails.ErrApplication, failure.Messagef("/users/me/stats.json の取引の件数が正しくありません (user_id: %d)", s1.UserID))
+	}
+	if stats.TotalSales < session.ItemMinPrice || len(stats.TopCategories) == 0 {
+		return failure.New(fails.ErrApplication, failure.Messagef("/users/me/stats.json の売上が正しくありません (user_id: %d)", s1.UserID))
+	}
+
+	var categorySales int64
+	for _, cs := range stats.TopCategories {
+		if cs.Category == nil {
+			return failure.New(fails.ErrApplication, failure.Messagef("/users/me/stats.json のカテゴリが返っていません (user_id: %d)", s1.UserID))
+		}
+		categorySales += cs.Sales
+	}
+	if categorySales > stats.TotalSales {
+		return failure.New(fails.ErrApplication, failure.Messagef("/users/me/stats.json のカテゴリ別の売上が合計を超えています (user_id: %d)", s1.UserID))
+	}
+
+	return nil
+}
+
+// checkPasswordChange はパスワード変更用のユーザーで、他のセッションの失効とパスワードの変更をチェックする
+// セッションをサーバー側に保存する実装なら、一覧から失効させたセッションが使えなくなることも確認する
+// パスワードを変えると他のセッションがすべて無効になるので、他のシナリオで使わないユーザーで行う
+func checkPasswordChange(ctx context.Context) error {
+	user := asset.GetPasswordUser()
+
+	s1, err := loginedSession(ctx, user)
+	if err != nil {
+		return err
+	}
+	s2, err := loginedSession(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := s1.UserSessions(ctx)
+	if err != nil {
+		return err
+	}
+	if sessions != nil {
+		current := 0
+		for _, us := range sessions {
+			if us.Current {
+				current++
+				continue
+			}
+			// 前回のチェックで残ったセッションもまとめて失効させる
+			err = s1.RevokeSession(ctx, us.ID)
+			if err != nil {
+				return err
+			}
+		}
+		if current != 1 || len(sessions) < 2 {
+			return failure.New(fails.ErrApplication, failure.Messagef("/users/sessions.json のセッションの一覧が正しくありません (user_id: %d)", s1.UserID))
+		}
+
+		err = s2.SettingsWithLoggedOut(ctx)
+		if err != nil {
+			return failure.Wrap(err, failure.Messagef("失効させたセッションが使えます (user_id: %d)", s1.UserID))
+		}
+
+		s2, err = loginedSession(ctx, user)
+		if err != nil {
+			return err
+		}
+	}
+
+	newPassword := fmt.Sprintf("password%x", rand.Uint64())
+	err = s1.ChangePassword(ctx, user.Password, newPassword)
+	if err != nil {
+		return err
+	}
+	asset.SetUserPassword(user.ID, newPassword)
+
+	// パスワードを変えた他のセッションは使えなくなり、変えたセッションはそのまま使える
+	err = s2.SettingsWithLoggedOut(ctx)
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("パスワードを変更する前のセッションが使えます (user_id: %d)", s1.UserID))
+	}
+	err = s1.SetSettings(ctx)
+	if err != nil {
+		return err
+	}
+
+	// 新しいパスワードでログインできる
+	// IPごとのログイン失敗の上限に近づかないように、古いパスワードでのログインは試さない
+	user.Password = newPassword
+	s3, err := loginedSession(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	err = s3.Logout(ctx)
+	if err != nil {
+		return err
+	}
+	return s1.Logout(ctx)
+}
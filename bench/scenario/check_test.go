@@ -0,0 +1,31 @@
+package scenario
+
+import (
+	"testing"
+	"time"
+
+	"github.com/isucon/isucon9-qualify/bench/session"
+)
+
+func TestCheckLoginFailuresPerWindow(t *testing.T) {
+	tests := []struct {
+		window time.Duration
+		want   int
+	}{
+		// 1 + 2*8 + 10*2
+		{time.Minute, 37},
+		{30 * time.Second, 1 + 2*4 + 10*1},
+		{8 * time.Second, 1 + 2*1 + 10*1},
+	}
+
+	for _, tt := range tests {
+		got := checkLoginFailuresPerWindow(tt.window)
+		if got != tt.want {
+			t.Errorf("checkLoginFailuresPerWindow(%s) = %d, want %d", tt.window, got, tt.want)
+		}
+	}
+
+	if got := checkLoginFailuresPerWindow(time.Minute); got > session.LoginIPFailuresPerMinute {
+		t.Errorf("check scenarios fail %d logins per minute, more than LoginIPFailuresPerMinute (%d)", got, session.LoginIPFailuresPerMinute)
+	}
+}
@@ -0,0 +1,171 @@
+package scenario
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon9-qualify/bench/asset"
+	"github.com/isucon/isucon9-qualify/bench/fails"
+	"github.com/isucon/isucon9-qualify/bench/session"
+)
+
+const (
+	DefaultOpenRate        = 5.0
+	DefaultOpenMaxInFlight = 50
+	DefaultOpenMaxQueue    = 1000
+)
+
+// OpenConfig は到着率を決めて負荷をかけるときの設定
+type OpenConfig struct {
+	// Rate は1秒あたりの平均の到着数。到着の間隔は指数分布になる
+	Rate float64
+	// MaxInFlight は同時に処理する到着の数。すべて処理中なら到着はキューで待つ
+	MaxInFlight int
+	// MaxQueue を超えて待っている到着は捨てる
+	MaxQueue int
+}
+
+// OpenResult は到着率を決めて負荷をかけた結果
+// レイテンシは到着した時刻から測るので、アプリケーションが遅くてキューで待った時間も含む
+type OpenResult struct {
+	Rate      float64 `json:"rate"`
+	Arrivals  int     `json:"arrivals"`
+	Completed int     `json:"completed"`
+	Failed    int     `json:"failed"`
+	// Dropped はキューがいっぱいで捨てた到着の数。Queued は終了時にまだキューで待っていた到着の数
+	Dropped int `json:"dropped"`
+	Queued  int `json:"queued"`
+
+	QueueP50Ms   int64 `json:"queue_p50_ms"`
+	QueueP99Ms   int64 `json:"queue_p99_ms"`
+	QueueMaxMs   int64 `json:"queue_max_ms"`
+	LatencyP50Ms int64 `json:"latency_p50_ms"`
+	LatencyP99Ms int64 `json:"latency_p99_ms"`
+	LatencyMaxMs int64 `json:"latency_max_ms"`
+}
+
+// Open は ctx が終わるまで、到着がポアソン過程に従うように出品・閲覧・購入をする
+// 他のシナリオと違い、アプリケーションが遅くても到着は減らない
+// 到着の数は決まっていないので、ユーザーは使い回す
+func Open(ctx context.Context, conf OpenConfig) *OpenResult {
+	asset.SetReuseUsers(true)
+
+	arrivals := make(chan time.Time, conf.MaxQueue)
+
+	var mu sync.Mutex
+	result := &OpenResult{Rate: conf.Rate}
+	queueTimes := []time.Duration{}
+	latencies := []time.Duration{}
+
+	for range conf.MaxInFlight {
+		go func() {
+			for {
+				var arrivedAt time.Time
+				select {
+				case arrivedAt = <-arrivals:
+				case <-ctx.Done():
+					return
+				}
+
+				startedAt := time.Now()
+				err := openTransaction(ctx)
+				if ctx.Err() != nil {
+					// 終了時に打ち切ったものは数えない
+					return
+				}
+				if err != nil {
+					fails.ErrorsForCheck.Add(err)
+				}
+
+				mu.Lock()
+				queueTimes = append(queueTimes, startedAt.Sub(arrivedAt))
+				latencies = append(latencies, time.Since(arrivedAt))
+				if err != nil {
+					result.Failed++
+				} else {
+					result.Completed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// 到着の時刻は予定の時刻にする。送る側が遅れても到着は遅らせない
+	next := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+L:
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			break L
+		}
+
+		for !next.After(time.Now()) {
+			mu.Lock()
+			result.Arrivals++
+			select {
+			case arrivals <- next:
+			default:
+				result.Dropped++
+			}
+			mu.Unlock()
+
+			next = next.Add(time.Duration(rand.ExpFloat64() / conf.Rate * float64(time.Second)))
+		}
+		timer.Reset(time.Until(next))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	result.Queued = len(arrivals)
+	session.SortDurations(queueTimes)
+	session.SortDurations(latencies)
+	result.QueueP50Ms = session.Percentile(queueTimes, 50).Milliseconds()
+	result.QueueP99Ms = session.Percentile(queueTimes, 99).Milliseconds()
+	result.QueueMaxMs = session.Percentile(queueTimes, 100).Milliseconds()
+	result.LatencyP50Ms = session.Percentile(latencies, 50).Milliseconds()
+	result.LatencyP99Ms = session.Percentile(latencies, 99).Milliseconds()
+	result.LatencyMaxMs = session.Percentile(latencies, 100).Milliseconds()
+
+	log.Printf("open: %d arrivals, %d completed, %d failed, %d dropped, %d queued", result.Arrivals, result.Completed, result.Failed, result.Dropped, result.Queued)
+	return result
+}
+
+// openTransaction は1回の到着で、出品した商品を別のユーザーが見て購入し、取引を完了させる
+func openTransaction(ctx context.Context) error {
+	s1, err := activeSellerSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	s2, err := buyerSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	price := priceStoreCache.Get()
+	targetItem, err := sell(ctx, s1, price)
+	if err != nil {
+		return err
+	}
+
+	err = loadGetItem(ctx, s2, targetItem.ID)
+	if err != nil {
+		return err
+	}
+
+	err = buyComplete(ctx, s1, s2, targetItem.ID, price)
+	if err != nil {
+		return err
+	}
+
+	ActiveSellerPool.Enqueue(s1)
+	BuyerPool.Enqueue(s2)
+	return nil
+}
@@ -0,0 +1,151 @@
+package scenario
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/isucon/isucon9-qualify/bench/asset"
+	"github.com/isucon/isucon9-qualify/bench/fails"
+	"github.com/isucon/isucon9-qualify/bench/session"
+)
+
+const (
+	DefaultRampStepInterval = 10 * time.Second
+	DefaultRampMaxWorkers   = 20
+	DefaultRampMaxErrorRate = 0.01
+	DefaultRampMaxP99       = 2 * time.Second
+)
+
+// RampConfig は負荷を段階的に上げるときの設定
+type RampConfig struct {
+	// StepInterval ごとに Load を1つ増やす
+	StepInterval time.Duration
+	MaxWorkers   int
+	// MaxErrorRate か MaxP99 を超えたら、その負荷は捌けていないとみなして止める
+	MaxErrorRate float64
+	MaxP99       time.Duration
+}
+
+// RampStep は1段階分の結果
+type RampStep struct {
+	Workers int `json:"workers"`
+	// Requests はこの段階で送ったリクエストの数。Errors はそのうちレスポンスが返らなかったか5XXを返した数
+	Requests  int     `json:"requests"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	// Failures はこの段階でベンチマーカーが検知したエラーの数
+	Failures int   `json:"failures"`
+	P99Ms    int64 `json:"p99_ms"`
+	// RequestsPerSec と TransactionsPerSec はこの段階の1秒あたりのリクエスト数と完了した取引の数
+	RequestsPerSec     float64 `json:"requests_per_sec"`
+	TransactionsPerSec float64 `json:"transactions_per_sec"`
+	Sustainable        bool    `json:"sustainable"`
+}
+
+// RampResult は段階的に負荷を上げた結果。最後に捌けていた段階の負荷が、アプリケーションが捌ける最大の負荷になる
+type RampResult struct {
+	Steps []RampStep `json:"steps"`
+
+	MaxSustainableWorkers            int     `json:"max_sustainable_workers"`
+	MaxSustainableRequestsPerSec     float64 `json:"max_sustainable_requests_per_sec"`
+	MaxSustainableTransactionsPerSec float64 `json:"max_sustainable_transactions_per_sec"`
+
+	StopReason string `json:"stop_reason"`
+}
+
+// Ramp は Load を1つずつ増やしながら、エラーの割合か p99 が閾値を超えるか MaxWorkers に達するまで負荷をかける
+// 通常の負荷走行と違い、Load は終わっても止めるまで繰り返すので、ユーザーは使い回す
+func Ramp(ctx context.Context, conf RampConfig) *RampResult {
+	asset.SetReuseUsers(true)
+
+	// Validation と同じく、止めたあとに Load が終わるのは待たない
+	// 待つとキャンセルしたリクエストのエラーが混ざる
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	addWorker := func(n int) {
+		go func() {
+			log.Printf("- Start Load worker %d", n)
+			for ctx.Err() == nil {
+				Load(ctx)
+			}
+		}()
+	}
+
+	result := &RampResult{}
+
+	session.Stats.Window()
+	_, cCnt, aCnt, tCnt := fails.ErrorsForCheck.Get()
+	failures := cCnt + aCnt + tCnt
+	done := sPayment.CountReports(asset.TransactionEvidenceStatusDone)
+
+	workers := 1
+	addWorker(workers)
+
+	ticker := time.NewTicker(conf.StepInterval)
+	defer ticker.Stop()
+	start := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			result.StopReason = "canceled"
+			return result
+		case now := <-ticker.C:
+			elapsed := now.Sub(start).Seconds()
+			start = now
+
+			w := session.Stats.Window()
+			_, cCnt, aCnt, tCnt := fails.ErrorsForCheck.Get()
+			stepFailures := cCnt + aCnt + tCnt - failures
+			failures += stepFailures
+			stepDone := sPayment.CountReports(asset.TransactionEvidenceStatusDone) - done
+			done += stepDone
+
+			step := RampStep{
+				Workers:            workers,
+				Requests:           w.Requests,
+				Errors:             w.Errors,
+				ErrorRate:          w.ErrorRate(),
+				Failures:           stepFailures,
+				P99Ms:              w.P99.Milliseconds(),
+				RequestsPerSec:     float64(w.Requests) / elapsed,
+				TransactionsPerSec: float64(stepDone) / elapsed,
+			}
+			// ベンチマーカーが検知したエラーもエラーの割合に含める
+			if w.Requests > 0 {
+				step.ErrorRate = float64(w.Errors+stepFailures) / float64(w.Requests)
+			}
+			step.Sustainable = step.ErrorRate <= conf.MaxErrorRate && w.P99 <= conf.MaxP99
+			result.Steps = append(result.Steps, step)
+			log.Printf("ramp: workers %d, %.1f req/s, %.2f trx/s, error rate %.3f, p99 %dms",
+				step.Workers, step.RequestsPerSec, step.TransactionsPerSec, step.ErrorRate, step.P99Ms)
+
+			if cCnt > 0 {
+				result.StopReason = "critical error"
+				return result
+			}
+			if !step.Sustainable {
+				result.StopReason = fmt.Sprintf("error rate %.3f or p99 %dms exceeded the threshold at %d workers", step.ErrorRate, step.P99Ms, workers)
+				return result
+			}
+
+			// 負荷を上げても処理量が増えるとは限らないので、捌けていた段階の最大をとる
+			result.MaxSustainableWorkers = step.Workers
+			if step.RequestsPerSec > result.MaxSustainableRequestsPerSec {
+				result.MaxSustainableRequestsPerSec = step.RequestsPerSec
+			}
+			if step.TransactionsPerSec > result.MaxSustainableTransactionsPerSec {
+				result.MaxSustainableTransactionsPerSec = step.TransactionsPerSec
+			}
+
+			if workers >= conf.MaxWorkers {
+				result.StopReason = fmt.Sprintf("reached max workers %d", conf.MaxWorkers)
+				return result
+			}
+			workers++
+			addWorker(workers)
+		}
+	}
+}
@@ -93,36 +93,60 @@ func Validation(ctx context.Context, campaign int) {
 	}
 }
 
-func FinalCheck(ctx context.Context) int64 {
+// FinalCheckResult は最終チェックでベンチマーカーの記録とアプリケーションの記録を突き合わせた結果
+type FinalCheckResult struct {
+	// Sales はdoneになった取引の売上の合計。減点する前のスコア
+	Sales int64
+	// ReportStatusCounts は決済サービスに記録された取引のステータスごとの件数
+	ReportStatusCounts map[string]int
+}
+
+func FinalCheck(ctx context.Context) FinalCheckResult {
 	reports := sPayment.GetReports()
 
+	result := FinalCheckResult{
+		ReportStatusCounts: make(map[string]int),
+	}
+	for _, report := range reports {
+		result.ReportStatusCounts[reportStatus(report.Status)]++
+	}
+	// 負荷をかけている途中で突き合わせた取引も含める
+	sales, statusCounts, reconciledID := getReconciled()
+	result.Sales += sales
+	for status, n := range statusCounts {
+		result.ReportStatusCounts[status] += n
+	}
+
 	s1, err := session.NewSession()
 	if err != nil {
 		fails.ErrorsForFinal.Add(err)
 
-		return 0
+		return result
 	}
 
 	tes, err := s1.Reports(ctx)
 	if err != nil {
 		fails.ErrorsForFinal.Add(err)
 
-		return 0
+		return result
 	}
 
-	var score int64
-
 	for _, te := range tes {
 		report, ok := reports[te.ItemID]
 		if !ok {
+			if te.ID <= reconciledID {
+				// 突き合わせが終わって忘れた取引
+				continue
+			}
 			fails.ErrorsForFinal.Add(failure.New(fails.ErrApplication, failure.Messagef("購入実績がありません transaction_evidence_id: %d; item_id: %d", te.ID, te.ItemID)))
 			continue
 		}
 
 		delete(reports, te.ItemID)
 
-		if report.Price != te.ItemPrice {
-			fails.ErrorsForFinal.Add(failure.New(fails.ErrApplication, failure.Messagef("購入実績の価格が異なります transaction_evidence_id: %d; item_id: %d; expected price: %d; reported price: %d", te.ID, te.ItemID, report.Price, te.ItemPrice)))
+		err := checkReportedPrice(te, report.Price, report.ListPrice)
+		if err != nil {
+			fails.ErrorsForFinal.Add(err)
 			continue
 		}
 
@@ -131,7 +155,7 @@ func FinalCheck(ctx context.Context) int64 {
 
 		if report.Status == asset.TransactionEvidenceStatusDone {
 			// doneの時だけが売り上げとして認められる
-			score += int64(report.Price)
+			result.Sales += int64(report.Price)
 		}
 	}
 
@@ -139,5 +163,25 @@ func FinalCheck(ctx context.Context) int64 {
 		fails.ErrorsForFinal.Add(failure.New(fails.ErrApplication, failure.Messagef("購入されたはずなのに記録されていません item_id: %d; expected price: %d", itemID, report.Price)))
 	}
 
-	return score
+	return result
+}
+
+// reportStatus は決済サービスに記録した取引のステータスを返す
+func reportStatus(status string) string {
+	if status == "" {
+		// 決済しただけの取引はステータスを記録していない
+		return asset.TransactionEvidenceStatusWaitShipping
+	}
+	return status
+}
+
+// checkReportedPrice は /reports.json の価格が決済した価格と同じかどうかを確かめる
+func checkReportedPrice(te session.TransactionEvidence, price, listPrice int) error {
+	if price == te.ItemPrice {
+		return nil
+	}
+	if listPrice != 0 {
+		return failure.New(fails.ErrApplication, failure.Messagef("購入実績の価格が交渉で合意した価格と異なります transaction_evidence_id: %d; item_id: %d; expected price: %d; list price: %d; reported price: %d", te.ID, te.ItemID, price, listPrice, te.ItemPrice))
+	}
+	return failure.New(fails.ErrApplication, failure.Messagef("購入実績の価格が異なります transaction_evidence_id: %d; item_id: %d; expected price: %d; reported price: %d", te.ID, te.ItemID, price, te.ItemPrice))
 }
@@ -0,0 +1,286 @@
+package scenario
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon9-qualify/bench/asset"
+	"github.com/isucon/isucon9-qualify/bench/fails"
+	"github.com/isucon/isucon9-qualify/bench/session"
+	"github.com/morikuni/failure"
+)
+
+const (
+	DefaultSoakDuration       = time.Hour
+	DefaultSoakInterval       = time.Minute
+	DefaultSoakWorkers        = 2
+	DefaultSoakLatencyDrift   = 0.5
+	DefaultSoakErrorRateDrift = 0.01
+	DefaultSoakMaxItems       = 50000
+
+	// soakBaselineSnapshots 回分のスナップショットの平均を基準にして、それより後の変化を見る
+	soakBaselineSnapshots = 3
+	// soakLatencyMinDrift より小さいp99の変化は誤差とみなす
+	soakLatencyMinDrift = 50 * time.Millisecond
+	// soakAbandonAfter を過ぎても完了しない取引は、途中で失敗したとみなして突き合わせから外す
+	soakAbandonAfter = 10 * time.Minute
+)
+
+// SoakConfig は長時間負荷をかけるときの設定
+type SoakConfig struct {
+	Duration time.Duration
+	// Interval ごとにスナップショットをとって取引を突き合わせる
+	Interval time.Duration
+	// Workers は同時に動かす Load の数
+	Workers int
+	// LatencyDrift はp99が基準から何割上がったら劣化とみなすか
+	LatencyDrift float64
+	// ErrorRateDrift はエラーの割合が基準からいくつ上がったら劣化とみなすか
+	ErrorRateDrift float64
+	// MaxItems を超えたらベンチマーカーが出品した商品を古いものから忘れる
+	MaxItems int
+}
+
+// SoakSnapshot は1回分のスナップショット。数はすべてその期間のもの
+type SoakSnapshot struct {
+	ElapsedSec     int64   `json:"elapsed_sec"`
+	Requests       int     `json:"requests"`
+	Errors         int     `json:"errors"`
+	Failures       int     `json:"failures"`
+	ErrorRate      float64 `json:"error_rate"`
+	RequestsPerSec float64 `json:"requests_per_sec"`
+	P50Ms          int64   `json:"p50_ms"`
+	P99Ms          int64   `json:"p99_ms"`
+	// Reconciled は突き合わせが終わった取引の数。Pending はまだ完了していない取引の数
+	Reconciled int `json:"reconciled"`
+	Abandoned  int `json:"abandoned"`
+	Pending    int `json:"pending"`
+	// PrunedItems は忘れた商品の数。HeapMB はベンチマーカー自身のヒープの大きさ
+	PrunedItems int     `json:"pruned_items"`
+	HeapMB      float64 `json:"heap_mb"`
+	Drift       bool    `json:"drift"`
+}
+
+// SoakResult は長時間負荷をかけた結果。Drifts に基準から劣化したスナップショットの説明が入る
+type SoakResult struct {
+	Snapshots         []SoakSnapshot `json:"snapshots"`
+	BaselineP99Ms     int64          `json:"baseline_p99_ms"`
+	BaselineErrorRate float64        `json:"baseline_error_rate"`
+	Drifts            []string       `json:"drifts"`
+	Reconciled        int            `json:"reconciled"`
+	Abandoned         int            `json:"abandoned"`
+}
+
+// reconciled は負荷をかけている途中で突き合わせが終わって忘れた取引の集計
+// FinalCheck はこれを足し、transactionEvidenceID 以下の取引は決済の記録がなくてもエラーにしない
+var reconciled = struct {
+	sync.Mutex
+
+	sales                 int64
+	statusCounts          map[string]int
+	transactionEvidenceID int64
+}{
+	statusCounts: make(map[string]int),
+}
+
+func getReconciled() (int64, map[string]int, int64) {
+	reconciled.Lock()
+	defer reconciled.Unlock()
+
+	statusCounts := make(map[string]int, len(reconciled.statusCounts))
+	for status, n := range reconciled.statusCounts {
+		statusCounts[status] = n
+	}
+	return reconciled.sales, statusCounts, reconciled.transactionEvidenceID
+}
+
+// Soak は Duration の間 Load を繰り返し、Interval ごとにレスポンスタイムとエラーの割合を記録して取引を突き合わせる
+// メモリを使い切らないように、突き合わせた取引と古い商品は忘れ、ユーザーは使い回す
+func Soak(ctx context.Context, conf SoakConfig) *SoakResult {
+	asset.SetReuseUsers(true)
+
+	// Validation と同じく、止めたあとに Load が終わるのは待たない
+	ctx, cancel := context.WithTimeout(ctx, conf.Duration)
+	defer cancel()
+
+	for i := range conf.Workers {
+		go func() {
+			log.Printf("- Start Load worker %d", i+1)
+			for ctx.Err() == nil {
+				Load(ctx)
+			}
+		}()
+	}
+
+	result := &SoakResult{Drifts: []string{}}
+
+	session.Stats.Window()
+	_, cCnt, aCnt, tCnt := fails.ErrorsForCheck.Get()
+	failures := cCnt + aCnt + tCnt
+
+	ticker := time.NewTicker(conf.Interval)
+	defer ticker.Stop()
+	start := time.Now()
+	last := start
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return result
+		case now = <-ticker.C:
+		}
+
+		w := session.Stats.Window()
+		_, cCnt, aCnt, tCnt := fails.ErrorsForCheck.Get()
+		stepFailures := cCnt + aCnt + tCnt - failures
+		failures += stepFailures
+
+		snapshot := SoakSnapshot{
+			ElapsedSec:     int64(now.Sub(start).Seconds()),
+			Requests:       w.Requests,
+			Errors:         w.Errors,
+			Failures:       stepFailures,
+			RequestsPerSec: float64(w.Requests) / now.Sub(last).Seconds(),
+			P50Ms:          w.P50.Milliseconds(),
+			P99Ms:          w.P99.Milliseconds(),
+		}
+		last = now
+		if w.Requests > 0 {
+			// ベンチマーカーが検知したエラーもエラーの割合に含める
+			snapshot.ErrorRate = float64(w.Errors+stepFailures) / float64(w.Requests)
+		}
+
+		snapshot.Reconciled, snapshot.Abandoned, snapshot.Pending = reconcileReports(ctx)
+		result.Reconciled += snapshot.Reconciled
+		result.Abandoned += snapshot.Abandoned
+		snapshot.PrunedItems = asset.PruneItems(conf.MaxItems)
+
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		snapshot.HeapMB = float64(m.HeapAlloc) / 1024 / 1024
+
+		if len(result.Snapshots) >= soakBaselineSnapshots {
+			if drift := soakDrift(result, snapshot, conf); drift != "" {
+				snapshot.Drift = true
+				result.Drifts = append(result.Drifts, drift)
+				log.Print("soak: " + drift)
+			}
+		}
+		result.Snapshots = append(result.Snapshots, snapshot)
+		if len(result.Snapshots) == soakBaselineSnapshots {
+			setSoakBaseline(result)
+		}
+
+		log.Printf("soak: %ds, %.1f req/s, error rate %.3f, p50 %dms, p99 %dms, reconciled %d, pending %d, heap %.1fMB",
+			snapshot.ElapsedSec, snapshot.RequestsPerSec, snapshot.ErrorRate, snapshot.P50Ms, snapshot.P99Ms, snapshot.Reconciled, snapshot.Pending, snapshot.HeapMB)
+	}
+}
+
+func setSoakBaseline(result *SoakResult) {
+	var p99 int64
+	var errorRate float64
+	for _, s := range result.Snapshots {
+		p99 += s.P99Ms
+		errorRate += s.ErrorRate
+	}
+	result.BaselineP99Ms = p99 / int64(len(result.Snapshots))
+	result.BaselineErrorRate = errorRate / float64(len(result.Snapshots))
+}
+
+// soakDrift は基準からp99かエラーの割合が閾値を超えて上がっていれば説明を返す
+func soakDrift(result *SoakResult, s SoakSnapshot, conf SoakConfig) string {
+	latency := s.P99Ms-result.BaselineP99Ms >= soakLatencyMinDrift.Milliseconds() &&
+		float64(s.P99Ms) > float64(result.BaselineP99Ms)*(1+conf.LatencyDrift)
+	errorRate := s.ErrorRate > result.BaselineErrorRate+conf.ErrorRateDrift
+
+	if !latency && !errorRate {
+		return ""
+	}
+	return fmt.Sprintf("%ds: p99 %dms (baseline %dms), error rate %.3f (baseline %.3f)",
+		s.ElapsedSec, s.P99Ms, result.BaselineP99Ms, s.ErrorRate, result.BaselineErrorRate)
+}
+
+// reconcileReports は FinalCheck と同じように決済サービスの記録と /reports.json を突き合わせる
+// 完了した取引と soakAbandonAfter を過ぎた取引は突き合わせたら忘れる。まだ完了していない取引は次に回す
+// 決済の記録は transaction_evidence より先にできるので、/reports.json を取ってから決済の記録をコピーする。
+// 逆にすると、コピーしたあとに購入された取引の決済の記録が見つからずエラーになってしまう
+func reconcileReports(ctx context.Context) (reconciledCount, abandoned, pending int) {
+	fetchedAt := time.Now()
+	s1, err := session.NewSession()
+	if err != nil {
+		fails.ErrorsForCheck.Add(err)
+		return 0, 0, len(sPayment.CopyReports())
+	}
+	tes, err := s1.Reports(ctx)
+	if err != nil {
+		fails.ErrorsForCheck.Add(err)
+		return 0, 0, len(sPayment.CopyReports())
+	}
+
+	reports := sPayment.CopyReports()
+
+	_, _, checkedID := getReconciled()
+	maxID := checkedID
+	tesByItemID := make(map[int64]session.TransactionEvidence, len(tes))
+	for _, te := range tes {
+		tesByItemID[te.ItemID] = te
+		if te.ID > maxID {
+			maxID = te.ID
+		}
+		// 前回までに確かめた取引は決済の記録を忘れているかもしれない
+		if te.ID <= checkedID {
+			continue
+		}
+		if _, ok := reports[te.ItemID]; !ok {
+			fails.ErrorsForCheck.Add(failure.New(fails.ErrApplication, failure.Messagef("購入実績がありません transaction_evidence_id: %d; item_id: %d", te.ID, te.ItemID)))
+		}
+	}
+
+	var sales int64
+	statusCounts := make(map[string]int)
+	forget := []int64{}
+	for itemID, report := range reports {
+		done := report.Status == asset.TransactionEvidenceStatusDone
+		if !done && time.Since(report.CreatedAt) < soakAbandonAfter {
+			pending++
+			continue
+		}
+
+		te, ok := tesByItemID[itemID]
+		if !ok && !report.CreatedAt.Before(fetchedAt) {
+			// /reports.json を取ったあとに購入された取引なので次に回す
+			pending++
+			continue
+		}
+		if !ok {
+			fails.ErrorsForCheck.Add(failure.New(fails.ErrApplication, failure.Messagef("購入されたはずなのに記録されていません item_id: %d; expected price: %d", itemID, report.Price)))
+		} else if err := checkReportedPrice(te, report.Price, report.ListPrice); err != nil {
+			fails.ErrorsForCheck.Add(err)
+		} else if done {
+			sales += int64(report.Price)
+		}
+
+		if done {
+			reconciledCount++
+		} else {
+			abandoned++
+		}
+		statusCounts[reportStatus(report.Status)]++
+		forget = append(forget, itemID)
+	}
+	sPayment.DeleteReports(forget)
+
+	reconciled.Lock()
+	reconciled.sales += sales
+	for status, n := range statusCounts {
+		reconciled.statusCounts[status] += n
+	}
+	reconciled.transactionEvidenceID = maxID
+	reconciled.Unlock()
+
+	return reconciledCount, abandoned, pending
+}
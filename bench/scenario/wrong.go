@@ -3,6 +3,7 @@ package scenario
 import (
 	"context"
 	"fmt"
+	"math/rand/v2"
 	"net/http"
 	"os"
 
@@ -27,6 +28,72 @@ func irregularLoginWrongPassword(ctx context.Context, user1 asset.AppUser) error
 	return nil
 }
 
+// irregularLoginLockout は存在しないアカウントで失敗を重ねてロックされることを確認する
+// ベンチマーカーのユーザーをロックしないように毎回新しいアカウント名を使う
+func irregularLoginLockout(ctx context.Context, user1 asset.AppUser) error {
+	s1, err := session.NewSession()
+	if err != nil {
+		return err
+	}
+
+	accountName := fmt.Sprintf("lockout_%x", rand.Uint64())
+
+	for range session.LoginAccountLimit {
+		err = s1.LoginWithWrongPassword(ctx, accountName, "password")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s1.LoginWithLockout(ctx, accountName, "password")
+	if err != nil {
+		return err
+	}
+
+	// 同じIPからでも他のアカウントはロックされていない
+	_, err = loginedSession(ctx, user1)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func irregularLogout(ctx context.Context, user1 asset.AppUser) error {
+	s1, err := loginedSession(ctx, user1)
+	if err != nil {
+		return err
+	}
+
+	err = s1.LogoutWithWrongCSRFToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	// パスワードを変更すると他のセッションがすべて無効になるので、ここでは失敗するものだけ確認する
+	err = s1.ChangePasswordWithWrongCSRFToken(ctx, user1.Password, user1.Password+"new")
+	if err != nil {
+		return err
+	}
+
+	err = s1.ChangePasswordWithWrongPassword(ctx, user1.Password+"wrong", user1.Password+"new")
+	if err != nil {
+		return err
+	}
+
+	err = s1.Logout(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = s1.SettingsWithLoggedOut(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func irregularSellAndBuy(ctx context.Context, s1, s2 *session.Session, user3 asset.AppUser) error {
 	fileName, name, description, categoryID := asset.GetRandomImageFileName(), asset.GenText(8, false), asset.GenText(200, true), asset.GetRandomChildCategory().ID
 
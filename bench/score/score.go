@@ -0,0 +1,211 @@
+package score
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/isucon/isucon9-qualify/bench/session"
+)
+
+const (
+	PolicyContest    = "contest"
+	PolicyThroughput = "throughput"
+	PolicyLatencySLO = "latency-slo"
+	PolicyStrict     = "strict"
+
+	DefaultSLO = 1 * time.Second
+)
+
+// Input は採点に使う材料。負荷走行の直後は Sales と TransactionStatusCounts が入っていない
+type Input struct {
+	CriticalErrors    int
+	ApplicationErrors int
+	TimeoutErrors     int
+
+	// Sales はdoneになった取引の売上の合計
+	Sales int64
+	// TransactionStatusCounts は決済サービスに記録された取引のステータスごとの件数
+	TransactionStatusCounts map[string]int
+
+	Campaign  int
+	Endpoints []session.EndpointStat
+}
+
+// Breakdown はスコアの内訳。Sales から減点を引いたものがスコアになる
+type Breakdown struct {
+	Policy                  string         `json:"policy"`
+	Sales                   int64          `json:"sales"`
+	TransactionStatusCounts map[string]int `json:"transaction_status_counts"`
+	ApplicationErrors       int            `json:"application_errors"`
+	ApplicationErrorPenalty int64          `json:"application_error_penalty"`
+	TimeoutErrors           int            `json:"timeout_errors"`
+	TimeoutPenalty          int64          `json:"timeout_penalty"`
+	// LatencyPenalty はレスポンスタイムの目標を守れなかったことによる減点。latency-slo のときだけ入る
+	LatencyPenalty int64 `json:"latency_penalty,omitempty"`
+	Campaign       int   `json:"campaign"`
+}
+
+func (b *Breakdown) Log() {
+	log.Printf("policy: %s", b.Policy)
+	log.Printf("sales: %d (transactions: %v)", b.Sales, b.TransactionStatusCounts)
+	log.Printf("application errors: %d (penalty: %d)", b.ApplicationErrors, b.ApplicationErrorPenalty)
+	log.Printf("timeout errors: %d (penalty: %d)", b.TimeoutErrors, b.TimeoutPenalty)
+	if b.LatencyPenalty > 0 {
+		log.Printf("latency penalty: %d", b.LatencyPenalty)
+	}
+	log.Printf("campaign: %d", b.Campaign)
+}
+
+type Result struct {
+	Pass      bool
+	Score     int64
+	Breakdown *Breakdown
+}
+
+// Policy は失格の条件とスコアの計算方法
+type Policy interface {
+	Name() string
+	// Abort は負荷走行の直後に、最終チェックに進まずに失格にするなら true を返す
+	Abort(in Input) bool
+	// Score は最終チェックのあとにスコアを計算する。失格なら Pass が false で Score が0になる
+	Score(in Input) Result
+}
+
+// Options は一部のポリシーだけが使う設定
+type Options struct {
+	// SLO は latency-slo で各エンドポイントの p99 の目標にするレスポンスタイム
+	SLO time.Duration
+}
+
+// Policies は -scoring に指定できるポリシーの名前
+func Policies() []string {
+	return []string{PolicyContest, PolicyThroughput, PolicyLatencySLO, PolicyStrict}
+}
+
+func NewPolicy(name string, opts Options) (Policy, error) {
+	switch name {
+	case PolicyContest:
+		return contestPolicy{}, nil
+	case PolicyThroughput:
+		return throughputPolicy{}, nil
+	case PolicyLatencySLO:
+		if opts.SLO <= 0 {
+			return nil, fmt.Errorf("slo must be positive")
+		}
+		return latencySLOPolicy{slo: opts.SLO}, nil
+	case PolicyStrict:
+		return strictPolicy{}, nil
+	}
+	return nil, fmt.Errorf("unknown scoring policy: %s", name)
+}
+
+// newBreakdown は本番のルールで減点を計算した内訳を返す
+func newBreakdown(policy string, in Input) *Breakdown {
+	b := &Breakdown{
+		Policy:                  policy,
+		Sales:                   in.Sales,
+		TransactionStatusCounts: in.TransactionStatusCounts,
+		ApplicationErrors:       in.ApplicationErrors,
+		// application errorは1回で500点減点
+		ApplicationErrorPenalty: int64(500 * in.ApplicationErrors),
+		TimeoutErrors:           in.TimeoutErrors,
+		Campaign:                in.Campaign,
+	}
+	if in.TimeoutErrors > 200 {
+		// trivial errorは200回を超えたら100回毎に5000点減点
+		b.TimeoutPenalty = int64(5000 * (1 + (in.TimeoutErrors-200)/100))
+	}
+	return b
+}
+
+// newResult は内訳からスコアを計算する。0点以下なら失格
+func newResult(b *Breakdown) Result {
+	s := b.Sales - b.ApplicationErrorPenalty - b.TimeoutPenalty - b.LatencyPenalty
+	if s <= 0 {
+		return Result{Pass: false, Score: 0, Breakdown: b}
+	}
+	return Result{Pass: true, Score: s, Breakdown: b}
+}
+
+// contestPolicy は本番のルール
+// critical errorは1つでもあれば、application errorは10回以上で失格
+type contestPolicy struct{}
+
+func (contestPolicy) Name() string { return PolicyContest }
+
+func (contestPolicy) Abort(in Input) bool {
+	return in.CriticalErrors > 0 || in.ApplicationErrors >= 10
+}
+
+func (contestPolicy) Score(in Input) Result {
+	b := newBreakdown(PolicyContest, in)
+	if in.ApplicationErrors >= 10 {
+		return Result{Pass: false, Score: 0, Breakdown: b}
+	}
+	return newResult(b)
+}
+
+// throughputPolicy は売上だけをスコアにする。どこまで捌けるかを見る負荷試験向けで、
+// critical error以外では失格にせず減点もしない
+type throughputPolicy struct{}
+
+func (throughputPolicy) Name() string { return PolicyThroughput }
+
+func (throughputPolicy) Abort(in Input) bool {
+	return in.CriticalErrors > 0
+}
+
+func (throughputPolicy) Score(in Input) Result {
+	b := newBreakdown(PolicyThroughput, in)
+	b.ApplicationErrorPenalty = 0
+	b.TimeoutPenalty = 0
+	return newResult(b)
+}
+
+// latencySLOPolicy は本番のルールに加えて、p99 が slo を超えたエンドポイントへのリクエストの割合だけスコアを減らす
+type latencySLOPolicy struct {
+	slo time.Duration
+}
+
+func (latencySLOPolicy) Name() string { return PolicyLatencySLO }
+
+func (p latencySLOPolicy) Abort(in Input) bool {
+	return contestPolicy{}.Abort(in)
+}
+
+func (p latencySLOPolicy) Score(in Input) Result {
+	b := newBreakdown(PolicyLatencySLO, in)
+	if in.ApplicationErrors >= 10 {
+		return Result{Pass: false, Score: 0, Breakdown: b}
+	}
+
+	total, violated := 0, 0
+	for _, e := range in.Endpoints {
+		total += e.Count
+		if time.Duration(e.P99Ms)*time.Millisecond > p.slo {
+			violated += e.Count
+		}
+	}
+	if s := b.Sales - b.ApplicationErrorPenalty - b.TimeoutPenalty; s > 0 && total > 0 {
+		b.LatencyPenalty = s * int64(violated) / int64(total)
+	}
+	return newResult(b)
+}
+
+// strictPolicy は正しさを重視する。critical errorとapplication errorは1回でも失格
+type strictPolicy struct{}
+
+func (strictPolicy) Name() string { return PolicyStrict }
+
+func (strictPolicy) Abort(in Input) bool {
+	return in.CriticalErrors > 0 || in.ApplicationErrors > 0
+}
+
+func (strictPolicy) Score(in Input) Result {
+	b := newBreakdown(PolicyStrict, in)
+	if in.ApplicationErrors > 0 {
+		return Result{Pass: false, Score: 0, Breakdown: b}
+	}
+	return newResult(b)
+}
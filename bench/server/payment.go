@@ -20,6 +20,9 @@ const (
 	IsucariShopID = "11"
 )
 
+// DefaultCardTokenTTL はカードのトークンを発行してから使えなくなるまでの時間
+const DefaultCardTokenTTL = 5 * time.Minute
+
 var (
 	regex = regexp.MustCompile("^[0-9A-F]{8}$")
 )
@@ -44,9 +47,17 @@ type tokenRes struct {
 	Status string `json:"status"`
 }
 
+// cardTokenStore はトークンが使われるまで覚えておく
+// 使われなかったトークンは Sweep で消し、max 件を超えたら期限の近いものから消す
 type cardTokenStore struct {
 	sync.Mutex
 	items map[string]cardToken
+
+	ttl time.Duration
+	max int
+
+	expired int64
+	evicted int64
 }
 
 type cardToken struct {
@@ -56,12 +67,15 @@ type cardToken struct {
 	// for benchmarker
 	itemID int64
 	price  int
+	// 値下げ交渉で合意した価格で決済する場合の出品価格
+	listPrice int
 }
 
 func newCardToken() *cardTokenStore {
 	m := make(map[string]cardToken)
 	c := &cardTokenStore{
 		items: m,
+		ttl:   DefaultCardTokenTTL,
 	}
 	return c
 }
@@ -75,13 +89,20 @@ func secureRandomStr(b int) string {
 }
 
 func (c *cardTokenStore) Set(card string) string {
+	return c.add(cardToken{
+		number: card,
+	})
+}
+
+// add は期限を付けてトークンを発行する
+func (c *cardTokenStore) add(ct cardToken) string {
 	token := secureRandomStr(20)
-	expire := time.Now().Add(5 * time.Minute)
 	c.Lock()
-	c.items[token] = cardToken{
-		number: card,
-		expire: expire,
-	}
+	ct.expire = time.Now().Add(c.ttl)
+	c.evicted += int64(evictOldest(c.items, c.max, nil, func(a, b cardToken) bool {
+		return a.expire.Before(b.expire)
+	}))
+	c.items[token] = ct
 	c.Unlock()
 
 	return token
@@ -89,17 +110,57 @@ func (c *cardTokenStore) Set(card string) string {
 
 func (c *cardTokenStore) Get(token string) (cardToken, bool) {
 	c.Lock()
+	defer c.Unlock()
+
 	v, found := c.items[token]
 	delete(c.items, token)
-	c.Unlock()
 
 	if time.Now().After(v.expire) {
+		if found {
+			c.expired++
+		}
 		return cardToken{}, false
 	}
 
 	return v, found
 }
 
+// SetLimit は発行してから使えなくなるまでの時間と覚えておく件数の上限を変える。max が0なら上限なし
+func (c *cardTokenStore) SetLimit(ttl time.Duration, max int) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.ttl = ttl
+	c.max = max
+	c.evicted += int64(evictOldest(c.items, c.max, nil, func(a, b cardToken) bool {
+		return a.expire.Before(b.expire)
+	}))
+}
+
+// Sweep は期限切れのトークンを消す
+func (c *cardTokenStore) Sweep(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	for token, ct := range c.items {
+		if now.After(ct.expire) {
+			delete(c.items, token)
+			c.expired++
+		}
+	}
+}
+
+func (c *cardTokenStore) Stats() StoreStats {
+	c.Lock()
+	defer c.Unlock()
+
+	return StoreStats{
+		Entries: len(c.items),
+		Expired: c.expired,
+		Evicted: c.evicted,
+	}
+}
+
 func newReports() *reportStore {
 	m := make(map[int64]report)
 	c := &reportStore{
@@ -114,11 +175,15 @@ type reportStore struct {
 }
 
 type report struct {
-	Price  int
-	Status string
+	Price int
+	// 交渉で合意した価格で決済した場合の出品価格。交渉していなければ0
+	ListPrice int
+	Status    string
+	// CreatedAt は決済した時刻
+	CreatedAt time.Time
 }
 
-func (c *reportStore) Set(itemID int64, price int) {
+func (c *reportStore) Set(itemID int64, price, listPrice int) {
 	c.Lock()
 	defer c.Unlock()
 
@@ -129,9 +194,11 @@ func (c *reportStore) Set(itemID int64, price int) {
 	}
 
 	c.items[itemID] = report{
-		Price: price,
+		Price:     price,
+		ListPrice: listPrice,
 		// statusがdoneになったかどうかだけを確認しているので、初期化時は特に必要ない
 		// Status: asset.TransactionEvidenceStatusWaitShipping,
+		CreatedAt: time.Now(),
 	}
 }
 
@@ -160,6 +227,7 @@ func NewPayment(allowedIPs []net.IP) *ServerPayment {
 
 	s.mux.Handle("/card", apply(http.HandlerFunc(s.cardHandler), s.withDelay(), s.withIPRestriction()))
 	s.mux.Handle("/token", apply(http.HandlerFunc(s.tokenHandler), s.withDelay(), s.withIPRestriction()))
+	s.mux.Handle("/stats", apply(http.HandlerFunc(s.statsHandler), s.withIPRestriction()))
 
 	return s
 }
@@ -231,7 +299,11 @@ func (s *ServerPayment) tokenHandler(w http.ResponseWriter, req *http.Request) {
 	if ct.price != 0 {
 		if ct.price != tr.Price {
 			// エラーにはするが処理を継続する
-			fails.ErrorsForCheck.Add(failure.New(fails.ErrCritical, failure.Messagef("決済額に誤りがあります expected: %d; actual: %d", ct.price, tr.Price)))
+			if ct.listPrice != 0 && ct.listPrice == tr.Price {
+				fails.ErrorsForCheck.Add(failure.New(fails.ErrCritical, failure.Messagef("交渉で合意した価格ではなく出品価格で決済されています (item_id: %d) expected: %d; actual: %d", ct.itemID, ct.price, tr.Price)))
+			} else {
+				fails.ErrorsForCheck.Add(failure.New(fails.ErrCritical, failure.Messagef("決済額に誤りがあります expected: %d; actual: %d", ct.price, tr.Price)))
+			}
 
 			b, _ := json.Marshal(result)
 
@@ -240,7 +312,7 @@ func (s *ServerPayment) tokenHandler(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		s.reports.Set(ct.itemID, ct.price)
+		s.reports.Set(ct.itemID, ct.price, ct.listPrice)
 	}
 
 	json.NewEncoder(w).Encode(result)
@@ -303,20 +375,51 @@ func (s *ServerPayment) cardHandler(w http.ResponseWriter, req *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
+// statsHandler はトークンの件数と、期限切れや上限で消した件数を返す
+func (s *ServerPayment) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeStoreStats(w, s.cardTokens.Stats())
+}
+
+// SetTokenLimit はトークンの有効期限と覚えておく件数の上限を変える。max が0なら上限なし
+func (s *ServerPayment) SetTokenLimit(ttl time.Duration, max int) {
+	s.cardTokens.SetLimit(ttl, max)
+}
+
+// RunSweeper は interval ごとに期限切れのトークンを消す。止まらないので goroutine で呼ぶ
+func (s *ServerPayment) RunSweeper(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		s.cardTokens.Sweep(now)
+	}
+}
+
+// TokenStats はトークンの件数と、期限切れや上限で消した件数を返す
+func (s *ServerPayment) TokenStats() StoreStats {
+	return s.cardTokens.Stats()
+}
+
 // ForceSet is the function for benchmarker
 func (s *ServerPayment) ForceSet(card string, itemID int64, price int) string {
-	token := secureRandomStr(20)
-	expire := time.Now().Add(5 * time.Minute)
-	s.cardTokens.Lock()
-	s.cardTokens.items[token] = cardToken{
+	return s.cardTokens.add(cardToken{
 		number: card,
-		expire: expire,
 		itemID: itemID,
 		price:  price,
-	}
-	s.cardTokens.Unlock()
+	})
+}
 
-	return token
+// ForceSetWithOffer is the function for benchmarker
+// 値下げ交渉が成立した商品の購入用。出品価格ではなく合意した価格での決済を期待する
+func (s *ServerPayment) ForceSetWithOffer(card string, itemID int64, listPrice, offerPrice int) string {
+	return s.cardTokens.add(cardToken{
+		number:    card,
+		itemID:    itemID,
+		price:     offerPrice,
+		listPrice: listPrice,
+	})
 }
 
 // ForceReportsSetStatus is the function for benchmarker
@@ -324,6 +427,45 @@ func (s *ServerPayment) ForceReportsSetStatus(itemID int64, status string) {
 	s.reports.SetStatus(itemID, status)
 }
 
+// CountReports is the function for benchmarker
+// status の取引の件数を返す
+func (s *ServerPayment) CountReports(status string) int {
+	s.reports.Lock()
+	defer s.reports.Unlock()
+
+	n := 0
+	for _, r := range s.reports.items {
+		if r.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// CopyReports is the function for benchmarker
+// 負荷をかけている途中でも読めるようにコピーを返す
+func (s *ServerPayment) CopyReports() map[int64]report {
+	s.reports.Lock()
+	defer s.reports.Unlock()
+
+	reports := make(map[int64]report, len(s.reports.items))
+	for itemID, r := range s.reports.items {
+		reports[itemID] = r
+	}
+	return reports
+}
+
+// DeleteReports is the function for benchmarker
+// 突き合わせが終わった取引を忘れる。長時間負荷をかけてもメモリを使い切らないように
+func (s *ServerPayment) DeleteReports(itemIDs []int64) {
+	s.reports.Lock()
+	defer s.reports.Unlock()
+
+	for _, itemID := range itemIDs {
+		delete(s.reports.items, itemID)
+	}
+}
+
 // GetReports is the function for benchmarker
 // コピーはしていないので注意
 func (s *ServerPayment) GetReports() map[int64]report {
@@ -79,6 +79,50 @@ func (s *Server) withIPRestriction() Adapter {
 	}
 }
 
+// StoreStats はメモリ上のストアの件数と、期限切れで消した件数、上限を超えたので消した件数
+type StoreStats struct {
+	Entries int   `json:"entries"`
+	Expired int64 `json:"expired"`
+	Evicted int64 `json:"evicted"`
+}
+
+func writeStoreStats(w http.ResponseWriter, stats StoreStats) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// evictOldest は items が max 件を超えていたら evictable なものを older で古い順に消して、消した件数を返す。max が0なら上限なし
+// evictable が nil ならどれでも消してよい
+// 追加のたびに並べ替えなくて済むように、上限の1割だけ余分に消す
+func evictOldest[V any](items map[string]V, max int, evictable func(V) bool, older func(a, b V) bool) int {
+	if max <= 0 || len(items) < max {
+		return 0
+	}
+	n := len(items) - max + 1 + max/10
+
+	keys := make([]string, 0, len(items))
+	for key, value := range items {
+		if evictable != nil && !evictable(value) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		if older(items[a], items[b]) {
+			return -1
+		}
+		if older(items[b], items[a]) {
+			return 1
+		}
+		return 0
+	})
+	n = min(n, len(keys))
+	for _, key := range keys[:n] {
+		delete(items, key)
+	}
+	return n
+}
+
 func apply(h http.Handler, adapters ...Adapter) http.Handler {
 	for _, adpt := range adapters {
 		h = adpt(h)
@@ -119,9 +163,17 @@ func RunServer(paymentPort, shipmentPort int, dataDir string, allowedIPs []net.I
 
 	liShipment, err := net.ListenTCP("tcp", &net.TCPAddr{Port: shipmentPort})
 	if err != nil {
+		liPayment.Close()
 		return nil, nil, err
 	}
 
+	pay, ship := RunServerOnListeners(liPayment, liShipment, dataDir, allowedIPs)
+	return pay, ship, nil
+}
+
+// RunServerOnListeners は開いてある listener で外部サービスを起動する
+// ベンチマーカーを起動したプロセスが開いたままのポートを受け取るときに使う
+func RunServerOnListeners(liPayment, liShipment net.Listener, dataDir string, allowedIPs []net.IP) (*ServerPayment, *ServerShipment) {
 	pay := NewPayment(allowedIPs)
 	serverPayment := &http.Server{
 		Handler: pay,
@@ -136,9 +188,12 @@ func RunServer(paymentPort, shipmentPort int, dataDir string, allowedIPs []net.I
 		log.Print(serverPayment.Serve(liPayment))
 	}()
 
+	// 期限切れのトークンはもう使えないので、ベンチマーカーの中でも消してよい
+	go pay.RunSweeper(time.Minute)
+
 	go func() {
 		log.Print(serverShipment.Serve(liShipment))
 	}()
 
-	return pay, ship, nil
+	return pay, ship
 }
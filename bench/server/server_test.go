@@ -0,0 +1,49 @@
+package server
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestEvictOldest(t *testing.T) {
+	// 値が小さいほど古い。負の値は消せない
+	older := func(a, b int) bool { return a < b }
+	evictable := func(v int) bool { return v >= 0 }
+
+	tests := []struct {
+		name      string
+		items     map[string]int
+		max       int
+		evictable func(int) bool
+		want      []string
+	}{
+		{"no limit", map[string]int{"a": 1, "b": 2}, 0, nil, []string{"a", "b"}},
+		{"under max", map[string]int{"a": 1, "b": 2}, 3, nil, []string{"a", "b"}},
+		// 1件足せるように空ける
+		{"at max", map[string]int{"a": 3, "b": 1, "c": 2}, 3, nil, []string{"a", "c"}},
+		{"over max", map[string]int{"a": 3, "b": 1, "c": 2, "d": 4}, 3, nil, []string{"a", "d"}},
+		// max/10 件は余分に消す
+		{"extra", map[string]int{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5, "f": 6, "g": 7, "h": 8, "i": 9, "j": 10}, 10, nil, []string{"c", "d", "e", "f", "g", "h", "i", "j"}},
+		{"skip not evictable", map[string]int{"a": -2, "b": 1, "c": 2}, 3, evictable, []string{"a", "c"}},
+		{"nothing evictable", map[string]int{"a": -2, "b": -1, "c": -3}, 3, evictable, []string{"a", "b", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(tt.items)
+			n := evictOldest(tt.items, tt.max, tt.evictable, older)
+
+			got := make([]string, 0, len(tt.items))
+			for key := range tt.items {
+				got = append(got, key)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("remaining = %v, want %v", got, tt.want)
+			}
+			if n != before-len(tt.items) {
+				t.Errorf("evicted = %d, want %d", n, before-len(tt.items))
+			}
+		})
+	}
+}
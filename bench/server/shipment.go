@@ -55,6 +55,18 @@ type shipment struct {
 	QRMD5           string    `json:"-"`
 	ReserveDatetime time.Time `json:"-"`
 	DoneDatetime    time.Time `json:"-"`
+	// CompletedAt は配送が完了した(する)時刻。完了していなければゼロ
+	CompletedAt time.Time `json:"-"`
+}
+
+// completed は now の時点で配送が完了しているかどうか
+func (s shipment) completed(now time.Time) bool {
+	return !s.CompletedAt.IsZero() && !now.Before(s.CompletedAt)
+}
+
+// olderShipment は上限を超えたときに a を b より先に消すかどうか。完了が古い順に消す
+func olderShipment(a, b shipment) bool {
+	return a.CompletedAt.Before(b.CompletedAt)
 }
 
 type shipmentStatusRes struct {
@@ -66,9 +78,22 @@ type shipmentStatusReq struct {
 	ReserveID string `json:"reserve_id"`
 }
 
+// shipmentStore は配送を覚えておく
+// completedTTL が0でなければ完了してから completedTTL 経った配送を Sweep で消し、max 件を超えたら完了した配送を olderShipment の順に消す
+// 配送中の配送は問い合わせに答えられなくなるので消さない
 type shipmentStore struct {
 	sync.Mutex
 	items map[string]shipment
+
+	completedTTL time.Duration
+	max          int
+
+	expired int64
+	evicted int64
+	// full は完了した配送を消しても max 件を超えている状態。ログを出すのは超えたときに1回だけにする
+	// full の間は Sweep で消えるか nextCompletion を過ぎるまで、Set のたびに全件を数えなおさない
+	full           bool
+	nextCompletion time.Time
 }
 
 func NewShipmentStore() *shipmentStore {
@@ -87,6 +112,7 @@ func (c *shipmentStore) Set(value shipment) string {
 		key = fmt.Sprintf("%010d", rand.IntN(10000000000))
 		_, ok = c.items[key]
 	}
+	c.evict()
 	c.items[key] = value
 	c.Unlock()
 
@@ -102,6 +128,11 @@ func (c *shipmentStore) SetStatus(key string, status string) (shipment, bool) {
 		return shipment{}, false
 	}
 	value.Status = status
+	value.CompletedAt = time.Time{}
+	if status == StatusDone {
+		value.CompletedAt = time.Now()
+		c.completeAt(value.CompletedAt)
+	}
 
 	c.items[key] = value
 
@@ -133,6 +164,8 @@ func (c *shipmentStore) SetStatusWithDone(key string, doneDatetime time.Time) (s
 	}
 	value.Status = StatusShipping
 	value.DoneDatetime = doneDatetime
+	value.CompletedAt = doneDatetime
+	c.completeAt(doneDatetime)
 
 	c.items[key] = value
 
@@ -141,10 +174,84 @@ func (c *shipmentStore) SetStatusWithDone(key string, doneDatetime time.Time) (s
 
 func (c *shipmentStore) ForceSet(key string, value shipment) {
 	c.Lock()
+	c.evict()
 	c.items[key] = value
 	c.Unlock()
 }
 
+// evict は上限を超えていたら完了した配送を古いものから消す。呼び出し側で Lock しておく
+// 配送中の配送しか残っていなければ上限を超えても覚えておく
+func (c *shipmentStore) evict() {
+	now := time.Now()
+	if c.full && (c.nextCompletion.IsZero() || now.Before(c.nextCompletion)) {
+		return
+	}
+
+	c.evicted += int64(evictOldest(c.items, c.max, func(s shipment) bool {
+		return s.completed(now)
+	}, olderShipment))
+
+	full := c.max > 0 && len(c.items) >= c.max
+	if full && !c.full {
+		log.Printf("shipment: %d shipments exceed max-shipments %d but shipments in progress are kept", len(c.items), c.max)
+	}
+	c.full = full
+	c.nextCompletion = time.Time{}
+	if full {
+		for _, value := range c.items {
+			if !value.CompletedAt.IsZero() && now.Before(value.CompletedAt) {
+				c.completeAt(value.CompletedAt)
+			}
+		}
+	}
+}
+
+// completeAt は full のときに、次に配送が完了して消せるようになる時刻を覚えておく。呼び出し側で Lock しておく
+func (c *shipmentStore) completeAt(t time.Time) {
+	if c.full && (c.nextCompletion.IsZero() || t.Before(c.nextCompletion)) {
+		c.nextCompletion = t
+	}
+}
+
+// SetLimit は完了した配送を覚えておく時間と件数の上限を変える。completedTTL と max が0なら消さない
+func (c *shipmentStore) SetLimit(completedTTL time.Duration, max int) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.completedTTL = completedTTL
+	c.max = max
+	c.full = false
+	c.evict()
+}
+
+// Sweep は完了してから completedTTL 経った配送を消す
+func (c *shipmentStore) Sweep(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.completedTTL <= 0 {
+		return
+	}
+	for key, value := range c.items {
+		if value.completed(now) && now.Sub(value.CompletedAt) >= c.completedTTL {
+			delete(c.items, key)
+			c.expired++
+			c.full = false
+		}
+	}
+}
+
+func (c *shipmentStore) Stats() StoreStats {
+	c.Lock()
+	defer c.Unlock()
+
+	return StoreStats{
+		Entries: len(c.items),
+		Expired: c.expired,
+		Evicted: c.evicted,
+	}
+}
+
 func (c *shipmentStore) Get(key string) (shipment, bool) {
 	c.Lock()
 	defer c.Unlock()
@@ -188,20 +295,26 @@ func NewShipment(debug bool, dataDir string, allowedIPs []net.IP) *ServerShipmen
 
 	scanner := bufio.NewScanner(f)
 	ship := AppShipping{}
+	// 初期データの配送がいつ完了したかはわからないので、読み込んだ時刻に完了したことにする
+	loadedAt := time.Now()
 
 	for scanner.Scan() {
 		err := json.Unmarshal([]byte(scanner.Text()), &ship)
 		if err != nil {
 			log.Fatal(err)
 		}
-		s.shipmentCache.ForceSet(ship.ReserveID, shipment{
+		value := shipment{
 			ToAddress:       ship.ToAddress,
 			ToName:          ship.ToName,
 			FromAddress:     ship.FromAddress,
 			FromName:        ship.FromName,
 			Status:          ship.Status,
 			ReserveDatetime: time.Unix(ship.ReserveTime, 0),
-		})
+		}
+		if ship.Status == StatusDone {
+			value.CompletedAt = loadedAt
+		}
+		s.shipmentCache.ForceSet(ship.ReserveID, value)
 	}
 	f.Close()
 
@@ -212,6 +325,7 @@ func NewShipment(debug bool, dataDir string, allowedIPs []net.IP) *ServerShipmen
 	s.mux.Handle("/request", apply(http.HandlerFunc(s.requestHandler), s.withDelay(), s.withIPRestriction()))
 	s.mux.Handle("/accept", apply(http.HandlerFunc(s.acceptHandler), s.withDelay(), s.withIPRestriction()))
 	s.mux.Handle("/status", apply(http.HandlerFunc(s.statusHandler), s.withDelay(), s.withIPRestriction()))
+	s.mux.Handle("/stats", apply(http.HandlerFunc(s.statsHandler), s.withIPRestriction()))
 
 	return s
 }
@@ -421,6 +535,33 @@ func (s *ServerShipment) statusHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 
+// statsHandler は配送の件数と、期限切れや上限で消した件数を返す
+func (s *ServerShipment) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeStoreStats(w, s.shipmentCache.Stats())
+}
+
+// SetStoreLimit は完了した配送を覚えておく時間と件数の上限を変える。completedTTL と max が0なら消さない
+func (s *ServerShipment) SetStoreLimit(completedTTL time.Duration, max int) {
+	s.shipmentCache.SetLimit(completedTTL, max)
+}
+
+// RunSweeper は interval ごとに完了してから時間が経った配送を消す。止まらないので goroutine で呼ぶ
+func (s *ServerShipment) RunSweeper(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		s.shipmentCache.Sweep(now)
+	}
+}
+
+// StoreStats は配送の件数と、期限切れや上限で消した件数を返す
+func (s *ServerShipment) StoreStats() StoreStats {
+	return s.shipmentCache.Stats()
+}
+
 func (s *ServerShipment) ForceSetStatus(key string, status string) bool {
 	_, ok := s.shipmentCache.SetStatus(key, status)
 
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShipmentStoreEvict(t *testing.T) {
+	c := NewShipmentStore()
+	c.SetLimit(0, 3)
+
+	keys := []string{}
+	for range 3 {
+		keys = append(keys, c.Set(shipment{Status: StatusInitial}))
+	}
+	// 配送中の配送は消さない
+	c.Set(shipment{Status: StatusInitial})
+	if got := c.Stats().Entries; got != 4 {
+		t.Fatalf("Entries = %d, want 4", got)
+	}
+	if !c.full {
+		t.Fatal("store is not full")
+	}
+
+	// 完了するまでは数えなおさない
+	c.SetStatusWithDone(keys[0], time.Now().Add(time.Hour))
+	c.Set(shipment{Status: StatusInitial})
+	if got := c.Stats().Evicted; got != 0 {
+		t.Errorf("Evicted = %d before completion, want 0", got)
+	}
+
+	// 完了したら古いものから消す
+	c.SetStatus(keys[1], StatusDone)
+	c.Set(shipment{Status: StatusInitial})
+	if _, ok := c.Get(keys[1]); ok {
+		t.Error("completed shipment was not evicted")
+	}
+	if _, ok := c.Get(keys[0]); !ok {
+		t.Error("shipment in progress was evicted")
+	}
+	if got := c.Stats().Evicted; got != 1 {
+		t.Errorf("Evicted = %d, want 1", got)
+	}
+}
+
+func TestShipmentStoreSweepClearsFull(t *testing.T) {
+	c := NewShipmentStore()
+	c.SetLimit(time.Minute, 2)
+
+	a := c.Set(shipment{Status: StatusInitial})
+	c.Set(shipment{Status: StatusInitial})
+	c.Set(shipment{Status: StatusInitial})
+	if !c.full {
+		t.Fatal("store is not full")
+	}
+
+	c.SetStatus(a, StatusDone)
+	c.Sweep(time.Now().Add(time.Minute))
+	if c.full {
+		t.Error("full is kept after Sweep removed a shipment")
+	}
+	if got := c.Stats().Expired; got != 1 {
+		t.Errorf("Expired = %d, want 1", got)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/isucon/isucon9-qualify/bench/fails"
 	"github.com/morikuni/failure"
@@ -178,7 +179,9 @@ func checkStatusCodeWithMsg(res *http.Response, expectedStatusCode int, msg stri
 }
 
 func (s *Session) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
 	res, err := s.httpClient.Do(req)
+	Stats.Add(req.Method, req.URL.Path, res, err, time.Since(start))
 	if err != nil {
 		if nerr, ok := err.(net.Error); ok {
 			if nerr.Timeout() {
@@ -0,0 +1,218 @@
+package session
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Stats はエンドポイントごとのリクエスト数とレスポンスタイム。Session.Do ですべてのリクエストを記録する
+	Stats *EndpointStats
+)
+
+// maxLatencySamples を超えたらレスポンスタイムは一部だけを残す。長時間負荷をかけてもメモリを使い切らないように
+const maxLatencySamples = 10000
+
+func init() {
+	Stats = NewEndpointStats()
+}
+
+// EndpointStat はエンドポイントごとの集計。レスポンスタイムはレスポンスヘッダーを受け取るまでの時間
+type EndpointStat struct {
+	Endpoint string `json:"endpoint"`
+	Count    int    `json:"count"`
+	// Errors はタイムアウトなどでレスポンスが返らなかったリクエストと5XXを返したリクエストの数
+	Errors int   `json:"errors"`
+	AvgMs  int64 `json:"avg_ms"`
+	P50Ms  int64 `json:"p50_ms"`
+	P90Ms  int64 `json:"p90_ms"`
+	P99Ms  int64 `json:"p99_ms"`
+	MaxMs  int64 `json:"max_ms"`
+}
+
+// endpointRecord はエンドポイントごとの記録。件数、合計、最大は正確に数え、
+// パーセンタイルを出すためのレスポンスタイムは maxLatencySamples 件までを均等に選んで残す
+type endpointRecord struct {
+	count  int
+	errors int
+	total  time.Duration
+	max    time.Duration
+
+	latencies []time.Duration
+}
+
+func (r *endpointRecord) add(latency time.Duration, failed bool) {
+	r.count++
+	if failed {
+		r.errors++
+	}
+	r.total += latency
+	if latency > r.max {
+		r.max = latency
+	}
+
+	if len(r.latencies) < maxLatencySamples {
+		r.latencies = append(r.latencies, latency)
+		return
+	}
+	if i := rand.IntN(r.count); i < maxLatencySamples {
+		r.latencies[i] = latency
+	}
+}
+
+// StatsWindow は一定の期間に送ったリクエストの集計
+type StatsWindow struct {
+	Requests  int
+	Errors    int
+	P50       time.Duration
+	P99       time.Duration
+	Endpoints []EndpointStat
+}
+
+// ErrorRate はレスポンスが返らなかったか5XXを返したリクエストの割合
+func (w StatsWindow) ErrorRate() float64 {
+	if w.Requests == 0 {
+		return 0
+	}
+	return float64(w.Errors) / float64(w.Requests)
+}
+
+type EndpointStats struct {
+	records map[string]*endpointRecord
+	// window は前回 Window を呼んでからの記録
+	window map[string]*endpointRecord
+
+	mu sync.Mutex
+}
+
+func NewEndpointStats() *EndpointStats {
+	return &EndpointStats{
+		records: make(map[string]*endpointRecord),
+		window:  make(map[string]*endpointRecord),
+	}
+}
+
+func (e *EndpointStats) Add(method, path string, res *http.Response, err error, latency time.Duration) {
+	endpoint := method + " " + normalizeEndpointPath(path)
+
+	failed := err != nil || res.StatusCode >= http.StatusInternalServerError
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, records := range []map[string]*endpointRecord{e.records, e.window} {
+		r, ok := records[endpoint]
+		if !ok {
+			r = &endpointRecord{}
+			records[endpoint] = r
+		}
+		r.add(latency, failed)
+	}
+}
+
+// Reset はそれまでの記録を消す。負荷をかけている間だけを集計するときに使う
+func (e *EndpointStats) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.records = make(map[string]*endpointRecord)
+	e.window = make(map[string]*endpointRecord)
+}
+
+// Get はエンドポイントの名前順に集計を返す
+func (e *EndpointStats) Get() []EndpointStat {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return summarize(e.records)
+}
+
+// Window は前回 Window を呼んでからのリクエストを集計して、次の期間の集計を始める
+// 負荷を変えながら期間ごとのレスポンスタイムとエラーの割合を見るときに使う
+func (e *EndpointStats) Window() StatsWindow {
+	e.mu.Lock()
+	records := e.window
+	e.window = make(map[string]*endpointRecord)
+	e.mu.Unlock()
+
+	w := StatsWindow{
+		Endpoints: summarize(records),
+	}
+	// 件数の多いエンドポイントは一部しか残していないので、全体のパーセンタイルは近似になる
+	latencies := []time.Duration{}
+	for _, r := range records {
+		w.Requests += r.count
+		w.Errors += r.errors
+		latencies = append(latencies, r.latencies...)
+	}
+	SortDurations(latencies)
+	w.P50 = Percentile(latencies, 50)
+	w.P99 = Percentile(latencies, 99)
+	return w
+}
+
+func summarize(records map[string]*endpointRecord) []EndpointStat {
+	stats := make([]EndpointStat, 0, len(records))
+	for endpoint, r := range records {
+		latencies := make([]time.Duration, len(r.latencies))
+		copy(latencies, r.latencies)
+		SortDurations(latencies)
+
+		stats = append(stats, EndpointStat{
+			Endpoint: endpoint,
+			Count:    r.count,
+			Errors:   r.errors,
+			AvgMs:    (r.total / time.Duration(r.count)).Milliseconds(),
+			P50Ms:    Percentile(latencies, 50).Milliseconds(),
+			P90Ms:    Percentile(latencies, 90).Milliseconds(),
+			P99Ms:    Percentile(latencies, 99).Milliseconds(),
+			MaxMs:    r.max.Milliseconds(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Endpoint < stats[j].Endpoint })
+	return stats
+}
+
+// SortDurations は Percentile に渡せるように短い順に並べる
+func SortDurations(d []time.Duration) {
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+}
+
+// Percentile はソート済みの latencies の p パーセンタイルを返す
+func Percentile(latencies []time.Duration, p int) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	i := (len(latencies)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return latencies[i]
+}
+
+// normalizeEndpointPath はパスに含まれるIDやファイル名をまとめて、エンドポイントごとに集計できるようにする
+// /items/123.json は /items/:id.json、/upload/abc.jpg は /upload/:name、/static/ 以下は /static/* になる
+func normalizeEndpointPath(path string) string {
+	if strings.HasPrefix(path, "/static/") {
+		return "/static/*"
+	}
+	if strings.HasPrefix(path, "/upload/") {
+		return "/upload/:name"
+	}
+
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		name, ext := s, ""
+		if j := strings.Index(s, "."); j >= 0 {
+			name, ext = s[:j], s[j:]
+		}
+		if name != "" && strings.Trim(name, "0123456789") == "" {
+			segments[i] = ":id" + ext
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,65 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeEndpointPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "/"},
+		{"/initialize", "/initialize"},
+		{"/items/123.json", "/items/:id.json"},
+		{"/users/45.json", "/users/:id.json"},
+		{"/new_items/1.json", "/new_items/:id.json"},
+		{"/transactions/123.png", "/transactions/:id.png"},
+		{"/items/123", "/items/:id"},
+		{"/users/transactions.json", "/users/transactions.json"},
+		// 数字だけでなければIDとみなさない
+		{"/items/12a.json", "/items/12a.json"},
+		{"/upload/0123abcd.jpg", "/upload/:name"},
+		{"/static/js/main.1234.js", "/static/*"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeEndpointPath(tt.path); got != tt.want {
+			t.Errorf("normalizeEndpointPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	latencies := make([]time.Duration, 0, 100)
+	for i := 100; i >= 1; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	SortDurations(latencies)
+
+	tests := []struct {
+		name      string
+		latencies []time.Duration
+		p         int
+		want      time.Duration
+	}{
+		{"empty", nil, 99, 0},
+		{"single", []time.Duration{time.Second}, 50, time.Second},
+		{"p0", latencies, 0, time.Millisecond},
+		{"p50", latencies, 50, 50 * time.Millisecond},
+		{"p99", latencies, 99, 99 * time.Millisecond},
+		{"p100", latencies, 100, 100 * time.Millisecond},
+		// 切り上げる
+		{"p50 of 3", []time.Duration{1, 2, 3}, 50, 2},
+		{"p99 of 3", []time.Duration{1, 2, 3}, 99, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Percentile(tt.latencies, tt.p); got != tt.want {
+				t.Errorf("Percentile(%d) = %s, want %s", tt.p, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package session
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
 	"crypto/md5"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,6 +13,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 
@@ -138,11 +141,57 @@ type resSell struct {
 	ID int64 `json:"id"`
 }
 
+// BulkSellItem は POST /sell/bulk で出品する1件分
+type BulkSellItem struct {
+	FileName    string
+	Name        string
+	Price       int
+	Description string
+	CategoryID  int
+}
+
+type resSellBulkError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+type resSellBulk struct {
+	IDs    []int64            `json:"ids"`
+	Error  string             `json:"error"`
+	Errors []resSellBulkError `json:"errors"`
+}
+
 type reqLogin struct {
 	AccountName string `json:"account_name"`
 	Password    string `json:"password"`
 }
 
+type reqLogout struct {
+	CSRFToken string `json:"csrf_token"`
+}
+
+type reqPassword struct {
+	CSRFToken       string `json:"csrf_token"`
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type resPassword struct {
+	CSRFToken string `json:"csrf_token"`
+}
+
+type UserSession struct {
+	ID        string `json:"id"`
+	Current   bool   `json:"current"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type reqRevokeSession struct {
+	CSRFToken string `json:"csrf_token"`
+	SessionID string `json:"session_id"`
+}
+
 type reqItemEdit struct {
 	CSRFToken string `json:"csrf_token"`
 	ItemID    int64  `json:"item_id"`
@@ -174,6 +223,17 @@ type reqBump struct {
 	ItemID    int64  `json:"item_id"`
 }
 
+type reqItemStatus struct {
+	CSRFToken string `json:"csrf_token"`
+	ItemID    int64  `json:"item_id"`
+}
+
+type resItemStatus struct {
+	ItemID        int64  `json:"item_id"`
+	ItemStatus    string `json:"item_status"`
+	ItemUpdatedAt int64  `json:"item_updated_at"`
+}
+
 type resItemEdit struct {
 	ItemID        int64 `json:"item_id"`
 	ItemPrice     int   `json:"item_price"`
@@ -181,6 +241,47 @@ type resItemEdit struct {
 	ItemUpdatedAt int64 `json:"item_updated_at"`
 }
 
+type reqOffer struct {
+	CSRFToken string `json:"csrf_token"`
+	ItemID    int64  `json:"item_id"`
+	Price     int    `json:"price"`
+}
+
+type reqOfferAction struct {
+	CSRFToken string `json:"csrf_token"`
+	OfferID   int64  `json:"offer_id"`
+	Price     int    `json:"price,omitempty"`
+}
+
+type Offer struct {
+	ID            int64  `json:"id"`
+	ItemID        int64  `json:"item_id"`
+	SellerID      int64  `json:"seller_id"`
+	BuyerID       int64  `json:"buyer_id"`
+	Price         int    `json:"price"`
+	Status        string `json:"status"`
+	ReservedUntil int64  `json:"reserved_until,omitempty"`
+	CreatedAt     int64  `json:"created_at"`
+	UpdatedAt     int64  `json:"updated_at"`
+}
+
+type UserStats struct {
+	TotalSales              int64          `json:"total_sales"`
+	TransactionStatusCounts map[string]int `json:"transaction_status_counts"`
+	ShippingStatusCounts    map[string]int `json:"shipping_status_counts"`
+	AverageCompleteSeconds  float64        `json:"average_complete_seconds"`
+	TopCategories           []struct {
+		Category *Category `json:"category"`
+		NumSold  int       `json:"num_sold"`
+		Sales    int64     `json:"sales"`
+	} `json:"top_categories"`
+	DailySales []struct {
+		Date    string `json:"date"`
+		NumSold int    `json:"num_sold"`
+		Sales   int64  `json:"sales"`
+	} `json:"daily_sales"`
+}
+
 type resNewItems struct {
 	RootCategoryID   int          `json:"root_category_id,omitempty"`
 	RootCategoryName string       `json:"root_category_name,omitempty"`
@@ -360,6 +461,120 @@ func (s *Session) Sell(ctx context.Context, fileName, name string, price int, de
 	return rs.ID, nil
 }
 
+func (s *Session) SellBulk(ctx context.Context, items []BulkSellItem) ([]int64, error) {
+	body, contentType, err := newSellBulkBody(s.csrfToken, items)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("POST /sell/bulk: リクエストに失敗しました"))
+	}
+
+	req, err := s.newPostRequest(ShareTargetURLs.AppURL, "/sell/bulk", contentType, body)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("POST /sell/bulk: リクエストに失敗しました"))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("POST /sell/bulk: リクエストに失敗しました"))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCode(res, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &resSellBulk{}
+	err = json.NewDecoder(res.Body).Decode(rs)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("POST /sell/bulk: JSONデコードに失敗しました"))
+	}
+
+	if len(rs.IDs) != len(items) {
+		return nil, failure.New(fails.ErrApplication, failure.Messagef("POST /sell/bulk: 出品した商品の数が正しくありません expected: %d; actual: %d", len(items), len(rs.IDs)))
+	}
+
+	return rs.IDs, nil
+}
+
+// newSellBulkBody はCSVのマニフェストと画像のzipアーカイブを送るリクエストボディを作る
+func newSellBulkBody(csrfToken string, items []BulkSellItem) (*bytes.Buffer, string, error) {
+	manifest := &bytes.Buffer{}
+	cw := csv.NewWriter(manifest)
+	cw.Write([]string{"name", "description", "price", "category_id", "image"})
+
+	archive := &bytes.Buffer{}
+	zw := zip.NewWriter(archive)
+
+	for i, item := range items {
+		image := fmt.Sprintf("%d%s", i, filepath.Ext(item.FileName))
+		cw.Write([]string{item.Name, item.Description, strconv.Itoa(item.Price), strconv.Itoa(item.CategoryID), image})
+
+		err := addZipFile(zw, image, item.FileName)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	cw.Flush()
+	err := cw.Error()
+	if err != nil {
+		return nil, "", err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	writer.WriteField("csrf_token", csrfToken)
+
+	part, err := writer.CreateFormFile("manifest", "manifest.csv")
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = io.Copy(part, manifest)
+	if err != nil {
+		return nil, "", err
+	}
+
+	part, err = writer.CreateFormFile("images", "images.zip")
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = io.Copy(part, archive)
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType := writer.FormDataContentType()
+
+	err = writer.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return body, contentType, nil
+}
+
+func addZipFile(zw *zip.Writer, name, fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, file)
+	return err
+}
+
 func (s *Session) Buy(ctx context.Context, itemID int64, token string) (int64, error) {
 	b, _ := json.Marshal(reqBuy{
 		CSRFToken: s.csrfToken,
@@ -696,6 +911,156 @@ func (s *Session) ItemEdit(ctx context.Context, itemID int64, price int) (int, e
 	return rie.ItemPrice, nil
 }
 
+func (s *Session) ItemStop(ctx context.Context, itemID int64) (string, error) {
+	return s.changeItemStatus(ctx, "/items/stop", itemID)
+}
+
+func (s *Session) ItemResume(ctx context.Context, itemID int64) (string, error) {
+	return s.changeItemStatus(ctx, "/items/resume", itemID)
+}
+
+func (s *Session) ItemCancel(ctx context.Context, itemID int64) (string, error) {
+	return s.changeItemStatus(ctx, "/items/cancel", itemID)
+}
+
+func (s *Session) changeItemStatus(ctx context.Context, spath string, itemID int64) (string, error) {
+	b, _ := json.Marshal(reqItemStatus{
+		CSRFToken: s.csrfToken,
+		ItemID:    itemID,
+	})
+	req, err := s.newPostRequest(ShareTargetURLs.AppURL, spath, "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return "", failure.Wrap(err, failure.Messagef("POST %s: リクエストに失敗しました (item_id: %d)", spath, itemID))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return "", failure.Wrap(err, failure.Messagef("POST %s: リクエストに失敗しました (item_id: %d)", spath, itemID))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCodeWithMsg(res, http.StatusOK, fmt.Sprintf("(item_id: %d)", itemID))
+	if err != nil {
+		return "", err
+	}
+
+	ris := &resItemStatus{}
+	err = json.NewDecoder(res.Body).Decode(ris)
+	if err != nil {
+		return "", failure.Wrap(err, failure.Messagef("POST %s: JSONデコードに失敗しました (item_id: %d)", spath, itemID))
+	}
+
+	return ris.ItemStatus, nil
+}
+
+func (s *Session) MakeOffer(ctx context.Context, itemID int64, price int) (Offer, error) {
+	b, _ := json.Marshal(reqOffer{
+		CSRFToken: s.csrfToken,
+		ItemID:    itemID,
+		Price:     price,
+	})
+	req, err := s.newPostRequest(ShareTargetURLs.AppURL, "/offers", "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return Offer{}, failure.Wrap(err, failure.Messagef("POST /offers: リクエストに失敗しました (item_id: %d)", itemID))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return Offer{}, failure.Wrap(err, failure.Messagef("POST /offers: リクエストに失敗しました (item_id: %d)", itemID))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCodeWithMsg(res, http.StatusOK, fmt.Sprintf("(item_id: %d)", itemID))
+	if err != nil {
+		return Offer{}, err
+	}
+
+	offer := Offer{}
+	err = json.NewDecoder(res.Body).Decode(&offer)
+	if err != nil {
+		return Offer{}, failure.Wrap(err, failure.Messagef("POST /offers: JSONデコードに失敗しました (item_id: %d)", itemID))
+	}
+
+	return offer, nil
+}
+
+func (s *Session) AcceptOffer(ctx context.Context, offerID int64) (Offer, error) {
+	return s.respondOffer(ctx, "/offers/accept", offerID, 0)
+}
+
+func (s *Session) RejectOffer(ctx context.Context, offerID int64) (Offer, error) {
+	return s.respondOffer(ctx, "/offers/reject", offerID, 0)
+}
+
+func (s *Session) CounterOffer(ctx context.Context, offerID int64, price int) (Offer, error) {
+	return s.respondOffer(ctx, "/offers/counter", offerID, price)
+}
+
+func (s *Session) respondOffer(ctx context.Context, spath string, offerID int64, price int) (Offer, error) {
+	b, _ := json.Marshal(reqOfferAction{
+		CSRFToken: s.csrfToken,
+		OfferID:   offerID,
+		Price:     price,
+	})
+	req, err := s.newPostRequest(ShareTargetURLs.AppURL, spath, "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return Offer{}, failure.Wrap(err, failure.Messagef("POST %s: リクエストに失敗しました (offer_id: %d)", spath, offerID))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return Offer{}, failure.Wrap(err, failure.Messagef("POST %s: リクエストに失敗しました (offer_id: %d)", spath, offerID))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCodeWithMsg(res, http.StatusOK, fmt.Sprintf("(offer_id: %d)", offerID))
+	if err != nil {
+		return Offer{}, err
+	}
+
+	offer := Offer{}
+	err = json.NewDecoder(res.Body).Decode(&offer)
+	if err != nil {
+		return Offer{}, failure.Wrap(err, failure.Messagef("POST %s: JSONデコードに失敗しました (offer_id: %d)", spath, offerID))
+	}
+
+	return offer, nil
+}
+
+func (s *Session) UserStats(ctx context.Context) (UserStats, error) {
+	req, err := s.newGetRequest(ShareTargetURLs.AppURL, "/users/me/stats.json")
+	if err != nil {
+		return UserStats{}, failure.Wrap(err, failure.Message("GET /users/me/stats.json: リクエストに失敗しました"))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return UserStats{}, failure.Wrap(err, failure.Message("GET /users/me/stats.json: リクエストに失敗しました"))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCode(res, http.StatusOK)
+	if err != nil {
+		return UserStats{}, err
+	}
+
+	stats := UserStats{}
+	err = json.NewDecoder(res.Body).Decode(&stats)
+	if err != nil {
+		return UserStats{}, failure.Wrap(err, failure.Message("GET /users/me/stats.json: JSONデコードに失敗しました"))
+	}
+
+	return stats, nil
+}
+
 func (s *Session) NewItems(ctx context.Context) (hasNext bool, items []ItemSimple, err error) {
 	req, err := s.newGetRequest(ShareTargetURLs.AppURL, "/new_items.json")
 	if err != nil {
@@ -991,3 +1356,128 @@ func (s *Session) Reports(ctx context.Context) (transactionEvidences []Transacti
 
 	return transactionEvidences, nil
 }
+
+func (s *Session) Logout(ctx context.Context) error {
+	b, _ := json.Marshal(reqLogout{
+		CSRFToken: s.csrfToken,
+	})
+	req, err := s.newPostRequest(ShareTargetURLs.AppURL, "/logout", "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /logout: リクエストに失敗しました"))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /logout: リクエストに失敗しました"))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCode(res, http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	s.UserID = 0
+	s.csrfToken = ""
+	return nil
+}
+
+func (s *Session) ChangePassword(ctx context.Context, currentPassword, newPassword string) error {
+	b, _ := json.Marshal(reqPassword{
+		CSRFToken:       s.csrfToken,
+		CurrentPassword: currentPassword,
+		NewPassword:     newPassword,
+	})
+	req, err := s.newPostRequest(ShareTargetURLs.AppURL, "/users/password", "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /users/password: リクエストに失敗しました"))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /users/password: リクエストに失敗しました"))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCode(res, http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	rp := &resPassword{}
+	err = json.NewDecoder(res.Body).Decode(rp)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /users/password: JSONデコードに失敗しました"))
+	}
+
+	if rp.CSRFToken == "" {
+		return failure.New(fails.ErrApplication, failure.Message("POST /users/password: csrf tokenが空です"))
+	}
+
+	s.csrfToken = rp.CSRFToken
+	return nil
+}
+
+// UserSessions はログインしているユーザーのセッションの一覧を返す。アプリケーションが一覧に対応していなければ nil を返す
+func (s *Session) UserSessions(ctx context.Context) ([]UserSession, error) {
+	req, err := s.newGetRequest(ShareTargetURLs.AppURL, "/users/sessions.json")
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("GET /users/sessions.json: リクエストに失敗しました"))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("GET /users/sessions.json: リクエストに失敗しました"))
+	}
+	defer res.Body.Close()
+
+	// セッションをcookieに持つ実装は一覧も失効もできない
+	if res.StatusCode == http.StatusNotImplemented {
+		return nil, nil
+	}
+
+	err = checkStatusCode(res, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []UserSession{}
+	err = json.NewDecoder(res.Body).Decode(&sessions)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("GET /users/sessions.json: JSONデコードに失敗しました"))
+	}
+
+	return sessions, nil
+}
+
+func (s *Session) RevokeSession(ctx context.Context, sessionID string) error {
+	b, _ := json.Marshal(reqRevokeSession{
+		CSRFToken: s.csrfToken,
+		SessionID: sessionID,
+	})
+	req, err := s.newPostRequest(ShareTargetURLs.AppURL, "/users/sessions/revoke", "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /users/sessions/revoke: リクエストに失敗しました"))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /users/sessions/revoke: リクエストに失敗しました"))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCode(res, http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
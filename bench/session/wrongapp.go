@@ -12,6 +12,7 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/isucon/isucon9-qualify/bench/fails"
 	"github.com/morikuni/failure"
 )
 
@@ -19,6 +20,12 @@ const (
 	ItemMinPrice    = 100
 	ItemMaxPrice    = 1000000
 	ItemPriceErrMsg = "商品価格は100ｲｽｺｲﾝ以上、1,000,000ｲｽｺｲﾝ以下にしてください"
+
+	// LoginAccountLimit 回続けてログインに失敗したアカウントはロックされる
+	LoginAccountLimit = 10
+	// LoginIPFailuresPerMinute はベンチマーカーが1つのIPから1分間に失敗するログインの上限
+	// webappでIPごとの制限を有効にするときはこれより大きくする
+	LoginIPFailuresPerMinute = 40
 )
 
 type resErr struct {
@@ -66,6 +73,44 @@ func (s *Session) LoginWithWrongPassword(ctx context.Context, accountName, passw
 	return nil
 }
 
+func (s *Session) LoginWithLockout(ctx context.Context, accountName, password string) error {
+	b, _ := json.Marshal(reqLogin{
+		AccountName: accountName,
+		Password:    password,
+	})
+
+	req, err := s.newPostRequest(ShareTargetURLs.AppURL, "/login", "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /login: リクエストに失敗しました"))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /login: リクエストに失敗しました"))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCode(res, http.StatusTooManyRequests)
+	if err != nil {
+		return err
+	}
+
+	retryAfter, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err != nil || retryAfter <= 0 {
+		return failure.New(fails.ErrApplication, failure.Message("POST /login: Retry-Afterヘッダーが正しくありません"))
+	}
+
+	re := resErr{}
+	err = json.NewDecoder(res.Body).Decode(&re)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /login: JSONデコードに失敗しました"))
+	}
+
+	return nil
+}
+
 func (s *Session) SellWithWrongCSRFToken(ctx context.Context, fileName, name string, price int, description string, categoryID int) error {
 	file, err := os.Open(fileName)
 	if err != nil {
@@ -509,3 +554,272 @@ func (s *Session) ItemEditWithNotOnSale(ctx context.Context, itemID int64, price
 
 	return nil
 }
+
+func (s *Session) LogoutWithWrongCSRFToken(ctx context.Context) error {
+	b, _ := json.Marshal(reqLogout{
+		CSRFToken: secureRandomStr(20),
+	})
+	req, err := s.newPostRequest(ShareTargetURLs.AppURL, "/logout", "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /logout: リクエストに失敗しました"))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /logout: リクエストに失敗しました"))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCode(res, http.StatusUnprocessableEntity)
+	if err != nil {
+		return err
+	}
+
+	re := resErr{}
+	err = json.NewDecoder(res.Body).Decode(&re)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /logout: JSONデコードに失敗しました"))
+	}
+
+	return nil
+}
+
+func (s *Session) ChangePasswordWithWrongCSRFToken(ctx context.Context, currentPassword, newPassword string) error {
+	b, _ := json.Marshal(reqPassword{
+		CSRFToken:       secureRandomStr(20),
+		CurrentPassword: currentPassword,
+		NewPassword:     newPassword,
+	})
+	req, err := s.newPostRequest(ShareTargetURLs.AppURL, "/users/password", "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /users/password: リクエストに失敗しました"))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /users/password: リクエストに失敗しました"))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCode(res, http.StatusUnprocessableEntity)
+	if err != nil {
+		return err
+	}
+
+	re := resErr{}
+	err = json.NewDecoder(res.Body).Decode(&re)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /users/password: JSONデコードに失敗しました"))
+	}
+
+	return nil
+}
+
+func (s *Session) ChangePasswordWithWrongPassword(ctx context.Context, currentPassword, newPassword string) error {
+	b, _ := json.Marshal(reqPassword{
+		CSRFToken:       s.csrfToken,
+		CurrentPassword: currentPassword,
+		NewPassword:     newPassword,
+	})
+	req, err := s.newPostRequest(ShareTargetURLs.AppURL, "/users/password", "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /users/password: リクエストに失敗しました"))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /users/password: リクエストに失敗しました"))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCode(res, http.StatusUnauthorized)
+	if err != nil {
+		return err
+	}
+
+	re := resErr{}
+	err = json.NewDecoder(res.Body).Decode(&re)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /users/password: JSONデコードに失敗しました"))
+	}
+
+	return nil
+}
+
+// SettingsWithLoggedOut はログアウト後の /settings にユーザーが含まれないことを確認する
+func (s *Session) SettingsWithLoggedOut(ctx context.Context) error {
+	req, err := s.newGetRequest(ShareTargetURLs.AppURL, "/settings")
+	if err != nil {
+		return failure.Wrap(err, failure.Message("GET /settings: リクエストに失敗しました"))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("GET /settings: リクエストに失敗しました"))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCode(res, http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	rs := &resSetting{}
+	err = json.NewDecoder(res.Body).Decode(rs)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("GET /settings: JSONデコードに失敗しました"))
+	}
+
+	if rs.User != nil {
+		return failure.New(fails.ErrApplication, failure.Message("GET /settings: ログアウトしたのにユーザーが返されています"))
+	}
+
+	return nil
+}
+
+func (s *Session) ItemResumeWithFailed(ctx context.Context, itemID int64, expectedStatus int, expectedMsg string) error {
+	b, _ := json.Marshal(reqItemStatus{
+		CSRFToken: s.csrfToken,
+		ItemID:    itemID,
+	})
+	req, err := s.newPostRequest(ShareTargetURLs.AppURL, "/items/resume", "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("POST /items/resume: リクエストに失敗しました (item_id: %d)", itemID))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("POST /items/resume: リクエストに失敗しました (item_id: %d)", itemID))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCodeWithMsg(res, expectedStatus, fmt.Sprintf("(item_id: %d)", itemID))
+	if err != nil {
+		return err
+	}
+
+	re := resErr{}
+	err = json.NewDecoder(res.Body).Decode(&re)
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("POST /items/resume: JSONデコードに失敗しました (item_id: %d)", itemID))
+	}
+
+	if re.Error != expectedMsg {
+		return failure.New(fails.ErrApplication, failure.Messagef("POST /items/resume: exected error message: %s; actual: %s (item_id: %d)", expectedMsg, re.Error, itemID))
+	}
+
+	return nil
+}
+
+func (s *Session) ItemWithNotFound(ctx context.Context, itemID int64) error {
+	req, err := s.newGetRequest(ShareTargetURLs.AppURL, fmt.Sprintf("/items/%d.json", itemID))
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("GET /items/%d.json: リクエストに失敗しました", itemID))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("GET /items/%d.json: リクエストに失敗しました", itemID))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCode(res, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Session) MakeOfferWithFailed(ctx context.Context, itemID int64, price int, expectedStatus int, expectedMsg string) error {
+	b, _ := json.Marshal(reqOffer{
+		CSRFToken: s.csrfToken,
+		ItemID:    itemID,
+		Price:     price,
+	})
+	req, err := s.newPostRequest(ShareTargetURLs.AppURL, "/offers", "application/json", bytes.NewBuffer(b))
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("POST /offers: リクエストに失敗しました (item_id: %d)", itemID))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("POST /offers: リクエストに失敗しました (item_id: %d)", itemID))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCodeWithMsg(res, expectedStatus, fmt.Sprintf("(item_id: %d)", itemID))
+	if err != nil {
+		return err
+	}
+
+	re := resErr{}
+	err = json.NewDecoder(res.Body).Decode(&re)
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("POST /offers: JSONデコードに失敗しました (item_id: %d)", itemID))
+	}
+
+	if re.Error != expectedMsg {
+		return failure.New(fails.ErrApplication, failure.Messagef("POST /offers: exected error message: %s; actual: %s (item_id: %d)", expectedMsg, re.Error, itemID))
+	}
+
+	return nil
+}
+
+// SellBulkWithFailed は誤りのある行を含めてまとめて出品し、何も出品されずにその行のエラーが返ることを確認する
+func (s *Session) SellBulkWithFailed(ctx context.Context, items []BulkSellItem, expectedRow int, expectedMsg string) error {
+	body, contentType, err := newSellBulkBody(s.csrfToken, items)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /sell/bulk: リクエストに失敗しました"))
+	}
+
+	req, err := s.newPostRequest(ShareTargetURLs.AppURL, "/sell/bulk", contentType, body)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /sell/bulk: リクエストに失敗しました"))
+	}
+
+	req = req.WithContext(ctx)
+
+	res, err := s.Do(req)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /sell/bulk: リクエストに失敗しました"))
+	}
+	defer res.Body.Close()
+
+	err = checkStatusCode(res, http.StatusBadRequest)
+	if err != nil {
+		return err
+	}
+
+	rs := resSellBulk{}
+	err = json.NewDecoder(res.Body).Decode(&rs)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("POST /sell/bulk: JSONデコードに失敗しました"))
+	}
+
+	if len(rs.IDs) != 0 {
+		return failure.New(fails.ErrApplication, failure.Message("POST /sell/bulk: 誤りのある行があるのに出品されています"))
+	}
+
+	for _, re := range rs.Errors {
+		if re.Row == expectedRow && re.Error == expectedMsg {
+			return nil
+		}
+	}
+
+	return failure.New(fails.ErrApplication, failure.Messagef("POST /sell/bulk: %d行目のエラーが返っていません expected: %s", expectedRow, expectedMsg))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// Thresholds はどこからを悪化とみなすか
+type Thresholds struct {
+	// Score はスコアが何割下がったら悪化とみなすか
+	Score float64
+	// Latency はレスポンスタイムの p50 か p99 が何割上がったら悪化とみなすか
+	Latency float64
+	// LatencyMinDiff より小さい差は誤差とみなす
+	LatencyMinDiff time.Duration
+}
+
+type endpointDiff struct {
+	Endpoint   string
+	Metric     string
+	Base       int64
+	Target     int64
+	Regression bool
+}
+
+// Comparison は2回の結果の違い
+type Comparison struct {
+	Base   Run
+	Target Run
+
+	ScoreRegression bool
+	PassRegression  bool
+
+	NewMessages      []string
+	ResolvedMessages []string
+
+	Endpoints []endpointDiff
+}
+
+var digitsRe = regexp.MustCompile(`[0-9]+`)
+
+// messageKey はIDなどの数字を除いたメッセージ。数字だけが違うメッセージは同じエラーとみなす
+func messageKey(msg string) string {
+	return digitsRe.ReplaceAllString(msg, "N")
+}
+
+func compareRuns(base, target Run, th Thresholds) *Comparison {
+	c := &Comparison{Base: base, Target: target}
+
+	c.PassRegression = base.Output.Pass && !target.Output.Pass
+	c.ScoreRegression = float64(target.Output.Score) < float64(base.Output.Score)*(1-th.Score)
+
+	c.NewMessages = diffMessages(target.Output.Messages, base.Output.Messages)
+	c.ResolvedMessages = diffMessages(base.Output.Messages, target.Output.Messages)
+
+	baseEndpoints := make(map[string]int)
+	for i, e := range base.Output.Endpoints {
+		baseEndpoints[e.Endpoint] = i
+	}
+	minDiff := th.LatencyMinDiff.Milliseconds()
+	for _, t := range target.Output.Endpoints {
+		i, ok := baseEndpoints[t.Endpoint]
+		if !ok {
+			continue
+		}
+		b := base.Output.Endpoints[i]
+
+		for _, m := range []struct {
+			name         string
+			base, target int64
+		}{
+			{"p50", b.P50Ms, t.P50Ms},
+			{"p99", b.P99Ms, t.P99Ms},
+		} {
+			if m.base == m.target {
+				continue
+			}
+			c.Endpoints = append(c.Endpoints, endpointDiff{
+				Endpoint: t.Endpoint,
+				Metric:   m.name,
+				Base:     m.base,
+				Target:   m.target,
+				Regression: m.target-m.base >= minDiff &&
+					float64(m.target) > float64(m.base)*(1+th.Latency),
+			})
+		}
+	}
+
+	return c
+}
+
+// diffMessages は base になくて msgs にあるメッセージを返す
+func diffMessages(msgs, base []string) []string {
+	seen := make(map[string]bool)
+	for _, m := range base {
+		seen[messageKey(m)] = true
+	}
+
+	diff := []string{}
+	for _, m := range msgs {
+		key := messageKey(m)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		diff = append(diff, m)
+	}
+	return diff
+}
+
+// HasRegression は悪化していれば true を返す。新しく出たエラーも悪化とみなす
+func (c *Comparison) HasRegression() bool {
+	if c.ScoreRegression || c.PassRegression || len(c.NewMessages) > 0 {
+		return true
+	}
+	for _, e := range c.Endpoints {
+		if e.Regression {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Comparison) Print(w io.Writer) {
+	fmt.Fprintf(w, "base:   %s\n", formatRun(c.Base))
+	fmt.Fprintf(w, "target: %s\n", formatRun(c.Target))
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "score: %d -> %d (%s)%s\n", c.Base.Output.Score, c.Target.Output.Score,
+		formatChange(c.Base.Output.Score, c.Target.Output.Score), regressionMark(c.ScoreRegression))
+	fmt.Fprintf(w, "pass:  %t -> %t%s\n", c.Base.Output.Pass, c.Target.Output.Pass, regressionMark(c.PassRegression))
+
+	if len(c.NewMessages) > 0 {
+		fmt.Fprintln(w, "\nnew messages:")
+		for _, m := range c.NewMessages {
+			fmt.Fprintf(w, "  + %s\n", m)
+		}
+	}
+	if len(c.ResolvedMessages) > 0 {
+		fmt.Fprintln(w, "\nresolved messages:")
+		for _, m := range c.ResolvedMessages {
+			fmt.Fprintf(w, "  - %s\n", m)
+		}
+	}
+
+	if len(c.Endpoints) > 0 {
+		fmt.Fprintln(w, "\nlatency:")
+		for _, e := range c.Endpoints {
+			fmt.Fprintf(w, "  %-40s %s %5dms -> %5dms (%s)%s\n", e.Endpoint, e.Metric, e.Base, e.Target,
+				formatChange(e.Base, e.Target), regressionMark(e.Regression))
+		}
+	}
+}
+
+func formatRun(run Run) string {
+	label := ""
+	if run.Label != "" {
+		label = " " + run.Label
+	}
+	return fmt.Sprintf("#%d %s rev %s%s", run.ID, run.RecordedAt.Local().Format("2006-01-02 15:04:05"), run.Revision, label)
+}
+
+func formatChange(base, target int64) string {
+	if base == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.1f%%", float64(target-base)/float64(base)*100)
+}
+
+func regressionMark(regression bool) string {
+	if regression {
+		return "  REGRESSION"
+	}
+	return ""
+}
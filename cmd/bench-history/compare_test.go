@@ -0,0 +1,75 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucon9-qualify/bench/session"
+)
+
+func TestCompareRuns(t *testing.T) {
+	th := Thresholds{Score: 0.05, Latency: 0.2, LatencyMinDiff: 10 * time.Millisecond}
+	run := func(pass bool, score int64, p50, p99 int64, msgs ...string) Run {
+		return Run{Output: Output{
+			Pass:     pass,
+			Score:    score,
+			Messages: msgs,
+			Endpoints: []session.EndpointStat{
+				{Endpoint: "GET /items/:id.json", P50Ms: p50, P99Ms: p99},
+			},
+		}}
+	}
+	base := run(true, 1000, 100, 500, "GET /items/1.json: タイムアウトしました")
+
+	tests := []struct {
+		name   string
+		target Run
+
+		score, pass bool
+		latency     []string
+		newMsgs     int
+		regression  bool
+	}{
+		{"same", run(true, 1000, 100, 500, "GET /items/1.json: タイムアウトしました"), false, false, nil, 0, false},
+		{"score within threshold", run(true, 950, 100, 500), false, false, nil, 0, false},
+		{"score regression", run(true, 949, 100, 500), true, false, nil, 0, true},
+		{"score improved", run(true, 2000, 100, 500), false, false, nil, 0, false},
+		{"fail", run(false, 1000, 100, 500), false, true, nil, 0, true},
+		// p99 は2割を超えたが差が LatencyMinDiff より小さい
+		{"latency within min diff", run(true, 1000, 109, 500), false, false, nil, 0, false},
+		{"latency within ratio", run(true, 1000, 100, 600), false, false, nil, 0, false},
+		{"latency regression", run(true, 1000, 121, 601), false, false, []string{"p50", "p99"}, 0, true},
+		{"latency improved", run(true, 1000, 50, 100), false, false, nil, 0, false},
+		// IDだけが違うメッセージは同じエラー
+		{"same message with other id", run(true, 1000, 100, 500, "GET /items/2.json: タイムアウトしました"), false, false, nil, 0, false},
+		{"new message", run(true, 1000, 100, 500, "POST /buy: 500 Internal Server Error"), false, false, nil, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := compareRuns(base, tt.target, th)
+			if c.ScoreRegression != tt.score {
+				t.Errorf("ScoreRegression = %v, want %v", c.ScoreRegression, tt.score)
+			}
+			if c.PassRegression != tt.pass {
+				t.Errorf("PassRegression = %v, want %v", c.PassRegression, tt.pass)
+			}
+			latency := []string{}
+			for _, e := range c.Endpoints {
+				if e.Regression {
+					latency = append(latency, e.Metric)
+				}
+			}
+			if !slices.Equal(latency, tt.latency) && (len(latency) > 0 || len(tt.latency) > 0) {
+				t.Errorf("latency regressions = %v, want %v", latency, tt.latency)
+			}
+			if len(c.NewMessages) != tt.newMsgs {
+				t.Errorf("NewMessages = %v, want %d", c.NewMessages, tt.newMsgs)
+			}
+			if c.HasRegression() != tt.regression {
+				t.Errorf("HasRegression = %v, want %v", c.HasRegression(), tt.regression)
+			}
+		})
+	}
+}
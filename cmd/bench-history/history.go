@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/isucon/isucon9-qualify/bench/session"
+)
+
+// Output はベンチマーカーが標準出力に出す結果。cmd/bench の Output と同じ形
+type Output struct {
+	Pass      bool                   `json:"pass"`
+	Score     int64                  `json:"score"`
+	Campaign  int                    `json:"campaign"`
+	Language  string                 `json:"language"`
+	Messages  []string               `json:"messages"`
+	Breakdown json.RawMessage        `json:"breakdown,omitempty"`
+	Endpoints []session.EndpointStat `json:"endpoints,omitempty"`
+}
+
+// Run は履歴に保存した1回分の結果
+type Run struct {
+	ID         int       `json:"id"`
+	RecordedAt time.Time `json:"recorded_at"`
+	Revision   string    `json:"revision"`
+	Label      string    `json:"label,omitempty"`
+	Output     Output    `json:"output"`
+}
+
+// loadHistory は履歴のファイルを読む。ファイルがなければ空の履歴を返す
+// 履歴は1行に1回分の結果を書いたJSON Lines
+func loadHistory(path string) ([]Run, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []Run{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	runs := []Run{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		run := Run{}
+		err := json.Unmarshal(scanner.Bytes(), &run)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		runs = append(runs, run)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+func appendHistory(path string, run Run) error {
+	b, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func findRun(runs []Run, id int) (Run, error) {
+	for _, run := range runs {
+		if run.ID == id {
+			return run, nil
+		}
+	}
+	return Run{}, fmt.Errorf("run #%d not found", id)
+}
+
+// gitRevision は dir のコミットを返す。コミットしていない変更があれば -dirty を付ける
+func gitRevision(dir string) (string, error) {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "--short", "HEAD").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get git revision of %s: %w", dir, err)
+	}
+	revision := strings.TrimSpace(string(out))
+
+	out, err = exec.Command("git", "-C", dir, "status", "--porcelain", "--", ".").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get git status of %s: %w", dir, err)
+	}
+	if len(strings.TrimSpace(string(out))) > 0 {
+		revision += "-dirty"
+	}
+	return revision, nil
+}
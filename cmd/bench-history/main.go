@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultHistoryPath = "bench-history.jsonl"
+	defaultWebappDir   = "webapp"
+
+	exitRegression = 1
+	exitError      = 2
+)
+
+const usage = `Usage: bench-history <command> [options]
+
+Commands:
+  record [FILE]           ベンチマーカーの結果(FILE がなければ標準入力)を履歴に保存する
+  list                    履歴を表示する
+  diff [BASE [TARGET]]    2回の結果を比べる。省略すると最後の2回を比べる。悪化していれば終了コード1で終わる
+
+Run 'bench-history <command> -help' for options.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(exitError)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "record":
+		err = runRecord(os.Args[2:])
+	case "list":
+		err = runList(os.Args[2:])
+	case "diff":
+		var regression bool
+		regression, err = runDiff(os.Args[2:])
+		if err == nil && regression {
+			os.Exit(exitRegression)
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(exitError)
+	}
+	if err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(exitError)
+	}
+}
+
+func runRecord(args []string) error {
+	flags := flag.NewFlagSet("record", flag.ContinueOnError)
+	historyPath := flags.String("history", defaultHistoryPath, "history file")
+	revision := flags.String("revision", "", "revision of the webapp (default: git revision of -webapp-dir)")
+	webappDir := flags.String("webapp-dir", defaultWebappDir, "webapp directory to get the git revision from")
+	label := flags.String("label", "", "label of this run")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if flags.NArg() > 0 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	output := Output{}
+	err = json.NewDecoder(r).Decode(&output)
+	if err != nil {
+		return fmt.Errorf("failed to read benchmarker output: %w", err)
+	}
+
+	if *revision == "" {
+		*revision, err = gitRevision(*webappDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	runs, err := loadHistory(*historyPath)
+	if err != nil {
+		return err
+	}
+	id := 1
+	if len(runs) > 0 {
+		id = runs[len(runs)-1].ID + 1
+	}
+
+	run := Run{
+		ID:         id,
+		RecordedAt: time.Now(),
+		Revision:   *revision,
+		Label:      *label,
+		Output:     output,
+	}
+	err = appendHistory(*historyPath, run)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("recorded run #%d (score: %d, pass: %t, revision: %s)\n", run.ID, output.Score, output.Pass, run.Revision)
+	return nil
+}
+
+func runList(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	historyPath := flags.String("history", defaultHistoryPath, "history file")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	runs, err := loadHistory(*historyPath)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tRECORDED AT\tREVISION\tPASS\tSCORE\tMESSAGES\tLABEL")
+	for _, run := range runs {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%d\t%d\t%s\n",
+			run.ID,
+			run.RecordedAt.Local().Format("2006-01-02 15:04:05"),
+			run.Revision,
+			run.Output.Pass,
+			run.Output.Score,
+			len(run.Output.Messages),
+			run.Label,
+		)
+	}
+	return w.Flush()
+}
+
+func runDiff(args []string) (bool, error) {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	historyPath := flags.String("history", defaultHistoryPath, "history file")
+	th := Thresholds{}
+	flags.Float64Var(&th.Score, "score-threshold", 0.05, "score drop ratio regarded as a regression")
+	flags.Float64Var(&th.Latency, "latency-threshold", 0.2, "p50/p99 latency increase ratio regarded as a regression")
+	flags.DurationVar(&th.LatencyMinDiff, "latency-min-diff", 10*time.Millisecond, "latency increase smaller than this is ignored")
+	err := flags.Parse(args)
+	if err != nil {
+		return false, err
+	}
+	if flags.NArg() > 2 {
+		return false, fmt.Errorf("too many arguments")
+	}
+
+	runs, err := loadHistory(*historyPath)
+	if err != nil {
+		return false, err
+	}
+	if len(runs) == 0 {
+		return false, fmt.Errorf("no runs in %s", *historyPath)
+	}
+
+	// 省略したら最後の結果とその1つ前を比べる
+	base, target := Run{}, runs[len(runs)-1]
+	switch flags.NArg() {
+	case 0:
+		if len(runs) < 2 {
+			return false, fmt.Errorf("need at least 2 runs in %s", *historyPath)
+		}
+		base = runs[len(runs)-2]
+	case 1:
+		base, err = findRunArg(runs, flags.Arg(0))
+	case 2:
+		base, err = findRunArg(runs, flags.Arg(0))
+		if err == nil {
+			target, err = findRunArg(runs, flags.Arg(1))
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	c := compareRuns(base, target, th)
+	c.Print(os.Stdout)
+	return c.HasRegression(), nil
+}
+
+func findRunArg(runs []Run, arg string) (Run, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return Run{}, fmt.Errorf("incorrect run id: %s", arg)
+	}
+	return findRun(runs, id)
+}
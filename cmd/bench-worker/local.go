@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	localJobStatusQueued  = "queued"
+	localJobStatusRunning = "running"
+
+	localJobsFile  = "jobs.json"
+	localResultDir = "results"
+)
+
+// LocalJob はローカルのキューに積まれたジョブ。結果の stdout と stderr は大きいので別のファイルに置く
+type LocalJob struct {
+	Job
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type localQueueState struct {
+	NextID int         `json:"next_id"`
+	Jobs   []*LocalJob `json:"jobs"`
+}
+
+// localQueue はポータルの代わりにJSONファイルをキューとして使う
+// dir/jobs.json にジョブの一覧、dir/results/{id}.json にジョブごとの結果を保存する
+type localQueue struct {
+	dir string
+
+	mu    sync.Mutex
+	state localQueueState
+}
+
+func newLocalQueue(dir string) (*localQueue, error) {
+	err := os.MkdirAll(filepath.Join(dir, localResultDir), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &localQueue{
+		dir:   dir,
+		state: localQueueState{NextID: 1},
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, localJobsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &q.state)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", localJobsFile, err)
+		}
+	}
+
+	// 実行中に止まったジョブは積み直す
+	for _, job := range q.state.Jobs {
+		if job.Status == localJobStatusRunning {
+			job.Status = localJobStatusQueued
+			job.StartedAt = nil
+		}
+	}
+
+	return q, q.save()
+}
+
+// save はジョブの一覧を書き出す。書いている途中で止まっても壊れないように一時ファイルからrenameする
+// 呼び出し側で mu を取っておく
+func (q *localQueue) save() error {
+	b, err := json.MarshalIndent(q.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(q.dir, localJobsFile), b)
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (q *localQueue) Submit(team *Team) (*LocalJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job := &LocalJob{
+		Job: Job{
+			ID:     q.state.NextID,
+			Team:   team,
+			Status: localJobStatusQueued,
+		},
+		CreatedAt: time.Now(),
+	}
+	q.state.NextID++
+	q.state.Jobs = append(q.state.Jobs, job)
+
+	err := q.save()
+	if err != nil {
+		return nil, err
+	}
+	copied := *job
+	return &copied, nil
+}
+
+// Dequeue は待ちのジョブを1つ実行中にして返す
+// チームごとに順番に回るように、実行中のジョブが少ないチーム、最後に始めたのが古いチームを優先する
+// 同じチームの中では古いジョブから実行する
+func (q *localQueue) Dequeue() (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	running := map[string]int{}
+	lastStarted := map[string]time.Time{}
+	for _, job := range q.state.Jobs {
+		key := teamKey(job.Team)
+		if job.Status == localJobStatusRunning {
+			running[key]++
+		}
+		if job.StartedAt != nil && job.StartedAt.After(lastStarted[key]) {
+			lastStarted[key] = *job.StartedAt
+		}
+	}
+
+	var next *LocalJob
+	for _, job := range q.state.Jobs {
+		if job.Status != localJobStatusQueued {
+			continue
+		}
+		if next == nil {
+			next = job
+			continue
+		}
+
+		key, nextKey := teamKey(job.Team), teamKey(next.Team)
+		if running[key] != running[nextKey] {
+			if running[key] < running[nextKey] {
+				next = job
+			}
+			continue
+		}
+		if lastStarted[key].Before(lastStarted[nextKey]) {
+			next = job
+		}
+	}
+	if next == nil {
+		return nil, errorJobNotFound
+	}
+
+	now := time.Now()
+	next.Status = localJobStatusRunning
+	next.StartedAt = &now
+	err := q.save()
+	if err != nil {
+		return nil, err
+	}
+
+	copied := next.Job
+	return &copied, nil
+}
+
+func teamKey(team *Team) string {
+	if team == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%s", team.ID, team.Name)
+}
+
+// Report は結果を保存してジョブを結果の状態(done か aborted)にする
+func (q *localQueue) Report(job *Job, result *Result) error {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(q.resultPath(job.ID), b)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, j := range q.state.Jobs {
+		if j.ID != job.ID {
+			continue
+		}
+
+		now := time.Now()
+		j.Status = result.Status
+		j.Score = result.Score
+		j.Reason = result.Reason
+		j.FinishedAt = &now
+		return q.save()
+	}
+	return errorJobNotFound
+}
+
+func (q *localQueue) resultPath(id int) string {
+	return filepath.Join(q.dir, localResultDir, fmt.Sprintf("%d.json", id))
+}
+
+// List は status のジョブを新しい順に返す。status が空ならすべて返す
+func (q *localQueue) List(status string) []LocalJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := []LocalJob{}
+	for i := len(q.state.Jobs) - 1; i >= 0; i-- {
+		job := q.state.Jobs[i]
+		if status != "" && job.Status != status {
+			continue
+		}
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+func (q *localQueue) Get(id int) (*LocalJob, *Result, error) {
+	q.mu.Lock()
+	var found *LocalJob
+	for _, job := range q.state.Jobs {
+		if job.ID == id {
+			copied := *job
+			found = &copied
+			break
+		}
+	}
+	q.mu.Unlock()
+
+	if found == nil {
+		return nil, nil, errorJobNotFound
+	}
+
+	b, err := os.ReadFile(q.resultPath(id))
+	if os.IsNotExist(err) {
+		return found, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	result := &Result{}
+	err = json.Unmarshal(b, result)
+	if err != nil {
+		return nil, nil, err
+	}
+	return found, result, nil
+}
+
+type resLocalJob struct {
+	*LocalJob
+	Result *Result `json:"result,omitempty"`
+}
+
+// serveLocalAPI はチームのメンバーがジョブを積んで結果を見るためのAPIを提供する
+//
+//	POST /jobs       ベンチマーク対象のチーム(ポータルの Team と同じ形)を受け取ってジョブを積む
+//	GET  /jobs       ジョブの一覧。?status= で絞り込む
+//	GET  /jobs/{id}  ジョブと、終わっていれば結果(stdout と stderr を含む)
+func serveLocalAPI(addr string, q *localQueue) error {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /jobs", func(w http.ResponseWriter, r *http.Request) {
+		team := &Team{}
+		err := json.NewDecoder(r.Body).Decode(team)
+		if err != nil {
+			writeLocalError(w, http.StatusBadRequest, "json decode error")
+			return
+		}
+		if _, err := findBenchmarkTargetServer(&Job{Team: team}); err != nil {
+			writeLocalError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		job, err := q.Submit(team)
+		if err != nil {
+			log.Println(err)
+			writeLocalError(w, http.StatusInternalServerError, "failed to save job")
+			return
+		}
+		writeLocalJSON(w, http.StatusCreated, job)
+	})
+
+	mux.HandleFunc("GET /jobs", func(w http.ResponseWriter, r *http.Request) {
+		writeLocalJSON(w, http.StatusOK, q.List(r.URL.Query().Get("status")))
+	})
+
+	mux.HandleFunc("GET /jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeLocalError(w, http.StatusBadRequest, "incorrect job id")
+			return
+		}
+
+		job, result, err := q.Get(id)
+		if err == errorJobNotFound {
+			writeLocalError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			writeLocalError(w, http.StatusInternalServerError, "failed to read result")
+			return
+		}
+		writeLocalJSON(w, http.StatusOK, resLocalJob{LocalJob: job, Result: result})
+	})
+
+	return http.ListenAndServe(addr, mux)
+}
+
+func writeLocalJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeLocalError(w http.ResponseWriter, status int, msg string) {
+	writeLocalJSON(w, status, map[string]string{"error": msg})
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -55,6 +56,17 @@ type BenchmarkResult struct {
 	Status string
 }
 
+// BenchmarkerConfig はベンチマーカーの起動方法
+// PaymentURL と ShipmentURL が空ならこのホスト名から外部サービスのURLを決める
+type BenchmarkerConfig struct {
+	Path         string
+	PaymentURL   string
+	ShipmentURL  string
+	TargetScheme string
+	DataDir      string
+	StaticDir    string
+}
+
 type BenchmarkResultStdout struct {
 	Pass     bool     `json:"pass"`
 	Score    int      `json:"score"`
@@ -68,6 +80,10 @@ const (
 	maxNumMessage          = 20
 	maxBenchmarkTime       = 180 * time.Second
 	defaultBenchmarkerPath = "/home/isucon/isucari/bin/benchmarker"
+	defaultDataDir         = "/home/isucon/isucari/initial-data"
+	defaultStaticDir       = "/home/isucon/isucari/webapp/public/static"
+	defaultLocalDir        = "bench-jobs"
+	defaultSpoolDir        = "bench-spool"
 )
 
 var (
@@ -184,12 +200,21 @@ func report(ep string, job *Job, result *Result) error {
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return err
+		return &reportStatusError{Status: res.StatusCode}
 	}
 
 	return nil
 }
 
+// reportStatusError はポータルが報告を 200 以外で返したときのエラー
+type reportStatusError struct {
+	Status int
+}
+
+func (e *reportStatusError) Error() string {
+	return fmt.Sprintf("report failed: status %d", e.Status)
+}
+
 func findBenchmarkTargetServer(job *Job) (*Server, error) {
 	for _, server := range job.Team.Servers {
 		if server.IsBenchTarget {
@@ -207,7 +232,7 @@ func getExternalServiceSuffix() (string, error) {
 	return strings.TrimPrefix(hostname, "bench"), nil
 }
 
-func runBenchmarker(benchmarkerPath string, job *Job) (*BenchmarkResult, error) {
+func runBenchmarker(conf *BenchmarkerConfig, job *Job, ports *jobPorts) (*BenchmarkResult, error) {
 	target, err := findBenchmarkTargetServer(job)
 	if err != nil {
 		return &BenchmarkResult{}, err
@@ -217,30 +242,62 @@ func runBenchmarker(benchmarkerPath string, job *Job) (*BenchmarkResult, error)
 		allowedIPs = append(allowedIPs, server.GlobalIP)
 	}
 
-	suffix, err := getExternalServiceSuffix()
-	if err != nil {
-		return &BenchmarkResult{}, err
+	paymentURL, shipmentURL := conf.PaymentURL, conf.ShipmentURL
+	if paymentURL == "" || shipmentURL == "" {
+		suffix, err := getExternalServiceSuffix()
+		if err != nil {
+			return &BenchmarkResult{}, err
+		}
+		if paymentURL == "" {
+			paymentURL = fmt.Sprintf("https://payment%s.isucon9q.catatsuy.org", suffix)
+		}
+		if shipmentURL == "" {
+			shipmentURL = fmt.Sprintf("https://shipment%s.isucon9q.catatsuy.org", suffix)
+		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), maxBenchmarkTime)
-	defer cancel()
-	cmd := exec.CommandContext(
-		ctx,
-		benchmarkerPath,
-		fmt.Sprintf("-payment-url=https://%s", fmt.Sprintf("payment%s.isucon9q.catatsuy.org", suffix)),
-		fmt.Sprintf("-shipment-url=https://%s", fmt.Sprintf("shipment%s.isucon9q.catatsuy.org", suffix)),
-		fmt.Sprintf("-target-url=https://%s", target.GlobalIP),
+	args := []string{
+		fmt.Sprintf("-target-url=%s://%s", conf.TargetScheme, target.GlobalIP),
 		fmt.Sprintf("-allowed-ips=%s", strings.Join(allowedIPs, ",")),
-		"-data-dir=/home/isucon/isucari/initial-data",
-		"-static-dir=/home/isucon/isucari/webapp/public/static",
+		fmt.Sprintf("-data-dir=%s", conf.DataDir),
+		fmt.Sprintf("-static-dir=%s", conf.StaticDir),
+	}
+	var extraFiles []*os.File
+	if ports != nil {
+		paymentURL = strings.ReplaceAll(paymentURL, portPlaceholder, strconv.Itoa(ports.Payment))
+		shipmentURL = strings.ReplaceAll(shipmentURL, portPlaceholder, strconv.Itoa(ports.Shipment))
+		// ポートを閉じてから渡すと他のプロセスに取られることがあるので、開いたまま渡す
+		files, err := ports.Files()
+		if err != nil {
+			return &BenchmarkResult{}, err
+		}
+		defer func() {
+			for _, f := range files {
+				f.Close()
+			}
+		}()
+		extraFiles = files
+		args = append(args,
+			fmt.Sprintf("-payment-fd=%d", paymentListenerFD),
+			fmt.Sprintf("-shipment-fd=%d", shipmentListenerFD),
+		)
+	}
+	args = append(args,
+		fmt.Sprintf("-payment-url=%s", paymentURL),
+		fmt.Sprintf("-shipment-url=%s", shipmentURL),
 	)
 
+	ctx, cancel := context.WithTimeout(context.Background(), maxBenchmarkTime)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, conf.Path, args...)
+
 	var (
 		stdout bytes.Buffer
 		stderr bytes.Buffer
 	)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
+	cmd.ExtraFiles = extraFiles
 
 	status := "success"
 	done := make(chan error, 1)
@@ -293,46 +350,122 @@ func printPrettyResult(result *Result) {
 	log.Println("============Result end================================")
 }
 
+// runJob は1つのジョブを実行して結果を報告する。ports が nil でなければ使い終わったら返す
+func runJob(conf *BenchmarkerConfig, spool *resultSpool, allocator *portAllocator, job *Job) {
+	log.Printf("Dequeued benchmark job (id: %d)", job.ID)
+	log.Println("============Benchmark job start====================")
+	json.NewEncoder(os.Stderr).Encode(job)
+	log.Println("============Benchmark job end======================")
+
+	var ports *jobPorts
+	var benchmarkResult *BenchmarkResult
+	if allocator != nil {
+		var err error
+		ports, err = allocator.Allocate()
+		if err != nil {
+			// 他のジョブとポートが衝突するのでベンチマークは走らせずに aborted で返す
+			log.Println("Allocate ports fail: ", err)
+			benchmarkResult = &BenchmarkResult{
+				Stderr: fmt.Sprintf("failed to allocate ports: %s", err),
+				Status: "fail",
+			}
+		} else {
+			defer allocator.Release(ports)
+		}
+	}
+
+	if benchmarkResult == nil {
+		log.Printf("Run benchmark (id: %d)", job.ID)
+		var err error
+		benchmarkResult, err = runBenchmarker(conf, job, ports)
+		if err != nil {
+			log.Println("Run benchmark fail: ", err)
+		}
+	}
+
+	log.Printf("Report benchmark result start (id: %d)", job.ID)
+	result := createResult(job, benchmarkResult)
+	printPrettyResult(result)
+	if err := spool.Deliver(job, result); err != nil {
+		log.Println("Spool benchmark result fail: ", err)
+	}
+}
+
 func main() {
 
 	var (
-		apiEndpoint     string
-		interval        time.Duration
-		benchmarkerPath string
+		apiEndpoint string
+		interval    time.Duration
+		concurrency int
+		localAddr   string
+		localDir    string
+		spoolDir    string
 	)
+	conf := &BenchmarkerConfig{}
 
 	flag.StringVar(&apiEndpoint, "ep", apiEndpointDev, "API Endpoint")
 	flag.DurationVar(&interval, "interval", defaultInterval, "Dequeuing interval second")
-	flag.StringVar(&benchmarkerPath, "benchmarker", defaultBenchmarkerPath, "Benchmarker path")
+	flag.IntVar(&concurrency, "concurrency", 1, "number of benchmarks to run at the same time")
+	flag.StringVar(&conf.Path, "benchmarker", defaultBenchmarkerPath, "Benchmarker path")
+	flag.StringVar(&conf.PaymentURL, "payment-url", "", "payment url. "+portPlaceholder+" is replaced with a free port allocated per job (default: derived from hostname)")
+	flag.StringVar(&conf.ShipmentURL, "shipment-url", "", "shipment url. "+portPlaceholder+" is replaced with a free port allocated per job (default: derived from hostname)")
+	flag.StringVar(&conf.TargetScheme, "target-scheme", "https", "scheme of target url")
+	flag.StringVar(&conf.DataDir, "data-dir", defaultDataDir, "data directory")
+	flag.StringVar(&conf.StaticDir, "static-dir", defaultStaticDir, "static file directory")
+	flag.StringVar(&localAddr, "local", "", "run with a local job queue and serve its API on this address instead of the portal (e.g. :9000)")
+	flag.StringVar(&localDir, "local-dir", defaultLocalDir, "directory to store local jobs and results")
+	flag.StringVar(&spoolDir, "spool-dir", defaultSpoolDir, "directory to keep benchmark results until they are reported")
 	flag.Parse()
 
-	ticker := time.NewTicker(interval)
-	for range ticker.C {
-		job, err := dequeue(apiEndpoint)
-		if err != nil {
-			if err != errorJobNotFound {
-				log.Println(err)
-			}
-			continue
-		}
-		log.Println("Dequeued benchmark job")
-		log.Println("============Benchmark job start====================")
-		json.NewEncoder(os.Stderr).Encode(job)
-		log.Println("============Benchmark job end======================")
+	if concurrency < 1 {
+		log.Fatal("-concurrency must be 1 or more")
+	}
+
+	// 外部サービスのURLがポートを含まなければ固定のポートで動かすので、同時には1つしか動かせない
+	var allocator *portAllocator
+	if strings.Contains(conf.PaymentURL, portPlaceholder) && strings.Contains(conf.ShipmentURL, portPlaceholder) {
+		allocator = newPortAllocator()
+	} else if concurrency > 1 {
+		log.Fatalf("-payment-url and -shipment-url must contain %s to run benchmarks concurrently", portPlaceholder)
+	}
 
-		log.Printf("Run benchmark")
-		benchmarkResult, err := runBenchmarker(benchmarkerPath, job)
+	var queue JobQueue = &portalQueue{ep: apiEndpoint}
+	if localAddr != "" {
+		lq, err := newLocalQueue(localDir)
 		if err != nil {
-			log.Println("Run benchmark fail: ", err)
+			log.Fatal(err)
 		}
+		go func() {
+			log.Fatal(serveLocalAPI(localAddr, lq))
+		}()
+		log.Printf("Serving local job API on %s", localAddr)
+		queue = lq
+	}
 
-		log.Printf("Report benchmark result start")
-		result := createResult(job, benchmarkResult)
-		printPrettyResult(result)
-		if err := report(apiEndpoint, job, result); err != nil {
-			log.Println("Report benchmark result fail: ", err)
-		} else {
-			log.Printf("Report benchmark result done")
+	spool, err := newResultSpool(spoolDir, queue)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go spool.Run()
+
+	// 空いている枠の数だけジョブを取り出す。取り出すのはこのゴルーチンだけ
+	slots := make(chan struct{}, concurrency)
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		for len(slots) < cap(slots) {
+			job, err := queue.Dequeue()
+			if err != nil {
+				if err != errorJobNotFound {
+					log.Println(err)
+				}
+				break
+			}
+
+			slots <- struct{}{}
+			go func() {
+				defer func() { <-slots }()
+				runJob(conf, spool, allocator, job)
+			}()
 		}
 	}
 }
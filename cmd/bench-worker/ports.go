@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// portPlaceholder を -payment-url と -shipment-url に含めると、ジョブごとに割り当てたポートに置き換える
+const portPlaceholder = "{port}"
+
+// ベンチマーカーに ExtraFiles で渡す listener のファイルディスクリプタ。ExtraFiles の先頭が3になる
+const (
+	paymentListenerFD  = 3
+	shipmentListenerFD = 4
+)
+
+// jobPorts はジョブごとに割り当てた外部サービスのポート。0ならベンチマーカーのデフォルトのポートを使う
+// listener はベンチマーカーに渡すまで開いておくので、その間に他のプロセスにポートを取られない
+type jobPorts struct {
+	Payment  int
+	Shipment int
+
+	paymentListener  *net.TCPListener
+	shipmentListener *net.TCPListener
+}
+
+// Files はベンチマーカーに ExtraFiles で渡す listener のファイル
+// 返したファイルはベンチマーカーを起動したら閉じてよい
+func (p *jobPorts) Files() ([]*os.File, error) {
+	payment, err := p.paymentListener.File()
+	if err != nil {
+		return nil, err
+	}
+	shipment, err := p.shipmentListener.File()
+	if err != nil {
+		payment.Close()
+		return nil, err
+	}
+	return []*os.File{payment, shipment}, nil
+}
+
+// portAllocator は同時に動くベンチマーカーの外部サービスが同じポートを使わないように空いているポートを配る
+type portAllocator struct{}
+
+func newPortAllocator() *portAllocator {
+	return &portAllocator{}
+}
+
+func (a *portAllocator) Allocate() (*jobPorts, error) {
+	payment, err := a.listen()
+	if err != nil {
+		return nil, err
+	}
+	shipment, err := a.listen()
+	if err != nil {
+		payment.Close()
+		return nil, err
+	}
+	return &jobPorts{
+		Payment:          payment.Addr().(*net.TCPAddr).Port,
+		Shipment:         shipment.Addr().(*net.TCPAddr).Port,
+		paymentListener:  payment,
+		shipmentListener: shipment,
+	}, nil
+}
+
+func (a *portAllocator) Release(ports *jobPorts) {
+	ports.paymentListener.Close()
+	ports.shipmentListener.Close()
+}
+
+// listen はOSに空いているポートを選ばせる。閉じるまでは他のジョブや他のプロセスに同じポートは割り当てられない
+func (a *portAllocator) listen() (*net.TCPListener, error) {
+	return net.ListenTCP("tcp", &net.TCPAddr{})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPortAllocator(t *testing.T) {
+	a := newPortAllocator()
+	ports, err := a.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ports.Payment == 0 || ports.Shipment == 0 || ports.Payment == ports.Shipment {
+		t.Fatalf("ports = %d, %d", ports.Payment, ports.Shipment)
+	}
+
+	// ベンチマーカーに渡すまで他のプロセスには取られない
+	if l, err := net.ListenTCP("tcp", &net.TCPAddr{Port: ports.Payment}); err == nil {
+		l.Close()
+		t.Error("allocated port can be bound before release")
+	}
+
+	// 渡したファイルで接続を受けられる
+	files, err := ports.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.FileListener(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	defer l.Close()
+	if l.Addr().(*net.TCPAddr).Port != ports.Payment {
+		t.Errorf("listener port = %d, want %d", l.Addr().(*net.TCPAddr).Port, ports.Payment)
+	}
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := <-accepted; err != nil {
+		t.Error(err)
+	}
+
+	a.Release(ports)
+}
@@ -0,0 +1,21 @@
+package main
+
+// JobQueue はベンチマークのジョブの取り出し先と結果の報告先
+// ジョブがなければ Dequeue は errorJobNotFound を返す
+type JobQueue interface {
+	Dequeue() (*Job, error)
+	Report(job *Job, result *Result) error
+}
+
+// portalQueue はポータルの /internal/job/ API をキューとして使う
+type portalQueue struct {
+	ep string
+}
+
+func (q *portalQueue) Dequeue() (*Job, error) {
+	return dequeue(q.ep)
+}
+
+func (q *portalQueue) Report(job *Job, result *Result) error {
+	return report(q.ep, job, result)
+}
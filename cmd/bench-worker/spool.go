@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	spoolRetryInterval = time.Second
+	spoolMinBackoff    = time.Second
+	spoolMaxBackoff    = 5 * time.Minute
+)
+
+// spooledResult は報告できるまでスプールに置いておく結果
+type spooledResult struct {
+	Job           *Job      `json:"job"`
+	Result        *Result   `json:"result"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// resultSpool は結果を報告する前にディレクトリに書き出し、報告できたら消す
+// 報告に失敗したら間隔を倍にしながら報告できるまでやり直す。
+// やり直しても報告できない失敗(4xx やジョブがない)なら failed/ に移してあきらめる。
+// ワーカーを再起動してもディレクトリに残っている結果は報告し直すので、ポータルが落ちていてもスコアは失われない
+type resultSpool struct {
+	dir   string
+	queue JobQueue
+
+	mu      sync.Mutex
+	pending map[int]*spooledResult
+}
+
+func newResultSpool(dir string, queue JobQueue) (*resultSpool, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &resultSpool{
+		dir:     dir,
+		queue:   queue,
+		pending: make(map[int]*spooledResult),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sr := &spooledResult{}
+		err = json.Unmarshal(b, sr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		// 再起動したらすぐに報告し直す
+		sr.NextAttemptAt = time.Time{}
+		s.pending[sr.Job.ID] = sr
+	}
+	if len(s.pending) > 0 {
+		log.Printf("Found %d spooled benchmark results", len(s.pending))
+	}
+
+	return s, nil
+}
+
+// Deliver は結果をスプールに書き出してから報告する
+// 報告に失敗しても Run がやり直すので、エラーを返すのはスプールに書き出せなかったときだけ
+func (s *resultSpool) Deliver(job *Job, result *Result) error {
+	sr := &spooledResult{Job: job, Result: result}
+	err := s.write(sr)
+	if err != nil {
+		// 書き出せなくても報告はしておく
+		if rerr := s.queue.Report(job, result); rerr != nil {
+			log.Printf("Report benchmark result fail (id: %d): %s", job.ID, rerr)
+		}
+		return err
+	}
+
+	if s.attempt(sr) {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.pending[job.ID] = sr
+	s.mu.Unlock()
+	return nil
+}
+
+// Run は報告できていない結果を時間がきたものから報告し直す。戻らない
+func (s *resultSpool) Run() {
+	for range time.Tick(spoolRetryInterval) {
+		for _, sr := range s.due(time.Now()) {
+			if !s.attempt(sr) {
+				continue
+			}
+
+			s.mu.Lock()
+			delete(s.pending, sr.Job.ID)
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *resultSpool) due(now time.Time) []*spooledResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := []*spooledResult{}
+	for _, sr := range s.pending {
+		if !sr.NextAttemptAt.After(now) {
+			results = append(results, sr)
+		}
+	}
+	// 古いジョブから報告する
+	sort.Slice(results, func(i, j int) bool { return results[i].Job.ID < results[j].Job.ID })
+	return results
+}
+
+// attempt は1回報告してみる。報告できたらスプールから消し、できなければ次に報告する時刻を決める
+func (s *resultSpool) attempt(sr *spooledResult) bool {
+	sr.Attempts++
+	err := s.queue.Report(sr.Job, sr.Result)
+	if err == nil {
+		log.Printf("Report benchmark result done (id: %d, attempts: %d)", sr.Job.ID, sr.Attempts)
+		if err := os.Remove(s.path(sr.Job.ID)); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		return true
+	}
+
+	if isPermanentReportError(err) {
+		sr.LastError = err.Error()
+		log.Printf("Report benchmark result give up (id: %d, attempts: %d): %s", sr.Job.ID, sr.Attempts, err)
+		if err := s.fail(sr); err != nil {
+			log.Println(err)
+		}
+		return true
+	}
+
+	backoff := spoolBackoff(sr.Attempts)
+	sr.NextAttemptAt = time.Now().Add(backoff)
+	sr.LastError = err.Error()
+	log.Printf("Report benchmark result fail (id: %d, attempts: %d, retry in %s): %s", sr.Job.ID, sr.Attempts, backoff, err)
+	if err := s.write(sr); err != nil {
+		log.Println(err)
+	}
+	return false
+}
+
+// fail は報告をあきらめた結果を failed/ に移す。あとから人が見られるように消しはしない
+func (s *resultSpool) fail(sr *spooledResult) error {
+	dir := filepath.Join(s.dir, "failed")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(sr)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(filepath.Join(dir, fmt.Sprintf("%d.json", sr.Job.ID)), b)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(s.path(sr.Job.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *resultSpool) write(sr *spooledResult) error {
+	b, err := json.Marshal(sr)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(sr.Job.ID), b)
+}
+
+func (s *resultSpool) path(id int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d.json", id))
+}
+
+// spoolBackoff は attempts 回失敗したあとに待つ時間。1秒から倍にしていき、spoolMaxBackoff で止める
+func spoolBackoff(attempts int) time.Duration {
+	backoff := spoolMinBackoff
+	for i := 1; i < attempts && backoff < spoolMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > spoolMaxBackoff {
+		backoff = spoolMaxBackoff
+	}
+	return backoff
+}
+
+// isPermanentReportError はやり直しても報告できない失敗かどうか
+// ネットワークのエラーと 5xx、408、429 はポータルが戻ればうまくいくのでやり直す
+func isPermanentReportError(err error) bool {
+	if err == errorJobNotFound {
+		return true
+	}
+	var serr *reportStatusError
+	if errors.As(err, &serr) {
+		switch serr.Status {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return false
+		}
+		return serr.Status >= 400 && serr.Status < 500
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestIsPermanentReportError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"job not found", errorJobNotFound, true},
+		{"network", errors.New("connection refused"), false},
+		{"400", &reportStatusError{Status: 400}, true},
+		{"404", &reportStatusError{Status: 404}, true},
+		{"408", &reportStatusError{Status: 408}, false},
+		{"429", &reportStatusError{Status: 429}, false},
+		{"500", &reportStatusError{Status: 500}, false},
+		{"503", &reportStatusError{Status: 503}, false},
+		{"wrapped 429", fmt.Errorf("report: %w", &reportStatusError{Status: 429}), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPermanentReportError(tt.err); got != tt.want {
+				t.Errorf("isPermanentReportError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
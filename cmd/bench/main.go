@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
@@ -14,6 +15,7 @@ import (
 	"github.com/isucon/isucon9-qualify/bench/asset"
 	"github.com/isucon/isucon9-qualify/bench/fails"
 	"github.com/isucon/isucon9-qualify/bench/scenario"
+	"github.com/isucon/isucon9-qualify/bench/score"
 	"github.com/isucon/isucon9-qualify/bench/server"
 	"github.com/isucon/isucon9-qualify/bench/session"
 )
@@ -24,8 +26,29 @@ type Output struct {
 	Campaign int      `json:"campaign"`
 	Language string   `json:"language"`
 	Messages []string `json:"messages"`
+	// Breakdown は最終チェックまで進んだときのスコアの内訳
+	Breakdown *score.Breakdown `json:"breakdown,omitempty"`
+	// Endpoints は負荷走行中のエンドポイントごとのリクエスト数とレスポンスタイム
+	Endpoints []session.EndpointStat `json:"endpoints,omitempty"`
+	// Ramp は -mode=ramp のときの段階ごとの結果
+	Ramp *scenario.RampResult `json:"ramp,omitempty"`
+	// Open は -mode=open のときの到着数とキューで待った時間
+	Open *scenario.OpenResult `json:"open,omitempty"`
+	// Soak は -mode=soak のときのスナップショットと劣化の検出結果
+	Soak *scenario.SoakResult `json:"soak,omitempty"`
 }
 
+const (
+	// modeContest は本番と同じく60秒間負荷をかける
+	modeContest = "contest"
+	// modeRamp は負荷を段階的に上げて、アプリケーションが捌ける最大の負荷を調べる
+	modeRamp = "ramp"
+	// modeOpen は60秒間、アプリケーションの速さに関係なく決まった到着率で負荷をかける
+	modeOpen = "open"
+	// modeSoak は長時間負荷をかけて、レスポンスタイムやエラーの割合が悪くなっていかないかを調べる
+	modeSoak = "soak"
+)
+
 type Config struct {
 	TargetURLStr string
 	TargetHost   string
@@ -33,6 +56,9 @@ type Config struct {
 	PaymentURL   string
 	PaymentPort  int
 	ShipmentPort int
+	// PaymentFD と ShipmentFD は起動したプロセスから受け取った listener のファイルディスクリプタ。0ならポートを開く
+	PaymentFD  int
+	ShipmentFD int
 
 	AllowedIPs []net.IP
 }
@@ -49,6 +75,12 @@ func main() {
 	allowedIPStr := ""
 	dataDir := ""
 	staticDir := ""
+	policyName := ""
+	scoreOpts := score.Options{}
+	mode := ""
+	rampConf := scenario.RampConfig{}
+	openConf := scenario.OpenConfig{}
+	soakConf := scenario.SoakConfig{}
 
 	flags.StringVar(&conf.TargetURLStr, "target-url", "http://127.0.0.1:8000", "target url")
 	flags.StringVar(&conf.TargetHost, "target-host", "isucon9.catatsuy.org", "target host")
@@ -56,15 +88,56 @@ func main() {
 	flags.StringVar(&conf.ShipmentURL, "shipment-url", "http://localhost:7001", "shipment url")
 	flags.IntVar(&conf.PaymentPort, "payment-port", 5555, "payment service port")
 	flags.IntVar(&conf.ShipmentPort, "shipment-port", 7001, "shipment service port")
+	flags.IntVar(&conf.PaymentFD, "payment-fd", 0, "file descriptor of an inherited listener for payment service. used instead of payment-port")
+	flags.IntVar(&conf.ShipmentFD, "shipment-fd", 0, "file descriptor of an inherited listener for shipment service. used instead of shipment-port")
 	flags.StringVar(&dataDir, "data-dir", "initial-data", "data directory")
 	flags.StringVar(&staticDir, "static-dir", "webapp/public/static", "static file directory")
 	flags.StringVar(&allowedIPStr, "allowed-ips", "", "allowed ips (comma separated)")
+	flags.StringVar(&policyName, "scoring", score.PolicyContest, "scoring policy ("+strings.Join(score.Policies(), ", ")+")")
+	flags.DurationVar(&scoreOpts.SLO, "slo", score.DefaultSLO, "p99 latency objective of each endpoint for latency-slo scoring policy")
+	flags.StringVar(&mode, "mode", modeContest, "load mode ("+strings.Join([]string{modeContest, modeRamp, modeOpen, modeSoak}, ", ")+")")
+	flags.DurationVar(&rampConf.StepInterval, "ramp-step", scenario.DefaultRampStepInterval, "interval to add a load worker in ramp mode")
+	flags.IntVar(&rampConf.MaxWorkers, "ramp-max-workers", scenario.DefaultRampMaxWorkers, "max number of load workers in ramp mode")
+	flags.Float64Var(&rampConf.MaxErrorRate, "ramp-max-error-rate", scenario.DefaultRampMaxErrorRate, "error rate regarded as unsustainable in ramp mode")
+	flags.DurationVar(&rampConf.MaxP99, "ramp-max-p99", scenario.DefaultRampMaxP99, "p99 latency regarded as unsustainable in ramp mode")
+	flags.Float64Var(&openConf.Rate, "open-rate", scenario.DefaultOpenRate, "mean arrivals per second in open mode")
+	flags.IntVar(&openConf.MaxInFlight, "open-max-in-flight", scenario.DefaultOpenMaxInFlight, "max number of arrivals processed at the same time in open mode")
+	flags.IntVar(&openConf.MaxQueue, "open-max-queue", scenario.DefaultOpenMaxQueue, "max number of waiting arrivals in open mode. more arrivals are dropped")
+	flags.DurationVar(&soakConf.Duration, "soak-duration", scenario.DefaultSoakDuration, "duration of load in soak mode")
+	flags.DurationVar(&soakConf.Interval, "soak-interval", scenario.DefaultSoakInterval, "interval to take a snapshot and reconcile transactions in soak mode")
+	flags.IntVar(&soakConf.Workers, "soak-workers", scenario.DefaultSoakWorkers, "number of load workers in soak mode")
+	flags.Float64Var(&soakConf.LatencyDrift, "soak-latency-drift", scenario.DefaultSoakLatencyDrift, "increase ratio of p99 latency from baseline regarded as drift in soak mode")
+	flags.Float64Var(&soakConf.ErrorRateDrift, "soak-error-rate-drift", scenario.DefaultSoakErrorRateDrift, "increase of error rate from baseline regarded as drift in soak mode")
+	flags.IntVar(&soakConf.MaxItems, "soak-max-items", scenario.DefaultSoakMaxItems, "max number of items the benchmarker remembers in soak mode")
 
 	err := flags.Parse(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	policy, err := score.NewPolicy(policyName, scoreOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch mode {
+	case modeContest:
+	case modeRamp:
+		if rampConf.StepInterval <= 0 || rampConf.MaxWorkers < 1 {
+			log.Fatal("ramp-step must be positive and ramp-max-workers must be 1 or more")
+		}
+	case modeOpen:
+		if openConf.Rate <= 0 || openConf.MaxInFlight < 1 || openConf.MaxQueue < 0 {
+			log.Fatal("open-rate must be positive, open-max-in-flight must be 1 or more and open-max-queue must not be negative")
+		}
+	case modeSoak:
+		if soakConf.Duration <= 0 || soakConf.Interval <= 0 || soakConf.Workers < 1 || soakConf.MaxItems < 1 {
+			log.Fatal("soak-duration and soak-interval must be positive, soak-workers and soak-max-items must be 1 or more")
+		}
+	default:
+		log.Fatalf("unknown mode: %s", mode)
+	}
+
 	if allowedIPStr != "" {
 		for _, str := range strings.Split(allowedIPStr, ",") {
 			aip := net.ParseIP(str)
@@ -76,9 +149,25 @@ func main() {
 	}
 
 	// 外部サービスの起動
-	sp, ss, err := server.RunServer(conf.PaymentPort, conf.ShipmentPort, dataDir, conf.AllowedIPs)
-	if err != nil {
-		log.Fatal(err)
+	var (
+		sp *server.ServerPayment
+		ss *server.ServerShipment
+	)
+	if conf.PaymentFD > 0 && conf.ShipmentFD > 0 {
+		liPayment, err := fileListener(conf.PaymentFD, "payment")
+		if err != nil {
+			log.Fatal(err)
+		}
+		liShipment, err := fileListener(conf.ShipmentFD, "shipment")
+		if err != nil {
+			log.Fatal(err)
+		}
+		sp, ss = server.RunServerOnListeners(liPayment, liShipment, dataDir, conf.AllowedIPs)
+	} else {
+		sp, ss, err = server.RunServer(conf.PaymentPort, conf.ShipmentPort, dataDir, conf.AllowedIPs)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	scenario.SetShipment(ss)
@@ -137,9 +226,6 @@ func main() {
 		return
 	}
 
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(scenario.ExecutionSeconds*time.Second))
-	defer cancel()
-
 	log.Print("=== validation ===")
 
 	// 外部サービスのレイテンシを追加
@@ -152,20 +238,51 @@ func main() {
 	// 理想的には全リクエストはcheckされるべきだが、それをやるとパフォーマンスが出し切れず、最適化されたアプリケーションよりも遅くなる
 	// checkとloadは区別がつかないようにしないといけない。loadのリクエストはログアウト状態しかなかったので、ログアウト時のキャッシュを強くするだけでスコアがはねる問題が過去にあった
 	// 今回はほぼ全リクエストがログイン前提になっているので、checkとloadの区別はできないはず
-	scenario.Validation(ctx, campaign)
+	session.Stats.Reset()
+	var ramp *scenario.RampResult
+	var open *scenario.OpenResult
+	var soak *scenario.SoakResult
+	switch mode {
+	case modeRamp:
+		// 負荷を上げきるまで続けるので時間は決めない
+		ramp = scenario.Ramp(context.Background(), rampConf)
+	case modeOpen:
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(scenario.ExecutionSeconds*time.Second))
+		open = scenario.Open(ctx, openConf)
+		cancel()
+	case modeSoak:
+		// 時間は -soak-duration で決める
+		soak = scenario.Soak(context.Background(), soakConf)
+	default:
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(scenario.ExecutionSeconds*time.Second))
+		scenario.Validation(ctx, campaign)
+		cancel()
+	}
+	endpoints := session.Stats.Get()
 
 	// context.Canceledのエラーは直後に取れば基本的には入ってこない
 	eMsgs, cCnt, aCnt, tCnt := fails.ErrorsForCheck.Get()
-	// critical errorは1つでもあれば、application errorは10回以上で失格
-	if cCnt > 0 || aCnt >= 10 {
+	in := score.Input{
+		CriticalErrors:    cCnt,
+		ApplicationErrors: aCnt,
+		TimeoutErrors:     tCnt,
+		Campaign:          campaign,
+		Endpoints:         endpoints,
+	}
+	// 本番のルールではcritical errorは1つでもあれば、application errorは10回以上で失格
+	if policy.Abort(in) {
 		log.Print("cause error!")
 
 		output := Output{
-			Pass:     false,
-			Score:    0,
-			Campaign: campaign,
-			Language: language,
-			Messages: uniqMsgs(eMsgs),
+			Pass:      false,
+			Score:     0,
+			Campaign:  campaign,
+			Language:  language,
+			Messages:  uniqMsgs(eMsgs),
+			Endpoints: endpoints,
+			Ramp:      ramp,
+			Open:      open,
+			Soak:      soak,
 		}
 		json.NewEncoder(os.Stdout).Encode(output)
 
@@ -176,62 +293,47 @@ func main() {
 
 	log.Print("=== final check ===")
 	// 最終チェック：ベンチマーカーの記録とアプリケーションの記録を突き合わせて、最終的なスコアを算出する
-	score := scenario.FinalCheck(context.Background())
+	finalResult := scenario.FinalCheck(context.Background())
 
 	// application errorだけが発生する
 	fMsgs, _, faCnt, _ := fails.ErrorsForFinal.Get()
 	msgs := append(uniqMsgs(eMsgs), fMsgs...)
 
-	aCnt += faCnt
-
-	// application errorは10回以上で失格
-	if aCnt >= 10 {
-		output := Output{
-			Pass:     false,
-			Score:    0,
-			Campaign: campaign,
-			Language: language,
-			Messages: msgs,
-		}
-		json.NewEncoder(os.Stdout).Encode(output)
-
-		return
-	}
+	in.ApplicationErrors += faCnt
+	in.Sales = finalResult.Sales
+	in.TransactionStatusCounts = finalResult.ReportStatusCounts
 
-	// application errorは1回で500点減点
-	penalty := int64(500 * aCnt)
+	result := policy.Score(in)
+	result.Breakdown.Log()
 
-	if tCnt > 200 {
-		// trivial errorは200回を超えたら100回毎に5000点減点
-		penalty += int64(5000 * (1 + (tCnt-200)/100))
+	output := Output{
+		Pass:      result.Pass,
+		Score:     result.Score,
+		Campaign:  campaign,
+		Language:  language,
+		Messages:  msgs,
+		Breakdown: result.Breakdown,
+		Endpoints: endpoints,
+		Ramp:      ramp,
+		Open:      open,
+		Soak:      soak,
 	}
+	json.NewEncoder(os.Stdout).Encode(output)
+}
 
-	log.Print(score, penalty)
-
-	score -= penalty
-
-	// 0点以下なら失格
-	if score <= 0 {
-		output := Output{
-			Pass:     false,
-			Score:    0,
-			Campaign: campaign,
-			Language: language,
-			Messages: msgs,
-		}
-		json.NewEncoder(os.Stdout).Encode(output)
-
-		return
+// fileListener は起動したプロセスから受け取ったファイルディスクリプタを listener にする
+func fileListener(fd int, name string) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), name)
+	if f == nil {
+		return nil, fmt.Errorf("%s-fd: %d is not a valid file descriptor", name, fd)
 	}
+	defer f.Close()
 
-	output := Output{
-		Pass:     true,
-		Score:    score,
-		Campaign: campaign,
-		Language: language,
-		Messages: msgs,
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s-fd: %w", name, err)
 	}
-	json.NewEncoder(os.Stdout).Encode(output)
+	return l, nil
 }
 
 func uniqMsgs(allMsgs []string) []string {
@@ -16,12 +16,21 @@ func main() {
 	flags.SetOutput(os.Stderr)
 
 	port := 0
+	tokenTTL := time.Duration(0)
+	maxTokens := 0
+	sweepInterval := time.Duration(0)
 
 	flags.IntVar(&port, "port", 5555, "payment service port")
+	flags.DurationVar(&tokenTTL, "token-ttl", server.DefaultCardTokenTTL, "lifetime of card tokens")
+	flags.IntVar(&maxTokens, "max-tokens", 100000, "max number of card tokens kept in memory (0 is unlimited)")
+	flags.DurationVar(&sweepInterval, "sweep-interval", time.Minute, "interval to sweep expired card tokens")
 	err := flags.Parse(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
+	if tokenTTL <= 0 || maxTokens < 0 || sweepInterval <= 0 {
+		log.Fatal("token-ttl and sweep-interval must be positive and max-tokens must not be negative")
+	}
 
 	liPayment, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
 	if err != nil {
@@ -35,6 +44,8 @@ func main() {
 	}
 
 	pay.SetDelay(200 * time.Millisecond)
+	pay.SetTokenLimit(tokenTTL, maxTokens)
+	go pay.RunSweeper(sweepInterval)
 
 	log.Print(serverPayment.Serve(liPayment))
 }
@@ -17,13 +17,22 @@ func main() {
 
 	dataDir := ""
 	port := 0
+	completedTTL := time.Duration(0)
+	maxShipments := 0
+	sweepInterval := time.Duration(0)
 
 	flags.StringVar(&dataDir, "data-dir", "initial-data", "data directory")
 	flags.IntVar(&port, "port", 7001, "shipment service port")
+	flags.DurationVar(&completedTTL, "completed-ttl", 0, "time to keep completed shipments (0 keeps them forever)")
+	flags.IntVar(&maxShipments, "max-shipments", 1000000, "max number of shipments kept in memory (0 is unlimited)")
+	flags.DurationVar(&sweepInterval, "sweep-interval", time.Minute, "interval to sweep completed shipments")
 	err := flags.Parse(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
+	if completedTTL < 0 || maxShipments < 0 || sweepInterval <= 0 {
+		log.Fatal("completed-ttl and max-shipments must not be negative and sweep-interval must be positive")
+	}
 
 	liShipment, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
 	if err != nil {
@@ -36,6 +45,8 @@ func main() {
 	}
 
 	ship.SetDelay(200 * time.Millisecond)
+	ship.SetStoreLimit(completedTTL, maxShipments)
+	go ship.RunSweeper(sweepInterval)
 
 	log.Print(serverShipment.Serve(liShipment))
 }
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	AdminActionSuspendUser   = "suspend_user"
+	AdminActionUnsuspendUser = "unsuspend_user"
+	AdminActionStopItem      = "stop_item"
+	AdminActionResumeItem    = "resume_item"
+	AdminActionRefund        = "refund"
+
+	AdminTargetUser           = "user"
+	AdminTargetItem           = "item"
+	AdminTargetBuyReservation = "buy_reservation"
+
+	AdminLogsPerPage = 50
+)
+
+type AdminLog struct {
+	ID         int64     `json:"id" db:"id"`
+	AdminID    int64     `json:"admin_id" db:"admin_id"`
+	Action     string    `json:"action" db:"action"`
+	TargetType string    `json:"target_type" db:"target_type"`
+	TargetID   int64     `json:"target_id" db:"target_id"`
+	Reason     string    `json:"reason" db:"reason"`
+	CreatedAt  time.Time `json:"-" db:"created_at"`
+}
+
+type reqAdminUser struct {
+	CSRFToken string `json:"csrf_token"`
+	UserID    int64  `json:"user_id"`
+	Reason    string `json:"reason"`
+}
+
+type reqAdminItem struct {
+	CSRFToken string `json:"csrf_token"`
+	ItemID    int64  `json:"item_id"`
+	Reason    string `json:"reason"`
+}
+
+type resAdminUser struct {
+	ID          int64  `json:"id"`
+	AccountName string `json:"account_name"`
+	IsSuspended bool   `json:"is_suspended"`
+}
+
+type resAdminTransaction struct {
+	TransactionEvidence *TransactionEvidence `json:"transaction_evidence"`
+	Shipping            *Shipping            `json:"shipping,omitempty"`
+	Seller              *UserSimple          `json:"seller"`
+	Buyer               *UserSimple          `json:"buyer"`
+	CreatedAt           int64                `json:"created_at"`
+	UpdatedAt           int64                `json:"updated_at"`
+}
+
+type resAdminLog struct {
+	AdminLog
+	CreatedAt int64 `json:"created_at"`
+}
+
+type resAdminLogs struct {
+	HasNext bool          `json:"has_next"`
+	Logs    []resAdminLog `json:"logs"`
+}
+
+// getAdmin はログインしている管理者を返す。管理者でなければ403を返す
+func getAdmin(r *http.Request) (user User, errCode int, errMsg string) {
+	user, errCode, errMsg = getUser(r)
+	if errMsg != "" {
+		return user, errCode, errMsg
+	}
+	if !user.IsAdmin {
+		return user, http.StatusForbidden, "権限がありません"
+	}
+	return user, http.StatusOK, ""
+}
+
+// postAdminUserSuspend はユーザーを利用停止にする
+// 利用停止したユーザーのセッションはすべて無効になり、出品は新着やユーザーページに表示されなくなる
+func postAdminUserSuspend(w http.ResponseWriter, r *http.Request) {
+	changeUserSuspension(w, r, true)
+}
+
+// postAdminUserUnsuspend はユーザーの利用停止を解除する
+func postAdminUserUnsuspend(w http.ResponseWriter, r *http.Request) {
+	changeUserSuspension(w, r, false)
+}
+
+func changeUserSuspension(w http.ResponseWriter, r *http.Request, suspended bool) {
+	ru := reqAdminUser{}
+	err := json.NewDecoder(r.Body).Decode(&ru)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if ru.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	admin, errCode, errMsg := getAdmin(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	if ru.UserID == admin.ID {
+		outputErrorMsg(w, http.StatusBadRequest, "自分自身は変更できません")
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	target := User{}
+	err = tx.Get(&target, "SELECT * FROM `users` WHERE `id` = ? FOR UPDATE", ru.UserID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "user not found")
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	if target.IsSuspended == suspended {
+		outputErrorMsg(w, http.StatusBadRequest, "既に変更されています")
+		tx.Rollback()
+		return
+	}
+
+	action := AdminActionUnsuspendUser
+	if suspended {
+		action = AdminActionSuspendUser
+		// cookieのセッションも無効にするためにセッションのバージョンを上げる
+		target.SessionVersion++
+	}
+	target.IsSuspended = suspended
+
+	_, err = tx.Exec("UPDATE `users` SET `is_suspended` = ?, `session_version` = ? WHERE `id` = ?",
+		target.IsSuspended,
+		target.SessionVersion,
+		target.ID,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	// 一覧のクエリで users を引かなくて済むように、出品にも利用停止を写しておく
+	_, err = tx.Exec("UPDATE `items` SET `seller_suspended` = ? WHERE `seller_id` = ?",
+		target.IsSuspended,
+		target.ID,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	err = addAdminLog(tx, admin.ID, action, AdminTargetUser, target.ID, ru.Reason)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	tx.Commit()
+
+	if suspended {
+		err = store.RevokeUserSessions(target.ID)
+		if err != nil && err != errSessionStoreNotServerSide {
+			log.Print(err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(resAdminUser{
+		ID:          target.ID,
+		AccountName: target.AccountName,
+		IsSuspended: target.IsSuspended,
+	})
+}
+
+// postAdminItemStop は商品を運営の判断で停止する。運営が停止した商品は出品者が再開できない
+func postAdminItemStop(w http.ResponseWriter, r *http.Request) {
+	moderateItem(w, r, AdminActionStopItem)
+}
+
+// postAdminItemResume は運営が停止した商品を販売中に戻す
+func postAdminItemResume(w http.ResponseWriter, r *http.Request) {
+	moderateItem(w, r, AdminActionResumeItem)
+}
+
+func moderateItem(w http.ResponseWriter, r *http.Request, action string) {
+	ri := reqAdminItem{}
+	err := json.NewDecoder(r.Body).Decode(&ri)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if ri.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	admin, errCode, errMsg := getAdmin(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	targetItem := Item{}
+	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ? FOR UPDATE", ri.ItemID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "item not found")
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	takenDown, err := isItemTakenDown(tx, targetItem.ID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	// 出品者が停止した商品も運営が停止すれば出品者は再開できなくなる
+	status := ItemStatusStop
+	allowed := !takenDown && (targetItem.Status == ItemStatusOnSale || targetItem.Status == ItemStatusStop)
+	if action == AdminActionResumeItem {
+		status = ItemStatusOnSale
+		allowed = takenDown && targetItem.Status == ItemStatusStop
+	}
+	if !allowed {
+		outputErrorMsg(w, http.StatusForbidden, "この商品の状態は変更できません")
+		tx.Rollback()
+		return
+	}
+
+	buying, err := hasActiveBuyReservation(tx, targetItem.ID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+	if buying {
+		outputErrorMsg(w, http.StatusForbidden, "購入手続き中の商品は停止できません")
+		tx.Rollback()
+		return
+	}
+
+	now := time.Now()
+	_, err = tx.Exec("UPDATE `items` SET `status` = ?, `updated_at` = ? WHERE `id` = ?",
+		status,
+		now,
+		targetItem.ID,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	err = updateNumSellItems(tx, targetItem.SellerID, targetItem.Status, status)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	err = addAdminLog(tx, admin.ID, action, AdminTargetItem, targetItem.ID, ri.Reason)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	err = addAuditLogs(tx, admin.ID, action, auditItemStatus(targetItem.ID, targetItem.Status, status))
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	tx.Commit()
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(&resItemStatus{
+		ItemID:        targetItem.ID,
+		ItemStatus:    status,
+		ItemUpdatedAt: now.Unix(),
+	})
+}
+
+// getAdminTransaction は任意の取引を配送状況とあわせて返す
+func getAdminTransaction(w http.ResponseWriter, r *http.Request) {
+	transactionEvidenceIDStr := r.PathValue("transaction_evidence_id")
+	transactionEvidenceID, err := strconv.ParseInt(transactionEvidenceIDStr, 10, 64)
+	if err != nil || transactionEvidenceID <= 0 {
+		outputErrorMsg(w, http.StatusBadRequest, "incorrect transaction_evidence id")
+		return
+	}
+
+	_, errCode, errMsg := getAdmin(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	transactionEvidence := TransactionEvidence{}
+	err = dbx.Get(&transactionEvidence, "SELECT * FROM `transaction_evidences` WHERE `id` = ?", transactionEvidenceID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "transaction_evidences not found")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	seller, err := getUserSimpleByID(dbx, transactionEvidence.SellerID)
+	if err != nil {
+		outputErrorMsg(w, http.StatusNotFound, "seller not found")
+		return
+	}
+	buyer, err := getUserSimpleByID(dbx, transactionEvidence.BuyerID)
+	if err != nil {
+		outputErrorMsg(w, http.StatusNotFound, "buyer not found")
+		return
+	}
+
+	res := resAdminTransaction{
+		TransactionEvidence: &transactionEvidence,
+		Seller:              &seller,
+		Buyer:               &buyer,
+		CreatedAt:           transactionEvidence.CreatedAt.Unix(),
+		UpdatedAt:           transactionEvidence.UpdatedAt.Unix(),
+	}
+
+	shipping := Shipping{}
+	err = dbx.Get(&shipping, "SELECT * FROM `shippings` WHERE `transaction_evidence_id` = ?", transactionEvidence.ID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if err == nil {
+		res.Shipping = &shipping
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+// getAdminLogs は運営の操作の記録を新しい順に返す
+// target_type と target_id で絞り込み、before_id で続きを取得する
+func getAdminLogs(w http.ResponseWriter, r *http.Request) {
+	_, errCode, errMsg := getAdmin(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	query := r.URL.Query()
+	conds := "1 = 1"
+	args := []any{}
+
+	if targetType := query.Get("target_type"); targetType != "" {
+		conds += " AND `target_type` = ?"
+		args = append(args, targetType)
+	}
+	if targetIDStr := query.Get("target_id"); targetIDStr != "" {
+		targetID, err := strconv.ParseInt(targetIDStr, 10, 64)
+		if err != nil || targetID <= 0 {
+			outputErrorMsg(w, http.StatusBadRequest, "target_id param error")
+			return
+		}
+		conds += " AND `target_id` = ?"
+		args = append(args, targetID)
+	}
+	if beforeIDStr := query.Get("before_id"); beforeIDStr != "" {
+		beforeID, err := strconv.ParseInt(beforeIDStr, 10, 64)
+		if err != nil || beforeID <= 0 {
+			outputErrorMsg(w, http.StatusBadRequest, "before_id param error")
+			return
+		}
+		conds += " AND `id` < ?"
+		args = append(args, beforeID)
+	}
+	args = append(args, AdminLogsPerPage+1)
+
+	logs := []AdminLog{}
+	err := dbx.Select(&logs, "SELECT * FROM `admin_logs` WHERE "+conds+" ORDER BY `id` DESC LIMIT ?", args...)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	res := resAdminLogs{Logs: []resAdminLog{}}
+	if len(logs) > AdminLogsPerPage {
+		res.HasNext = true
+		logs = logs[:AdminLogsPerPage]
+	}
+	for _, l := range logs {
+		res.Logs = append(res.Logs, resAdminLog{AdminLog: l, CreatedAt: l.CreatedAt.Unix()})
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func addAdminLog(tx *sqlx.Tx, adminID int64, action, targetType string, targetID int64, reason string) error {
+	_, err := tx.Exec("INSERT INTO `admin_logs` (`admin_id`, `action`, `target_type`, `target_id`, `reason`) VALUES (?, ?, ?, ?, ?)",
+		adminID,
+		action,
+		targetType,
+		targetID,
+		reason,
+	)
+	return err
+}
+
+// isItemTakenDown は商品が運営によって停止されたままかを返す
+func isItemTakenDown(tx *sqlx.Tx, itemID int64) (bool, error) {
+	action := ""
+	err := tx.Get(&action, "SELECT `action` FROM `admin_logs` WHERE `target_type` = ? AND `target_id` = ? AND `action` IN (?, ?) ORDER BY `id` DESC LIMIT 1",
+		AdminTargetItem,
+		itemID,
+		AdminActionStopItem,
+		AdminActionResumeItem,
+	)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return action == AdminActionStopItem, nil
+}
@@ -6,14 +6,23 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 )
 
 const (
 	IsucariAPIToken = "Bearer 75ugk2m37a750fwir5xr-22l6h4wmue1bwrubzwd0"
 
 	userAgent = "isucon9-qualify-webapp"
+
+	// APIRequestTimeout は外部サービスへのリクエストのタイムアウト
+	// 外部サービスが応答しなくてもリクエストやバックグラウンドの処理がいつまでも止まらないようにする
+	APIRequestTimeout = 10 * time.Second
 )
 
+var apiClient = &http.Client{
+	Timeout: APIRequestTimeout,
+}
+
 type APIPaymentServiceTokenReq struct {
 	ShopID string `json:"shop_id"`
 	Token  string `json:"token"`
@@ -61,7 +70,7 @@ func APIPaymentToken(paymentURL string, param *APIPaymentServiceTokenReq) (*APIP
 	req.Header.Set("User-Agent", userAgent)
 	req.Header.Set("Content-Type", "application/json")
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := apiClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -96,7 +105,7 @@ func APIShipmentCreate(shipmentURL string, param *APIShipmentCreateReq) (*APIShi
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", IsucariAPIToken)
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := apiClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -131,7 +140,7 @@ func APIShipmentRequest(shipmentURL string, param *APIShipmentRequestReq) ([]byt
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", IsucariAPIToken)
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := apiClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -160,7 +169,7 @@ func APIShipmentStatus(shipmentURL string, param *APIShipmentStatusReq) (*APIShi
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", IsucariAPIToken)
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := apiClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	AuditEntityItem                = "item"
+	AuditEntityTransactionEvidence = "transaction_evidence"
+	AuditEntityShipping            = "shipping"
+
+	AuditFieldStatus    = "status"
+	AuditFieldPrice     = "price"
+	AuditFieldCreatedAt = "created_at"
+
+	AuditActionBuy        = "buy"
+	AuditActionShip       = "ship"
+	AuditActionShipDone   = "ship_done"
+	AuditActionComplete   = "complete"
+	AuditActionItemEdit   = "item_edit"
+	AuditActionBump       = "bump"
+	AuditActionItemStatus = "item_status"
+)
+
+// AuditLog は状態の変更の記録。1行に1つの値の変更を記録し、更新も削除もしない
+// 新しく作られた行の old_value は空になる
+type AuditLog struct {
+	ID         int64     `json:"id" db:"id"`
+	ActorID    int64     `json:"actor_id" db:"actor_id"`
+	Action     string    `json:"action" db:"action"`
+	EntityType string    `json:"entity_type" db:"entity_type"`
+	EntityID   int64     `json:"entity_id" db:"entity_id"`
+	Field      string    `json:"field" db:"field"`
+	OldValue   string    `json:"old_value" db:"old_value"`
+	NewValue   string    `json:"new_value" db:"new_value"`
+	CreatedAt  time.Time `json:"-" db:"created_at"`
+}
+
+type resAuditLog struct {
+	AuditLog
+	CreatedAt int64 `json:"created_at"`
+}
+
+// addAuditLogs は変更と同じトランザクションで記録を追加する
+func addAuditLogs(tx *sqlx.Tx, actorID int64, action string, logs ...AuditLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	placeholders := make([]string, 0, len(logs))
+	args := make([]any, 0, len(logs)*8)
+	for _, l := range logs {
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, actorID, action, l.EntityType, l.EntityID, l.Field, l.OldValue, l.NewValue, now)
+	}
+
+	_, err := tx.Exec("INSERT INTO `audit_logs` (`actor_id`, `action`, `entity_type`, `entity_id`, `field`, `old_value`, `new_value`, `created_at`) VALUES "+strings.Join(placeholders, ", "), args...)
+	return err
+}
+
+func auditItemStatus(itemID int64, oldStatus, newStatus string) AuditLog {
+	return AuditLog{EntityType: AuditEntityItem, EntityID: itemID, Field: AuditFieldStatus, OldValue: oldStatus, NewValue: newStatus}
+}
+
+func auditTransactionEvidenceStatus(transactionEvidenceID int64, oldStatus, newStatus string) AuditLog {
+	return AuditLog{EntityType: AuditEntityTransactionEvidence, EntityID: transactionEvidenceID, Field: AuditFieldStatus, OldValue: oldStatus, NewValue: newStatus}
+}
+
+func auditShippingStatus(transactionEvidenceID int64, oldStatus, newStatus string) AuditLog {
+	return AuditLog{EntityType: AuditEntityShipping, EntityID: transactionEvidenceID, Field: AuditFieldStatus, OldValue: oldStatus, NewValue: newStatus}
+}
+
+// getAuditLogs は entity_type と entity_id で指定したものの変更の記録を古い順に返す
+// 見られるのは出品者と購入者と管理者だけ。shipping の entity_id は transaction_evidence_id
+func getAuditLogs(w http.ResponseWriter, r *http.Request) {
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	query := r.URL.Query()
+	entityType := query.Get("entity_type")
+	entityID, err := strconv.ParseInt(query.Get("entity_id"), 10, 64)
+	if err != nil || entityID <= 0 {
+		outputErrorMsg(w, http.StatusBadRequest, "entity_id param error")
+		return
+	}
+
+	var sellerID, buyerID int64
+	switch entityType {
+	case AuditEntityItem:
+		item := Item{}
+		err = dbx.Get(&item, "SELECT * FROM `items` WHERE `id` = ?", entityID)
+		sellerID, buyerID = item.SellerID, item.BuyerID
+	case AuditEntityTransactionEvidence, AuditEntityShipping:
+		transactionEvidence := TransactionEvidence{}
+		err = dbx.Get(&transactionEvidence, "SELECT * FROM `transaction_evidences` WHERE `id` = ?", entityID)
+		sellerID, buyerID = transactionEvidence.SellerID, transactionEvidence.BuyerID
+	default:
+		outputErrorMsg(w, http.StatusBadRequest, "entity_type param error")
+		return
+	}
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "entity not found")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if user.ID != sellerID && user.ID != buyerID && !user.IsAdmin {
+		outputErrorMsg(w, http.StatusForbidden, "権限がありません")
+		return
+	}
+
+	logs := []AuditLog{}
+	err = dbx.Select(&logs, "SELECT * FROM `audit_logs` WHERE `entity_type` = ? AND `entity_id` = ? ORDER BY `id` ASC", entityType, entityID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	res := make([]resAuditLog, 0, len(logs))
+	for _, l := range logs {
+		res = append(res, resAuditLog{AuditLog: l, CreatedAt: l.CreatedAt.Unix()})
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BulkSellMaxItems     = 200
+	BulkSellMaxImageSize = 10 << 20
+	BulkSellMaxMemory    = 32 << 20
+)
+
+// bulkSellRow はマニフェストの1行。CSVはヘッダー行の列名、JSONLはキーで対応づける
+type bulkSellRow struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Price       int    `json:"price"`
+	CategoryID  int    `json:"category_id"`
+	Image       string `json:"image"`
+}
+
+type resSellBulkError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+type resSellBulk struct {
+	IDs    []int64            `json:"ids,omitempty"`
+	Error  string             `json:"error,omitempty"`
+	Errors []resSellBulkError `json:"errors,omitempty"`
+}
+
+// postSellBulk はマニフェスト(CSVかJSONL)と画像のzipアーカイブからまとめて出品する
+// すべての行を postSell と同じ規則で確認し、1行でも誤りがあれば何も出品せずに行ごとのエラーを返す
+func postSellBulk(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseMultipartForm(BulkSellMaxMemory)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusBadRequest, "multipart form error")
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	mf, mheader, err := r.FormFile("manifest")
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusBadRequest, "manifest error")
+		return
+	}
+	defer mf.Close()
+
+	rows, rowErrs, err := parseBulkSellManifest(mf, filepath.Ext(mheader.Filename))
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if len(rows) == 0 {
+		outputErrorMsg(w, http.StatusBadRequest, "manifest is empty")
+		return
+	}
+	if len(rows) > BulkSellMaxItems {
+		outputErrorMsg(w, http.StatusBadRequest, fmt.Sprintf("一度に出品できるのは%d件までです", BulkSellMaxItems))
+		return
+	}
+
+	af, aheader, err := r.FormFile("images")
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusBadRequest, "image error")
+		return
+	}
+	defer af.Close()
+
+	archive, err := zip.NewReader(af, aheader.Size)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusBadRequest, "image archive error")
+		return
+	}
+
+	images := make(map[string]*zip.File, len(archive.File))
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		images[path.Clean(f.Name)] = f
+	}
+
+	parseFailed := make(map[int]bool, len(rowErrs))
+	for _, re := range rowErrs {
+		parseFailed[re.Row] = true
+	}
+
+	categories := make([]Category, len(rows))
+	exts := make([]string, len(rows))
+	for i, row := range rows {
+		if parseFailed[i+1] {
+			continue
+		}
+
+		categories[i], errMsg = validateSellItem(dbx, row.Name, row.Description, row.Price, row.CategoryID)
+		if errMsg != "" {
+			rowErrs = append(rowErrs, resSellBulkError{Row: i + 1, Error: errMsg})
+			continue
+		}
+
+		f, ok := images[path.Clean(row.Image)]
+		if !ok {
+			rowErrs = append(rowErrs, resSellBulkError{Row: i + 1, Error: "image not found"})
+			continue
+		}
+		if f.UncompressedSize64 > BulkSellMaxImageSize {
+			rowErrs = append(rowErrs, resSellBulkError{Row: i + 1, Error: "image is too large"})
+			continue
+		}
+
+		exts[i], ok = imageExt(row.Image)
+		if !ok {
+			rowErrs = append(rowErrs, resSellBulkError{Row: i + 1, Error: "unsupported image format error"})
+			continue
+		}
+	}
+
+	if len(rowErrs) > 0 {
+		sort.Slice(rowErrs, func(i, j int) bool { return rowErrs[i].Row < rowErrs[j].Row })
+
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(resSellBulk{
+			Error:  "出品内容に誤りがあります",
+			Errors: rowErrs,
+		})
+		return
+	}
+
+	// 同じ画像を指す行があっても1回だけ保存する
+	imgNames := make(map[string]string, len(rows))
+	for i, row := range rows {
+		key := path.Clean(row.Image)
+		if _, ok := imgNames[key]; ok {
+			continue
+		}
+
+		img, err := readZipFile(images[key])
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusBadRequest, "image error")
+			return
+		}
+
+		imgNames[key], err = imageStorage.Save(img, exts[i])
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "Saving image failed")
+			return
+		}
+	}
+
+	tx := dbx.MustBegin()
+
+	seller := User{}
+	err = tx.Get(&seller, "SELECT * FROM `users` WHERE `id` = ? FOR UPDATE", user.ID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	itemIDs := make([]int64, 0, len(rows))
+	for i, row := range rows {
+		result, err := tx.Exec("INSERT INTO `items` (`seller_id`, `status`, `name`, `price`, `description`,`image_name`,`category_id`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			seller.ID,
+			ItemStatusOnSale,
+			row.Name,
+			row.Price,
+			row.Description,
+			imgNames[path.Clean(row.Image)],
+			categories[i].ID,
+		)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			tx.Rollback()
+			return
+		}
+
+		itemID, err := result.LastInsertId()
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			tx.Rollback()
+			return
+		}
+		itemIDs = append(itemIDs, itemID)
+	}
+
+	_, err = tx.Exec("UPDATE `users` SET `num_sell_items`=?, `last_bump`=? WHERE `id`=?",
+		seller.NumSellItems+len(itemIDs),
+		time.Now(),
+		seller.ID,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	tx.Commit()
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(resSellBulk{IDs: itemIDs})
+}
+
+// parseBulkSellManifest はマニフェストを読む。読めない行は空の行にして行ごとのエラーを返す
+// 行番号はヘッダーを除いたデータ行の1始まりの通し番号
+func parseBulkSellManifest(r io.Reader, ext string) ([]bulkSellRow, []resSellBulkError, error) {
+	switch strings.ToLower(ext) {
+	case ".csv":
+		return parseBulkSellCSV(r)
+	case ".jsonl", ".ndjson":
+		return parseBulkSellJSONL(r)
+	default:
+		return nil, nil, fmt.Errorf("unsupported manifest format error")
+	}
+}
+
+func parseBulkSellCSV(r io.Reader) ([]bulkSellRow, []resSellBulkError, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("manifest header error")
+	}
+	columns := make(map[string]int, len(header))
+	for i, h := range header {
+		columns[strings.TrimSpace(h)] = i
+	}
+	for _, c := range []string{"name", "description", "price", "category_id", "image"} {
+		if _, ok := columns[c]; !ok {
+			return nil, nil, fmt.Errorf("manifest header error: %s is required", c)
+		}
+	}
+
+	rows := []bulkSellRow{}
+	rowErrs := []resSellBulkError{}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*csv.ParseError); err != nil && !ok {
+			return nil, nil, fmt.Errorf("manifest read error")
+		}
+		rows = append(rows, bulkSellRow{})
+		n := len(rows)
+		if err != nil {
+			rowErrs = append(rowErrs, resSellBulkError{Row: n, Error: "csv parse error"})
+			continue
+		}
+		get := func(c string) string {
+			i := columns[c]
+			if i >= len(record) {
+				return ""
+			}
+			return record[i]
+		}
+
+		price, err := strconv.Atoi(get("price"))
+		if err != nil {
+			rowErrs = append(rowErrs, resSellBulkError{Row: n, Error: "price error"})
+			continue
+		}
+		categoryID, err := strconv.Atoi(get("category_id"))
+		if err != nil || categoryID < 0 {
+			rowErrs = append(rowErrs, resSellBulkError{Row: n, Error: "category id error"})
+			continue
+		}
+
+		rows[n-1] = bulkSellRow{
+			Name:        get("name"),
+			Description: get("description"),
+			Price:       price,
+			CategoryID:  categoryID,
+			Image:       get("image"),
+		}
+	}
+
+	return rows, rowErrs, nil
+}
+
+func parseBulkSellJSONL(r io.Reader) ([]bulkSellRow, []resSellBulkError, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+
+	rows := []bulkSellRow{}
+	rowErrs := []resSellBulkError{}
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		rows = append(rows, bulkSellRow{})
+		n := len(rows)
+
+		row := bulkSellRow{}
+		err := json.Unmarshal(line, &row)
+		if err != nil {
+			rowErrs = append(rowErrs, resSellBulkError{Row: n, Error: "json decode error"})
+			continue
+		}
+		if row.CategoryID < 0 {
+			rowErrs = append(rowErrs, resSellBulkError{Row: n, Error: "category id error"})
+			continue
+		}
+		rows[n-1] = row
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, fmt.Errorf("manifest read error")
+	}
+
+	return rows, rowErrs, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(io.LimitReader(rc, BulkSellMaxImageSize))
+}
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	BuyReservationStatusPending         = "pending"
+	BuyReservationStatusShipmentCreated = "shipment_created"
+	BuyReservationStatusPaid            = "paid"
+	BuyReservationStatusFinalized       = "finalized"
+	BuyReservationStatusFailed          = "failed"
+	// 決済されたかもしれないのに取引を作れなかった手続き。運営が返金したら refunded にする
+	BuyReservationStatusRefundRequired = "refund_required"
+	BuyReservationStatusRefunded       = "refunded"
+
+	// BuyReservationLease は購入手続きを進めている処理が持つ期限。
+	// 期限が切れた手続きはワーカーが引き取る
+	// 外部サービスを呼ぶ前に延長するので、1回の呼び出しの APIRequestTimeout より十分長くしておく
+	BuyReservationLease = time.Minute
+
+	DefaultBuyWorkerInterval = 5 * time.Second
+	BuyWorkerBatchSize       = 100
+
+	BuyInterruptedErrMsg = "購入手続きが中断されました"
+	BuyUnconfirmedErrMsg = "決済できたか確認できませんでした"
+
+	BuyRefundsPerPage = 50
+)
+
+// BuyReservation は購入手続きの状態。外部サービスの呼び出しはこの行を進めながら
+// ロックを持たずに行い、商品を取引中にするのは決済が終わってからにする
+//
+//	pending → shipment_created → paid → finalized
+//
+// どこで失敗しても failed になり、商品は販売中のまま残る
+// 決済されたかもしれないのに取引を作れなかったときは refund_required にして運営が返金する
+type BuyReservation struct {
+	ID                    int64     `json:"id" db:"id"`
+	ItemID                int64     `json:"item_id" db:"item_id"`
+	BuyerID               int64     `json:"buyer_id" db:"buyer_id"`
+	SellerID              int64     `json:"seller_id" db:"seller_id"`
+	OfferID               int64     `json:"offer_id" db:"offer_id"`
+	Price                 int       `json:"price" db:"price"`
+	Token                 string    `json:"-" db:"token"`
+	ToAddress             string    `json:"to_address" db:"to_address"`
+	ToName                string    `json:"to_name" db:"to_name"`
+	FromAddress           string    `json:"from_address" db:"from_address"`
+	FromName              string    `json:"from_name" db:"from_name"`
+	ReserveID             string    `json:"reserve_id" db:"reserve_id"`
+	ReserveTime           int64     `json:"reserve_time" db:"reserve_time"`
+	TransactionEvidenceID int64     `json:"transaction_evidence_id" db:"transaction_evidence_id"`
+	Status                string    `json:"status" db:"status"`
+	Error                 string    `json:"error" db:"error"`
+	LeaseUntil            time.Time `json:"-" db:"lease_until"`
+	CreatedAt             time.Time `json:"-" db:"created_at"`
+	UpdatedAt             time.Time `json:"-" db:"updated_at"`
+}
+
+type reqAdminRefund struct {
+	CSRFToken     string `json:"csrf_token"`
+	ReservationID int64  `json:"reservation_id"`
+	Reason        string `json:"reason"`
+}
+
+type resAdminRefund struct {
+	BuyReservation
+	CreatedAt int64 `json:"created_at"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+type resAdminRefunds struct {
+	HasNext bool             `json:"has_next"`
+	Refunds []resAdminRefund `json:"refunds"`
+}
+
+// errBuyReservationTaken は手続きが他の処理に引き取られて状態が変わっていたことを表す
+var errBuyReservationTaken = fmt.Errorf("buy reservation was taken over")
+
+// errBuyItemNotOnSale は決済が済んだのに商品が販売中でなくなっていたことを表す
+var errBuyItemNotOnSale = fmt.Errorf("item is not on sale")
+
+// hasActiveBuyReservation は商品の購入手続きが進行中かを返す。
+// 進行中の商品は他の購入者には売れたものとして扱い、出品者も変更できない
+func hasActiveBuyReservation(q sqlx.Queryer, itemID int64) (bool, error) {
+	count := 0
+	err := sqlx.Get(q, &count, "SELECT COUNT(*) FROM `buy_reservations` WHERE `item_id` = ? AND `status` IN (?, ?, ?)",
+		itemID,
+		BuyReservationStatusPending,
+		BuyReservationStatusShipmentCreated,
+		BuyReservationStatusPaid,
+	)
+	return count > 0, err
+}
+
+// processBuyReservation は購入手続きを外部サービスの呼び出しから最後まで進める
+// 失敗したらその手続きを failed にし、postBuy が返すステータスコードとメッセージを返す
+// resumed はワーカーが止まった手続きを引き取って進め直しているかどうか
+func processBuyReservation(reservation BuyReservation, resumed bool) (transactionEvidenceID int64, errCode int, errMsg string) {
+	if reservation.Status == BuyReservationStatusPending {
+		err := renewBuyReservationLease(reservation)
+		if err != nil {
+			log.Print(err)
+			return 0, http.StatusInternalServerError, BuyInterruptedErrMsg
+		}
+
+		// 販売中でなくなった商品の配送を予約しないように確かめておく
+		err = checkBuyItemOnSale(reservation.ItemID)
+		if err == errBuyItemNotOnSale {
+			return failBuyReservation(reservation, http.StatusForbidden, "item is not for sale")
+		}
+		if err != nil {
+			log.Print(err)
+			return 0, http.StatusInternalServerError, "db error"
+		}
+
+		scr, err := APIShipmentCreate(getShipmentServiceURL(), &APIShipmentCreateReq{
+			ToAddress:   reservation.ToAddress,
+			ToName:      reservation.ToName,
+			FromAddress: reservation.FromAddress,
+			FromName:    reservation.FromName,
+		})
+		if err != nil {
+			log.Print(err)
+			return failBuyReservation(reservation, http.StatusInternalServerError, "failed to request to shipment service")
+		}
+
+		// 予約番号を先に残しておき、決済に失敗したときに取り消せなかった予約をたどれるようにする
+		err = updateBuyReservation(reservation, BuyReservationStatusShipmentCreated, "`reserve_id` = ?, `reserve_time` = ?", scr.ReserveID, scr.ReserveTime)
+		if err != nil {
+			log.Print(err)
+			return 0, http.StatusInternalServerError, "db error"
+		}
+		reservation.Status = BuyReservationStatusShipmentCreated
+		reservation.ReserveID = scr.ReserveID
+		reservation.ReserveTime = scr.ReserveTime
+	}
+
+	if reservation.Status == BuyReservationStatusShipmentCreated {
+		// 決済している間にワーカーに引き取られないように期限を延ばす
+		// 引き取られていたら決済せずに打ち切る
+		err := renewBuyReservationLease(reservation)
+		if err != nil {
+			log.Print(err)
+			return 0, http.StatusInternalServerError, BuyInterruptedErrMsg
+		}
+
+		// 決済してから販売中でないとわかると返金が必要になるので、決済する前にも確かめる
+		err = checkBuyItemOnSale(reservation.ItemID)
+		if err == errBuyItemNotOnSale {
+			return failBuyReservation(reservation, http.StatusForbidden, "item is not for sale")
+		}
+		if err != nil {
+			log.Print(err)
+			return 0, http.StatusInternalServerError, "db error"
+		}
+
+		pstr, err := APIPaymentToken(getPaymentServiceURL(), &APIPaymentServiceTokenReq{
+			ShopID: PaymentServiceIsucariShopID,
+			Token:  reservation.Token,
+			APIKey: PaymentServiceIsucariAPIKey,
+			Price:  reservation.Price,
+		})
+		if err != nil {
+			log.Print(err)
+		}
+		status, errCode, errMsg := buyPaymentOutcome(pstr, err, resumed)
+		switch status {
+		case "":
+			// 期限が切れたらワーカーがもう一度問い合わせる
+			return 0, errCode, errMsg
+		case BuyReservationStatusFailed:
+			return failBuyReservation(reservation, errCode, errMsg)
+		case BuyReservationStatusRefundRequired:
+			return requireBuyRefund(reservation, errCode, errMsg)
+		}
+
+		err = updateBuyReservation(reservation, BuyReservationStatusPaid, "`token` = ''")
+		if err != nil {
+			// 決済は済んでいるので、引き取られていなければワーカーが確定させる
+			log.Print(err)
+			return 0, http.StatusInternalServerError, "db error"
+		}
+		reservation.Status = BuyReservationStatusPaid
+	}
+
+	transactionEvidenceID, err := finalizeBuyReservation(reservation.ID)
+	if err == errBuyItemNotOnSale {
+		return 0, http.StatusForbidden, "item is not for sale"
+	}
+	if err != nil {
+		log.Print(err)
+		return 0, http.StatusInternalServerError, "db error"
+	}
+
+	return transactionEvidenceID, 0, ""
+}
+
+// buyPaymentOutcome は決済サービスの結果から手続きを次にどの状態にするかを決める
+// status が空なら手続きはそのままにして、ワーカーが引き取ったときにもう一度問い合わせる
+//
+// 決済済みのトークンで問い合わせ直すと invalid になるので、ワーカーが問い合わせ直して invalid なら
+// 中断される前に決済できていたかもしれない。取引は作らずに返金が必要な手続きとして残す
+func buyPaymentOutcome(pstr *APIPaymentServiceTokenRes, err error, resumed bool) (status string, errCode int, errMsg string) {
+	if err != nil {
+		if resumed {
+			return "", http.StatusInternalServerError, "payment service is failed"
+		}
+		return BuyReservationStatusFailed, http.StatusInternalServerError, "payment service is failed"
+	}
+
+	switch pstr.Status {
+	case "ok":
+		return BuyReservationStatusPaid, 0, ""
+	case "invalid":
+		if resumed {
+			return BuyReservationStatusRefundRequired, http.StatusInternalServerError, BuyUnconfirmedErrMsg
+		}
+		return BuyReservationStatusFailed, http.StatusBadRequest, "カード情報に誤りがあります"
+	case "fail":
+		return BuyReservationStatusFailed, http.StatusBadRequest, "カードの残高が足りません"
+	default:
+		return BuyReservationStatusFailed, http.StatusBadRequest, "想定外のエラー"
+	}
+}
+
+// checkBuyItemOnSale は商品が販売中のままかを確かめる
+// 商品の行ロックを取って、状態を変えている途中の処理があればコミットされるのを待つ
+func checkBuyItemOnSale(itemID int64) error {
+	tx := dbx.MustBegin()
+	defer tx.Rollback()
+
+	status := ""
+	err := tx.Get(&status, "SELECT `status` FROM `items` WHERE `id` = ? FOR UPDATE", itemID)
+	if err != nil {
+		return err
+	}
+	if status != ItemStatusOnSale {
+		return errBuyItemNotOnSale
+	}
+	return nil
+}
+
+// updateBuyReservation は手続きが reservation.Status のままであれば status に進める
+func updateBuyReservation(reservation BuyReservation, status, sets string, args ...any) error {
+	if sets != "" {
+		sets += ", "
+	}
+	args = append([]any{status}, args...)
+	args = append(args, time.Now(), reservation.ID, reservation.Status)
+
+	result, err := dbx.Exec("UPDATE `buy_reservations` SET `status` = ?, "+sets+"`updated_at` = ? WHERE `id` = ? AND `status` = ?", args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errBuyReservationTaken
+	}
+	return nil
+}
+
+// renewBuyReservationLease は手続きが reservation.Status のままで期限が切れていなければ期限を延ばす
+func renewBuyReservationLease(reservation BuyReservation) error {
+	now := time.Now()
+	result, err := dbx.Exec("UPDATE `buy_reservations` SET `lease_until` = ? WHERE `id` = ? AND `status` = ? AND `lease_until` >= ?",
+		now.Add(BuyReservationLease),
+		reservation.ID,
+		reservation.Status,
+		now,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errBuyReservationTaken
+	}
+	return nil
+}
+
+// failBuyReservation は手続きを打ち切る。商品は販売中のまま他の購入者が買えるようになる
+// shipment service には予約を取り消すAPIがないため、作った予約は reserve_id として残す
+func failBuyReservation(reservation BuyReservation, errCode int, errMsg string) (int64, int, string) {
+	err := updateBuyReservation(reservation, BuyReservationStatusFailed, "`token` = '', `error` = ?", errMsg)
+	if err != nil {
+		log.Print(err)
+	}
+	return 0, errCode, errMsg
+}
+
+// requireBuyRefund は決済されたかもしれない手続きを返金が必要な手続きとして打ち切る
+// 取引は作らず、商品は販売中のまま残る。運営は GET /admin/refunds.json で確認して返金する
+func requireBuyRefund(reservation BuyReservation, errCode int, errMsg string) (int64, int, string) {
+	err := updateBuyReservation(reservation, BuyReservationStatusRefundRequired, "`token` = '', `error` = ?", errMsg)
+	if err != nil {
+		log.Print(err)
+	}
+	log.Printf("buy reservation %d (reserve_id: %s) requires refund: %s", reservation.ID, reservation.ReserveID, errMsg)
+	return 0, errCode, errMsg
+}
+
+// finalizeBuyReservation は決済の済んだ手続きから取引と配送を作り、商品を取引中にする
+// 確定済みの手続きなら作った取引の id をそのまま返す
+func finalizeBuyReservation(reservationID int64) (int64, error) {
+	reservation := BuyReservation{}
+	err := dbx.Get(&reservation, "SELECT * FROM `buy_reservations` WHERE `id` = ?", reservationID)
+	if err != nil {
+		return 0, err
+	}
+
+	tx := dbx.MustBegin()
+
+	targetItem := Item{}
+	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ? FOR UPDATE", reservation.ItemID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Get(&reservation, "SELECT * FROM `buy_reservations` WHERE `id` = ? FOR UPDATE", reservationID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if reservation.Status == BuyReservationStatusFinalized {
+		tx.Rollback()
+		return reservation.TransactionEvidenceID, nil
+	}
+	if reservation.Status != BuyReservationStatusPaid {
+		tx.Rollback()
+		return 0, errBuyReservationTaken
+	}
+
+	// 手続き中の商品は売れたものとして扱っているが、決済の前に確かめたあとで販売中でなくなっていることがある
+	// 決済は済んでいるので、運営が返金できるように返金が必要な手続きとして残す
+	if targetItem.Status != ItemStatusOnSale {
+		_, err = tx.Exec("UPDATE `buy_reservations` SET `status` = ?, `error` = ?, `updated_at` = ? WHERE `id` = ?",
+			BuyReservationStatusRefundRequired,
+			"item is not for sale",
+			time.Now(),
+			reservation.ID,
+		)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		tx.Commit()
+
+		log.Printf("buy reservation %d (reserve_id: %s) requires refund: paid but item %d is %s", reservation.ID, reservation.ReserveID, targetItem.ID, targetItem.Status)
+		return 0, errBuyItemNotOnSale
+	}
+
+	category, err := getCategoryByID(tx, targetItem.CategoryID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	result, err := tx.Exec("INSERT INTO `transaction_evidences` (`seller_id`, `buyer_id`, `status`, `item_id`, `item_name`, `item_price`, `item_description`,`item_category_id`,`item_root_category_id`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		targetItem.SellerID,
+		reservation.BuyerID,
+		TransactionEvidenceStatusWaitShipping,
+		targetItem.ID,
+		targetItem.Name,
+		reservation.Price,
+		targetItem.Description,
+		category.ID,
+		category.ParentID,
+	)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	transactionEvidenceID, err := result.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	now := time.Now()
+	_, err = tx.Exec("UPDATE `items` SET `buyer_id` = ?, `status` = ?, `updated_at` = ? WHERE `id` = ?",
+		reservation.BuyerID,
+		ItemStatusTrading,
+		now,
+		targetItem.ID,
+	)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if reservation.OfferID != 0 {
+		_, err = tx.Exec("UPDATE `offers` SET `status` = ?, `updated_at` = ? WHERE `id` = ?",
+			OfferStatusPurchased,
+			now,
+			reservation.OfferID,
+		)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO `shippings` (`transaction_evidence_id`, `status`, `item_name`, `item_id`, `reserve_id`, `reserve_time`, `to_address`, `to_name`, `from_address`, `from_name`, `img_binary`) VALUES (?,?,?,?,?,?,?,?,?,?,?)",
+		transactionEvidenceID,
+		ShippingsStatusInitial,
+		targetItem.Name,
+		targetItem.ID,
+		reservation.ReserveID,
+		reservation.ReserveTime,
+		reservation.ToAddress,
+		reservation.ToName,
+		reservation.FromAddress,
+		reservation.FromName,
+		"",
+	)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = addAuditLogs(tx, reservation.BuyerID, AuditActionBuy,
+		auditItemStatus(targetItem.ID, targetItem.Status, ItemStatusTrading),
+		auditTransactionEvidenceStatus(transactionEvidenceID, "", TransactionEvidenceStatusWaitShipping),
+		AuditLog{
+			EntityType: AuditEntityTransactionEvidence,
+			EntityID:   transactionEvidenceID,
+			Field:      AuditFieldPrice,
+			NewValue:   strconv.Itoa(reservation.Price),
+		},
+		auditShippingStatus(transactionEvidenceID, "", ShippingsStatusInitial),
+	)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	_, err = tx.Exec("UPDATE `buy_reservations` SET `status` = ?, `transaction_evidence_id` = ?, `updated_at` = ? WHERE `id` = ?",
+		BuyReservationStatusFinalized,
+		transactionEvidenceID,
+		now,
+		reservation.ID,
+	)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	tx.Commit()
+
+	return transactionEvidenceID, nil
+}
+
+// startBuyWorker は期限の切れた購入手続きを引き取るワーカーを動かす
+// 決済まで済んだ手続きは確定させ、配送の予約まで済んだ手続きは決済サービスに同じトークンで問い合わせ直して進める
+// 配送の予約より前で止まった手続きは何も起きていないので打ち切る
+func startBuyWorker() error {
+	interval, err := envDuration("BUY_WORKER_INTERVAL", DefaultBuyWorkerInterval)
+	if err != nil {
+		return err
+	}
+	if interval > 0 {
+		go func() {
+			for now := range time.Tick(interval) {
+				runBuyWorker(now)
+			}
+		}()
+	}
+	return nil
+}
+
+func runBuyWorker(now time.Time) {
+	reservations := []BuyReservation{}
+	err := dbx.Select(&reservations, "SELECT * FROM `buy_reservations` WHERE `status` IN (?, ?, ?) AND `lease_until` < ? ORDER BY `id` ASC LIMIT ?",
+		BuyReservationStatusPending,
+		BuyReservationStatusShipmentCreated,
+		BuyReservationStatusPaid,
+		now,
+		BuyWorkerBatchSize,
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	for _, reservation := range reservations {
+		// 複数のプロセスで動いていても1つだけが引き取る
+		result, err := dbx.Exec("UPDATE `buy_reservations` SET `lease_until` = ? WHERE `id` = ? AND `status` = ? AND `lease_until` < ?",
+			now.Add(BuyReservationLease),
+			reservation.ID,
+			reservation.Status,
+			now,
+		)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			continue
+		}
+
+		switch reservation.Status {
+		case BuyReservationStatusPending:
+			failBuyReservation(reservation, http.StatusInternalServerError, BuyInterruptedErrMsg)
+		case BuyReservationStatusShipmentCreated:
+			// 決済の途中で止まったかもしれないので、打ち切らずに決済サービスに問い合わせ直す
+			// 決済済みのトークンは invalid になり、決済できたかどうかはわからないので返金が必要な手続きにする
+			_, _, errMsg := processBuyReservation(reservation, true)
+			if errMsg != "" {
+				log.Printf("buy reservation %d (reserve_id: %s) could not be confirmed: %s", reservation.ID, reservation.ReserveID, errMsg)
+			}
+		default:
+			_, err = finalizeBuyReservation(reservation.ID)
+			if err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+// getAdminRefunds は返金が必要な購入手続きを新しい順に返す
+// status に refunded を指定すると返金済みの手続きを返し、before_id で続きを取得する
+func getAdminRefunds(w http.ResponseWriter, r *http.Request) {
+	_, errCode, errMsg := getAdmin(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	query := r.URL.Query()
+	status := BuyReservationStatusRefundRequired
+	if s := query.Get("status"); s != "" {
+		if s != BuyReservationStatusRefundRequired && s != BuyReservationStatusRefunded {
+			outputErrorMsg(w, http.StatusBadRequest, "status param error")
+			return
+		}
+		status = s
+	}
+	conds := "`status` = ?"
+	args := []any{status}
+
+	if beforeIDStr := query.Get("before_id"); beforeIDStr != "" {
+		beforeID, err := strconv.ParseInt(beforeIDStr, 10, 64)
+		if err != nil || beforeID <= 0 {
+			outputErrorMsg(w, http.StatusBadRequest, "before_id param error")
+			return
+		}
+		conds += " AND `id` < ?"
+		args = append(args, beforeID)
+	}
+	args = append(args, BuyRefundsPerPage+1)
+
+	reservations := []BuyReservation{}
+	err := dbx.Select(&reservations, "SELECT * FROM `buy_reservations` WHERE "+conds+" ORDER BY `id` DESC LIMIT ?", args...)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	res := resAdminRefunds{Refunds: []resAdminRefund{}}
+	if len(reservations) > BuyRefundsPerPage {
+		res.HasNext = true
+		reservations = reservations[:BuyRefundsPerPage]
+	}
+	for _, reservation := range reservations {
+		res.Refunds = append(res.Refunds, resAdminRefund{
+			BuyReservation: reservation,
+			CreatedAt:      reservation.CreatedAt.Unix(),
+			UpdatedAt:      reservation.UpdatedAt.Unix(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+// postAdminRefundResolve は運営が返金し、使われなかった配送の予約を取り消した手続きを refunded にする
+func postAdminRefundResolve(w http.ResponseWriter, r *http.Request) {
+	rr := reqAdminRefund{}
+	err := json.NewDecoder(r.Body).Decode(&rr)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if rr.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	admin, errCode, errMsg := getAdmin(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	reservation := BuyReservation{}
+	err = tx.Get(&reservation, "SELECT * FROM `buy_reservations` WHERE `id` = ? FOR UPDATE", rr.ReservationID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "buy reservation not found")
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	if reservation.Status != BuyReservationStatusRefundRequired {
+		outputErrorMsg(w, http.StatusForbidden, "返金が必要な手続きではありません")
+		tx.Rollback()
+		return
+	}
+
+	now := time.Now()
+	_, err = tx.Exec("UPDATE `buy_reservations` SET `status` = ?, `updated_at` = ? WHERE `id` = ?",
+		BuyReservationStatusRefunded,
+		now,
+		reservation.ID,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	err = addAdminLog(tx, admin.ID, AdminActionRefund, AdminTargetBuyReservation, reservation.ID, rr.Reason)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	tx.Commit()
+
+	reservation.Status = BuyReservationStatusRefunded
+	reservation.UpdatedAt = now
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(resAdminRefund{
+		BuyReservation: reservation,
+		CreatedAt:      reservation.CreatedAt.Unix(),
+		UpdatedAt:      reservation.UpdatedAt.Unix(),
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestBuyPaymentOutcome(t *testing.T) {
+	errTimeout := errors.New("timeout")
+
+	tests := []struct {
+		name    string
+		pstr    *APIPaymentServiceTokenRes
+		err     error
+		resumed bool
+
+		status  string
+		errCode int
+	}{
+		{"ok", &APIPaymentServiceTokenRes{Status: "ok"}, nil, false, BuyReservationStatusPaid, 0},
+		{"ok after resume", &APIPaymentServiceTokenRes{Status: "ok"}, nil, true, BuyReservationStatusPaid, 0},
+		{"invalid card", &APIPaymentServiceTokenRes{Status: "invalid"}, nil, false, BuyReservationStatusFailed, http.StatusBadRequest},
+		// 決済済みのトークンで問い合わせ直したかもしれないので返金が必要
+		{"invalid after resume", &APIPaymentServiceTokenRes{Status: "invalid"}, nil, true, BuyReservationStatusRefundRequired, http.StatusInternalServerError},
+		{"fail", &APIPaymentServiceTokenRes{Status: "fail"}, nil, false, BuyReservationStatusFailed, http.StatusBadRequest},
+		{"fail after resume", &APIPaymentServiceTokenRes{Status: "fail"}, nil, true, BuyReservationStatusFailed, http.StatusBadRequest},
+		{"unknown", &APIPaymentServiceTokenRes{Status: "unknown"}, nil, false, BuyReservationStatusFailed, http.StatusBadRequest},
+		{"request error", nil, errTimeout, false, BuyReservationStatusFailed, http.StatusInternalServerError},
+		// ワーカーはそのままにして次に引き取ったときに問い合わせ直す
+		{"request error after resume", nil, errTimeout, true, "", http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, errCode, errMsg := buyPaymentOutcome(tt.pstr, tt.err, tt.resumed)
+			if status != tt.status {
+				t.Errorf("status = %q, want %q", status, tt.status)
+			}
+			if errCode != tt.errCode {
+				t.Errorf("errCode = %d, want %d", errCode, tt.errCode)
+			}
+			if (errMsg == "") != (tt.errCode == 0) {
+				t.Errorf("errMsg = %q with errCode %d", errMsg, tt.errCode)
+			}
+		})
+	}
+}
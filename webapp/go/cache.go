@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	DefaultCacheTTL = time.Minute
+)
+
+var (
+	categoryCache *Cache[int, Category]
+	configCache   *Cache[string, string]
+)
+
+// Cache はプロセス内のキャッシュ。ttl が0以下なら明示的に消すまで残す
+// 書き込み側はコミットしたあとに Invalidate を呼ぶ。
+// 読み込み側は DB を読む前に Generation を取っておき、SetIfUnchanged で入れる。
+// 読んでいる間に消されていれば古い値なので入れない
+type Cache[K comparable, V any] struct {
+	name string
+	ttl  time.Duration
+
+	mu      sync.RWMutex
+	entries map[K]cacheEntry[V]
+	gen     uint64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type cacheEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+type CacheStats struct {
+	Name    string  `json:"name"`
+	Size    int     `json:"size"`
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+func newCache[K comparable, V any](name string, ttl time.Duration) *Cache[K, V] {
+	return &Cache[K, V]{
+		name:    name,
+		ttl:     ttl,
+		entries: make(map[K]cacheEntry[V]),
+	}
+}
+
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	v, ok := c.lookup(key)
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return v, ok
+}
+
+// lookup はヒット率に数えずに値を引く。読み込んだ直後に引き直すときに使う
+func (c *Cache[K, V]) lookup(key K) (V, bool) {
+	c.mu.RLock()
+	e, ok := c.entries[key]
+	c.mu.RUnlock()
+
+	if ok && (c.ttl <= 0 || time.Now().Before(e.expiresAt)) {
+		return e.value, true
+	}
+
+	var zero V
+	return zero, false
+}
+
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = cacheEntry[V]{value: value, expiresAt: time.Now().Add(c.ttl)}
+}
+
+// Generation は Invalidate と Purge のたびに増える値を返す
+func (c *Cache[K, V]) Generation() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.gen
+}
+
+// SetIfUnchanged は gen を取ってから何も消されていなければ値を入れる
+func (c *Cache[K, V]) SetIfUnchanged(key K, value V, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gen != gen {
+		return
+	}
+	c.entries[key] = cacheEntry[V]{value: value, expiresAt: time.Now().Add(c.ttl)}
+}
+
+func (c *Cache[K, V]) Invalidate(keys ...K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		delete(c.entries, key)
+	}
+	c.gen++
+}
+
+// Purge はすべての値と集計を消す
+func (c *Cache[K, V]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[K]cacheEntry[V])
+	c.gen++
+	c.hits.Store(0)
+	c.misses.Store(0)
+}
+
+func (c *Cache[K, V]) Stats() CacheStats {
+	c.mu.RLock()
+	size := len(c.entries)
+	c.mu.RUnlock()
+
+	stats := CacheStats{
+		Name:   c.name,
+		Size:   size,
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+func initCaches() error {
+	ttl, err := envDuration("CACHE_TTL", DefaultCacheTTL)
+	if err != nil {
+		return err
+	}
+
+	// カテゴリは初期データから変わらない
+	// ユーザーは出品数や利用停止が変わり、複数台で動かすとほかのプロセスの変更を消せないのでキャッシュしない
+	categoryCache = newCache[int, Category]("categories", 0)
+	configCache = newCache[string, string]("configs", ttl)
+	return nil
+}
+
+func purgeCaches() {
+	categoryCache.Purge()
+	configCache.Purge()
+}
+
+// loadCategories はすべてのカテゴリを親カテゴリ名とあわせてキャッシュに入れる
+func loadCategories(q sqlx.Queryer) error {
+	categories := []Category{}
+	err := sqlx.Select(q, &categories, "SELECT * FROM `categories`")
+	if err != nil {
+		return err
+	}
+
+	names := make(map[int]string, len(categories))
+	for _, c := range categories {
+		names[c.ID] = c.CategoryName
+	}
+	for _, c := range categories {
+		if c.ParentID != 0 {
+			c.ParentCategoryName = names[c.ParentID]
+		}
+		categoryCache.Set(c.ID, c)
+	}
+	return nil
+}
+
+// getCategoriesByIDs は複数のカテゴリをまとめて返す。見つからないカテゴリは含まない
+func getCategoriesByIDs(q sqlx.Queryer, categoryIDs []int) (map[int]Category, error) {
+	categories := make(map[int]Category, len(categoryIDs))
+	missed := false
+	for _, id := range categoryIDs {
+		if c, ok := categoryCache.Get(id); ok {
+			categories[id] = c
+			continue
+		}
+		missed = true
+	}
+	if !missed {
+		return categories, nil
+	}
+
+	err := loadCategories(q)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range categoryIDs {
+		if _, ok := categories[id]; ok {
+			continue
+		}
+		if c, ok := categoryCache.lookup(id); ok {
+			categories[id] = c
+		}
+	}
+	return categories, nil
+}
+
+// getUserSimplesByIDs は複数のユーザーを1回のクエリでまとめて返す。見つからないユーザーは含まない
+func getUserSimplesByIDs(q sqlx.Queryer, userIDs []int64) (map[int64]UserSimple, error) {
+	userSimples := make(map[int64]UserSimple, len(userIDs))
+	if len(userIDs) == 0 {
+		return userSimples, nil
+	}
+
+	inQuery, inArgs, err := sqlx.In("SELECT * FROM `users` WHERE `id` IN (?)", userIDs)
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	err = sqlx.Select(q, &users, inQuery, inArgs...)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		userSimples[user.ID] = toUserSimple(user)
+	}
+	return userSimples, nil
+}
+
+// getItemUsersAndCategories は商品の一覧に出す出品者、カテゴリをまとめて引く。withBuyers なら購入者も引く
+func getItemUsersAndCategories(q sqlx.Queryer, items []Item, withBuyers bool) (map[int64]UserSimple, map[int]Category, error) {
+	userIDs := make([]int64, 0, len(items))
+	categoryIDs := make([]int, 0, len(items))
+	for _, item := range items {
+		userIDs = append(userIDs, item.SellerID)
+		if withBuyers && item.BuyerID != 0 {
+			userIDs = append(userIDs, item.BuyerID)
+		}
+		categoryIDs = append(categoryIDs, item.CategoryID)
+	}
+
+	users, err := getUserSimplesByIDs(q, userIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	categories, err := getCategoriesByIDs(q, categoryIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return users, categories, nil
+}
+
+func toUserSimple(user User) UserSimple {
+	return UserSimple{
+		ID:           user.ID,
+		AccountName:  user.AccountName,
+		DisplayName:  user.DisplayName,
+		NumSellItems: user.NumSellItems,
+		IsSuspended:  user.IsSuspended,
+	}
+}
+
+// getAdminCache はキャッシュごとの件数とヒット率を返す
+func getAdminCache(w http.ResponseWriter, r *http.Request) {
+	_, errCode, errMsg := getAdmin(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	res := []CacheStats{
+		categoryCache.Stats(),
+		configCache.Stats(),
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
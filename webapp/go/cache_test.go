@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheSetIfUnchanged(t *testing.T) {
+	tests := []struct {
+		name string
+		// between は Generation を取ってから SetIfUnchanged するまでに起きること
+		between func(c *Cache[int, string])
+		want    bool
+	}{
+		{"unchanged", func(c *Cache[int, string]) {}, true},
+		{"invalidated same key", func(c *Cache[int, string]) { c.Invalidate(1) }, false},
+		// 別のキーでも、読んでいる間に消されたかどうかはわからないので入れない
+		{"invalidated other key", func(c *Cache[int, string]) { c.Invalidate(2) }, false},
+		{"purged", func(c *Cache[int, string]) { c.Purge() }, false},
+		{"set by other reader", func(c *Cache[int, string]) { c.Set(2, "other") }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCache[int, string]("test", 0)
+			gen := c.Generation()
+			tt.between(c)
+			c.SetIfUnchanged(1, "stale", gen)
+
+			_, ok := c.lookup(1)
+			if ok != tt.want {
+				t.Errorf("cached = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+// 読み込みと書き込みが並んで走っても、消したあとに古い値が残らない
+func TestCacheSetIfUnchangedRace(t *testing.T) {
+	c := newCache[int, int]("test", 0)
+
+	var wg sync.WaitGroup
+	for i := range 100 {
+		wg.Add(2)
+		var gen uint64
+		read := make(chan struct{})
+		go func() {
+			defer wg.Done()
+			gen = c.Generation()
+			close(read)
+		}()
+		go func() {
+			defer wg.Done()
+			<-read
+			// DB を更新してコミットしたあとに消す
+			c.Invalidate(1)
+			c.SetIfUnchanged(1, i, gen)
+		}()
+		wg.Wait()
+
+		if v, ok := c.lookup(1); ok {
+			t.Fatalf("stale value %d remains after Invalidate", v)
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := newCache[int, string]("test", time.Hour)
+	c.Set(1, "a")
+	if v, ok := c.Get(1); !ok || v != "a" {
+		t.Errorf("Get = %q, %v, want a, true", v, ok)
+	}
+
+	c.mu.Lock()
+	e := c.entries[1]
+	e.expiresAt = time.Now().Add(-time.Second)
+	c.entries[1] = e
+	c.mu.Unlock()
+	if _, ok := c.Get(1); ok {
+		t.Error("expired value was returned")
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.HitRate != 0.5 {
+		t.Errorf("Stats = %+v, want 1 hit and 1 miss", stats)
+	}
+
+	c.Purge()
+	if stats := c.Stats(); stats.Size != 0 || stats.Hits != 0 || stats.Misses != 0 {
+		t.Errorf("Stats after Purge = %+v", stats)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
@@ -15,10 +16,10 @@ import (
 	"path/filepath"
 	"strconv"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-sql-driver/mysql"
-	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	"golang.org/x/crypto/bcrypt"
@@ -58,12 +59,39 @@ const (
 	TransactionsPerPage = 10
 
 	BcryptCost = 10
+
+	DisplayNameMaxLength = 191
+	AddressNameMaxLength = 191
+	AddressMaxLength     = 191
+	UserAddressesMax     = 20
+
+	OfferStatusPending   = "pending"
+	OfferStatusCountered = "countered"
+	OfferStatusAccepted  = "accepted"
+	OfferStatusRejected  = "rejected"
+	OfferStatusPurchased = "purchased"
+	// OfferStatusExpired は取り置き期限が過ぎた accepted の交渉をレスポンスで表す。DBには保存しない
+	OfferStatusExpired = "expired"
+
+	OfferReservationPeriod = 10 * time.Minute
+	OffersPerPage          = 48
+
+	StatsDateFormat       = "2006-01-02"
+	StatsDefaultDays      = 30
+	StatsMaxDays          = 366
+	StatsTopCategoriesNum = 5
+
+	UserSuspendedErrMsg = "このアカウントは利用停止されています"
 )
 
 var (
-	templates *template.Template
-	dbx       *sqlx.DB
-	store     sessions.Store
+	templates    *template.Template
+	dbx          *sqlx.DB
+	store        SessionStore
+	imageStorage ImageStorage
+	loginLimiter *LoginLimiter
+	reconciler   *Reconciler
+	qrCodeStore  *QRCodeStore
 )
 
 type Config struct {
@@ -74,17 +102,44 @@ type Config struct {
 type User struct {
 	ID             int64     `json:"id" db:"id"`
 	AccountName    string    `json:"account_name" db:"account_name"`
+	DisplayName    string    `json:"display_name,omitempty" db:"display_name"`
 	HashedPassword []byte    `json:"-" db:"hashed_password"`
 	Address        string    `json:"address,omitempty" db:"address"`
 	NumSellItems   int       `json:"num_sell_items" db:"num_sell_items"`
 	LastBump       time.Time `json:"-" db:"last_bump"`
+	SessionVersion int64     `json:"-" db:"session_version"`
+	IsAdmin        bool      `json:"is_admin,omitempty" db:"is_admin"`
+	IsSuspended    bool      `json:"-" db:"is_suspended"`
 	CreatedAt      time.Time `json:"-" db:"created_at"`
 }
 
 type UserSimple struct {
 	ID           int64  `json:"id"`
 	AccountName  string `json:"account_name"`
+	DisplayName  string `json:"display_name,omitempty"`
 	NumSellItems int    `json:"num_sell_items"`
+	IsSuspended  bool   `json:"-"`
+}
+
+type UserAddress struct {
+	ID        int64     `json:"id" db:"id"`
+	UserID    int64     `json:"-" db:"user_id"`
+	Name      string    `json:"name" db:"name"`
+	Address   string    `json:"address" db:"address"`
+	IsDefault bool      `json:"is_default" db:"is_default"`
+	CreatedAt time.Time `json:"-" db:"created_at"`
+}
+
+type Offer struct {
+	ID            int64     `json:"id" db:"id"`
+	ItemID        int64     `json:"item_id" db:"item_id"`
+	SellerID      int64     `json:"seller_id" db:"seller_id"`
+	BuyerID       int64     `json:"buyer_id" db:"buyer_id"`
+	Price         int       `json:"price" db:"price"`
+	Status        string    `json:"status" db:"status"`
+	ReservedUntil time.Time `json:"-" db:"reserved_until"`
+	CreatedAt     time.Time `json:"-" db:"created_at"`
+	UpdatedAt     time.Time `json:"-" db:"updated_at"`
 }
 
 type Item struct {
@@ -99,6 +154,9 @@ type Item struct {
 	CategoryID  int       `json:"category_id" db:"category_id"`
 	CreatedAt   time.Time `json:"-" db:"created_at"`
 	UpdatedAt   time.Time `json:"-" db:"updated_at"`
+
+	// SellerSuspended は出品者が利用停止されているかどうか。新着やカテゴリの一覧で users を引かずに済むように写しておく
+	SellerSuspended bool `json:"-" db:"seller_suspended"`
 }
 
 type ItemSimple struct {
@@ -160,6 +218,7 @@ type Shipping struct {
 	FromAddress           string    `json:"from_address" db:"from_address"`
 	FromName              string    `json:"from_name" db:"from_name"`
 	ImgBinary             []byte    `json:"-" db:"img_binary"`
+	ImgName               string    `json:"-" db:"img_name"`
 	CreatedAt             time.Time `json:"-" db:"created_at"`
 	UpdatedAt             time.Time `json:"-" db:"updated_at"`
 }
@@ -199,6 +258,27 @@ type resTransactions struct {
 	Items   []ItemDetail `json:"items"`
 }
 
+type resUserStats struct {
+	TotalSales              int64              `json:"total_sales"`
+	TransactionStatusCounts map[string]int     `json:"transaction_status_counts"`
+	ShippingStatusCounts    map[string]int     `json:"shipping_status_counts"`
+	AverageCompleteSeconds  float64            `json:"average_complete_seconds"`
+	TopCategories           []resCategorySales `json:"top_categories"`
+	DailySales              []resDailySales    `json:"daily_sales"`
+}
+
+type resCategorySales struct {
+	Category *Category `json:"category"`
+	NumSold  int       `json:"num_sold"`
+	Sales    int64     `json:"sales"`
+}
+
+type resDailySales struct {
+	Date    string `json:"date" db:"date"`
+	NumSold int    `json:"num_sold" db:"num_sold"`
+	Sales   int64  `json:"sales" db:"sales"`
+}
+
 type reqRegister struct {
 	AccountName string `json:"account_name"`
 	Address     string `json:"address"`
@@ -210,6 +290,45 @@ type reqLogin struct {
 	Password    string `json:"password"`
 }
 
+type reqLogout struct {
+	CSRFToken string `json:"csrf_token"`
+}
+
+type reqPassword struct {
+	CSRFToken       string `json:"csrf_token"`
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type resPassword struct {
+	CSRFToken string `json:"csrf_token"`
+}
+
+type resSession struct {
+	ID        string `json:"id"`
+	Current   bool   `json:"current"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type reqRevokeSession struct {
+	CSRFToken string `json:"csrf_token"`
+	SessionID string `json:"session_id"`
+}
+
+type reqProfile struct {
+	CSRFToken   string `json:"csrf_token"`
+	DisplayName string `json:"display_name"`
+}
+
+type reqAddress struct {
+	CSRFToken string `json:"csrf_token"`
+	AddressID int64  `json:"address_id"`
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	IsDefault bool   `json:"is_default"`
+}
+
 type reqItemEdit struct {
 	CSRFToken string `json:"csrf_token"`
 	ItemID    int64  `json:"item_id"`
@@ -223,10 +342,46 @@ type resItemEdit struct {
 	ItemUpdatedAt int64 `json:"item_updated_at"`
 }
 
+type reqItemStatus struct {
+	CSRFToken string `json:"csrf_token"`
+	ItemID    int64  `json:"item_id"`
+}
+
+type resItemStatus struct {
+	ItemID        int64  `json:"item_id"`
+	ItemStatus    string `json:"item_status"`
+	ItemUpdatedAt int64  `json:"item_updated_at"`
+}
+
+type reqOffer struct {
+	CSRFToken string `json:"csrf_token"`
+	ItemID    int64  `json:"item_id"`
+	Price     int    `json:"price"`
+}
+
+type reqOfferAction struct {
+	CSRFToken string `json:"csrf_token"`
+	OfferID   int64  `json:"offer_id"`
+	Price     int    `json:"price,omitempty"`
+}
+
+type resOffer struct {
+	ID            int64  `json:"id"`
+	ItemID        int64  `json:"item_id"`
+	SellerID      int64  `json:"seller_id"`
+	BuyerID       int64  `json:"buyer_id"`
+	Price         int    `json:"price"`
+	Status        string `json:"status"`
+	ReservedUntil int64  `json:"reserved_until,omitempty"`
+	CreatedAt     int64  `json:"created_at"`
+	UpdatedAt     int64  `json:"updated_at"`
+}
+
 type reqBuy struct {
 	CSRFToken string `json:"csrf_token"`
 	ItemID    int64  `json:"item_id"`
 	Token     string `json:"token"`
+	AddressID int64  `json:"address_id,omitempty"`
 }
 
 type resBuy struct {
@@ -270,18 +425,6 @@ type resSetting struct {
 }
 
 func init() {
-	keyPairs := []byte("abc")
-	cs := &sessions.CookieStore{
-		Codecs: securecookie.CodecsFromPairs(keyPairs),
-		Options: &sessions.Options{
-			Path:     "/",
-			MaxAge:   86400 * 30,
-			HttpOnly: true,
-		},
-	}
-	cs.MaxAge(cs.Options.MaxAge)
-	store = cs
-
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
 	templates = template.Must(template.ParseFiles(
@@ -322,6 +465,9 @@ func main() {
 	conf.Passwd = password
 	conf.DBName = dbname
 	conf.ParseTime = true
+	// アプリケーションが書く時刻も CURRENT_TIMESTAMP も、DATE_FORMAT などで読む時刻もすべてUTCで揃える
+	conf.Loc = time.UTC
+	conf.Params = map[string]string{"time_zone": "'+00:00'"}
 
 	dbx, err = sqlx.Open("mysql", conf.FormatDSN())
 	if err != nil {
@@ -335,6 +481,50 @@ func main() {
 	}
 	defer root.Close()
 
+	imageStorage, err = newImageStorage()
+	if err != nil {
+		log.Fatalf("failed to initialize image storage: %v", err)
+	}
+
+	qrCodeStore, err = newQRCodeStore()
+	if err != nil {
+		log.Fatalf("failed to initialize qrcode store: %v", err)
+	}
+
+	// ./isucari migrate-qrcode で shippings.img_binary の画像を保存先に移して終わる
+	if len(os.Args) > 1 && os.Args[1] == "migrate-qrcode" {
+		err = migrateQRCodes()
+		if err != nil {
+			log.Fatalf("failed to migrate qrcode images: %v", err)
+		}
+		return
+	}
+
+	store, err = newSessionStore()
+	if err != nil {
+		log.Fatalf("failed to initialize session store: %v", err)
+	}
+
+	loginLimiter, err = newLoginLimiter()
+	if err != nil {
+		log.Fatalf("failed to initialize login limiter: %v", err)
+	}
+
+	err = initCaches()
+	if err != nil {
+		log.Fatalf("failed to initialize caches: %v", err)
+	}
+
+	err = startBuyWorker()
+	if err != nil {
+		log.Fatalf("failed to start buy worker: %v", err)
+	}
+
+	reconciler, err = newReconciler()
+	if err != nil {
+		log.Fatalf("failed to initialize reconciler: %v", err)
+	}
+
 	r := chi.NewRouter()
 
 	// API
@@ -342,11 +532,21 @@ func main() {
 	r.Get("/new_items.json", getNewItems)
 	r.Get("/new_items/{root_category_id}.json", getNewCategoryItems)
 	r.Get("/users/transactions.json", getTransactions)
+	r.Get("/users/me/stats.json", getUserStats)
 	r.Get("/users/{user_id}.json", getUserItems)
 	r.Get("/items/{item_id}.json", getItem)
 	r.Post("/items/edit", postItemEdit)
+	r.Post("/items/stop", postItemStop)
+	r.Post("/items/resume", postItemResume)
+	r.Post("/items/cancel", postItemCancel)
+	r.Post("/offers", postOffer)
+	r.Post("/offers/accept", postOfferAccept)
+	r.Post("/offers/reject", postOfferReject)
+	r.Post("/offers/counter", postOfferCounter)
+	r.Get("/users/offers.json", getOffers)
 	r.Post("/buy", postBuy)
 	r.Post("/sell", postSell)
+	r.Post("/sell/bulk", postSellBulk)
 	r.Post("/ship", postShip)
 	r.Post("/ship_done", postShipDone)
 	r.Post("/complete", postComplete)
@@ -355,7 +555,27 @@ func main() {
 	r.Get("/settings", getSettings)
 	r.Post("/login", postLogin)
 	r.Post("/register", postRegister)
+	r.Post("/logout", postLogout)
+	r.Post("/users/password", postPassword)
+	r.Get("/users/sessions.json", getUserSessions)
+	r.Post("/users/sessions/revoke", postRevokeSession)
+	r.Post("/users/profile", postProfile)
+	r.Get("/users/addresses.json", getAddresses)
+	r.Post("/users/addresses", postAddress)
+	r.Post("/users/addresses/edit", postAddressEdit)
+	r.Post("/users/addresses/delete", postAddressDelete)
+	r.Get("/audit_logs.json", getAuditLogs)
 	r.Get("/reports.json", getReports)
+	r.Post("/admin/users/suspend", postAdminUserSuspend)
+	r.Post("/admin/users/unsuspend", postAdminUserUnsuspend)
+	r.Post("/admin/items/stop", postAdminItemStop)
+	r.Post("/admin/items/resume", postAdminItemResume)
+	r.Get("/admin/transactions/{transaction_evidence_id}.json", getAdminTransaction)
+	r.Get("/admin/logs.json", getAdminLogs)
+	r.Get("/admin/reconciliations.json", getAdminReconciliations)
+	r.Get("/admin/cache.json", getAdminCache)
+	r.Get("/admin/refunds.json", getAdminRefunds)
+	r.Post("/admin/refunds/resolve", postAdminRefundResolve)
 	// Frontend
 	r.Get("/", getIndex)
 	r.Get("/login", getIndex)
@@ -371,6 +591,7 @@ func main() {
 	r.Get("/users/{user_id}", getIndex)
 	r.Get("/users/setting", getIndex)
 	// Assets
+	r.Get("/upload/{image_name}", getImage)
 	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
 		http.FileServerFS(root.FS()).ServeHTTP(w, r)
 	})
@@ -411,6 +632,16 @@ func getUser(r *http.Request) (user User, errCode int, errMsg string) {
 		return user, http.StatusInternalServerError, "db error"
 	}
 
+	// パスワード変更より前に発行されたセッションは無効
+	sessionVersion, _ := session.Values["session_version"].(int64)
+	if sessionVersion != user.SessionVersion {
+		return user, http.StatusNotFound, "no session"
+	}
+
+	if user.IsSuspended {
+		return user, http.StatusForbidden, UserSuspendedErrMsg
+	}
+
 	return user, http.StatusOK, ""
 }
 
@@ -420,34 +651,43 @@ func getUserSimpleByID(q sqlx.Queryer, userID int64) (userSimple UserSimple, err
 	if err != nil {
 		return userSimple, err
 	}
-	userSimple.ID = user.ID
-	userSimple.AccountName = user.AccountName
-	userSimple.NumSellItems = user.NumSellItems
+	userSimple = toUserSimple(user)
 	return userSimple, err
 }
 
 func getCategoryByID(q sqlx.Queryer, categoryID int) (category Category, err error) {
-	err = sqlx.Get(q, &category, "SELECT * FROM `categories` WHERE `id` = ?", categoryID)
-	if category.ParentID != 0 {
-		parentCategory, err := getCategoryByID(q, category.ParentID)
-		if err != nil {
-			return category, err
-		}
-		category.ParentCategoryName = parentCategory.CategoryName
+	if category, ok := categoryCache.Get(categoryID); ok {
+		return category, nil
+	}
+
+	err = loadCategories(q)
+	if err != nil {
+		return category, err
 	}
-	return category, err
+	category, ok := categoryCache.lookup(categoryID)
+	if !ok {
+		return category, sql.ErrNoRows
+	}
+	return category, nil
 }
 
 func getConfigByName(name string) (string, error) {
+	if val, ok := configCache.Get(name); ok {
+		return val, nil
+	}
+
+	gen := configCache.Generation()
 	config := Config{}
 	err := dbx.Get(&config, "SELECT * FROM `configs` WHERE `name` = ?", name)
 	if err == sql.ErrNoRows {
+		configCache.SetIfUnchanged(name, "", gen)
 		return "", nil
 	}
 	if err != nil {
 		log.Print(err)
 		return "", err
 	}
+	configCache.SetIfUnchanged(name, config.Val, gen)
 	return config.Val, err
 }
 
@@ -489,6 +729,9 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	loginLimiter.Reset()
+	reconciler.Reset()
+
 	_, err = dbx.Exec(
 		"INSERT INTO `configs` (`name`, `val`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `val` = VALUES(`val`)",
 		"payment_service_url",
@@ -510,6 +753,9 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 初期データを入れ直したのでキャッシュはすべて捨てる
+	purgeCaches()
+
 	res := resInitialize{
 		// キャンペーン実施時には還元率の設定を返す。詳しくはマニュアルを参照のこと。
 		Campaign: 0,
@@ -548,7 +794,7 @@ func getNewItems(w http.ResponseWriter, r *http.Request) {
 	if itemID > 0 && createdAt > 0 {
 		// paging
 		err := dbx.Select(&items,
-			"SELECT * FROM `items` WHERE `status` IN (?,?) AND (`created_at` < ?  OR (`created_at` <= ? AND `id` < ?)) ORDER BY `created_at` DESC, `id` DESC LIMIT ?",
+			"SELECT * FROM `items` WHERE `status` IN (?,?) AND `seller_suspended` = 0 AND (`created_at` < ?  OR (`created_at` <= ? AND `id` < ?)) ORDER BY `created_at` DESC, `id` DESC LIMIT ?",
 			ItemStatusOnSale,
 			ItemStatusSoldOut,
 			time.Unix(createdAt, 0),
@@ -564,7 +810,7 @@ func getNewItems(w http.ResponseWriter, r *http.Request) {
 	} else {
 		// 1st page
 		err := dbx.Select(&items,
-			"SELECT * FROM `items` WHERE `status` IN (?,?) ORDER BY `created_at` DESC, `id` DESC LIMIT ?",
+			"SELECT * FROM `items` WHERE `status` IN (?,?) AND `seller_suspended` = 0 ORDER BY `created_at` DESC, `id` DESC LIMIT ?",
 			ItemStatusOnSale,
 			ItemStatusSoldOut,
 			ItemsPerPage+1,
@@ -576,15 +822,22 @@ func getNewItems(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	sellers, categories, err := getItemUsersAndCategories(dbx, items, false)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
 	itemSimples := []ItemSimple{}
 	for _, item := range items {
-		seller, err := getUserSimpleByID(dbx, item.SellerID)
-		if err != nil {
+		seller, ok := sellers[item.SellerID]
+		if !ok {
 			outputErrorMsg(w, http.StatusNotFound, "seller not found")
 			return
 		}
-		category, err := getCategoryByID(dbx, item.CategoryID)
-		if err != nil {
+		category, ok := categories[item.CategoryID]
+		if !ok {
 			outputErrorMsg(w, http.StatusNotFound, "category not found")
 			return
 		}
@@ -665,7 +918,7 @@ func getNewCategoryItems(w http.ResponseWriter, r *http.Request) {
 	if itemID > 0 && createdAt > 0 {
 		// paging
 		inQuery, inArgs, err = sqlx.In(
-			"SELECT * FROM `items` WHERE `status` IN (?,?) AND category_id IN (?) AND (`created_at` < ?  OR (`created_at` <= ? AND `id` < ?)) ORDER BY `created_at` DESC, `id` DESC LIMIT ?",
+			"SELECT * FROM `items` WHERE `status` IN (?,?) AND `seller_suspended` = 0 AND category_id IN (?) AND (`created_at` < ?  OR (`created_at` <= ? AND `id` < ?)) ORDER BY `created_at` DESC, `id` DESC LIMIT ?",
 			ItemStatusOnSale,
 			ItemStatusSoldOut,
 			categoryIDs,
@@ -682,7 +935,7 @@ func getNewCategoryItems(w http.ResponseWriter, r *http.Request) {
 	} else {
 		// 1st page
 		inQuery, inArgs, err = sqlx.In(
-			"SELECT * FROM `items` WHERE `status` IN (?,?) AND category_id IN (?) ORDER BY created_at DESC, id DESC LIMIT ?",
+			"SELECT * FROM `items` WHERE `status` IN (?,?) AND `seller_suspended` = 0 AND category_id IN (?) ORDER BY created_at DESC, id DESC LIMIT ?",
 			ItemStatusOnSale,
 			ItemStatusSoldOut,
 			categoryIDs,
@@ -704,15 +957,22 @@ func getNewCategoryItems(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	sellers, categories, err := getItemUsersAndCategories(dbx, items, false)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
 	itemSimples := []ItemSimple{}
 	for _, item := range items {
-		seller, err := getUserSimpleByID(dbx, item.SellerID)
-		if err != nil {
+		seller, ok := sellers[item.SellerID]
+		if !ok {
 			outputErrorMsg(w, http.StatusNotFound, "seller not found")
 			return
 		}
-		category, err := getCategoryByID(dbx, item.CategoryID)
-		if err != nil {
+		category, ok := categories[item.CategoryID]
+		if !ok {
 			outputErrorMsg(w, http.StatusNotFound, "category not found")
 			return
 		}
@@ -757,7 +1017,7 @@ func getUserItems(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userSimple, err := getUserSimpleByID(dbx, userID)
-	if err != nil {
+	if err != nil || userSimple.IsSuspended {
 		outputErrorMsg(w, http.StatusNotFound, "user not found")
 		return
 	}
@@ -819,10 +1079,21 @@ func getUserItems(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	categoryIDs := make([]int, 0, len(items))
+	for _, item := range items {
+		categoryIDs = append(categoryIDs, item.CategoryID)
+	}
+	categories, err := getCategoriesByIDs(dbx, categoryIDs)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
 	itemSimples := []ItemSimple{}
 	for _, item := range items {
-		category, err := getCategoryByID(dbx, item.CategoryID)
-		if err != nil {
+		category, ok := categories[item.CategoryID]
+		if !ok {
 			outputErrorMsg(w, http.StatusNotFound, "category not found")
 			return
 		}
@@ -931,16 +1202,24 @@ func getTransactions(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	users, categories, err := getItemUsersAndCategories(tx, items, true)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
 	itemDetails := []ItemDetail{}
 	for _, item := range items {
-		seller, err := getUserSimpleByID(tx, item.SellerID)
-		if err != nil {
+		seller, ok := users[item.SellerID]
+		if !ok {
 			outputErrorMsg(w, http.StatusNotFound, "seller not found")
 			tx.Rollback()
 			return
 		}
-		category, err := getCategoryByID(tx, item.CategoryID)
-		if err != nil {
+		category, ok := categories[item.CategoryID]
+		if !ok {
 			outputErrorMsg(w, http.StatusNotFound, "category not found")
 			tx.Rollback()
 			return
@@ -966,8 +1245,8 @@ func getTransactions(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if item.BuyerID != 0 {
-			buyer, err := getUserSimpleByID(tx, item.BuyerID)
-			if err != nil {
+			buyer, ok := users[item.BuyerID]
+			if !ok {
 				outputErrorMsg(w, http.StatusNotFound, "buyer not found")
 				tx.Rollback()
 				return
@@ -1061,6 +1340,12 @@ func getItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 出品を停止・取り消した商品は出品者にしか見せない
+	if (item.Status == ItemStatusStop || item.Status == ItemStatusCancel) && user.ID != item.SellerID {
+		outputErrorMsg(w, http.StatusNotFound, "item not found")
+		return
+	}
+
 	category, err := getCategoryByID(dbx, item.CategoryID)
 	if err != nil {
 		outputErrorMsg(w, http.StatusNotFound, "category not found")
@@ -1073,6 +1358,12 @@ func getItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 利用停止されたユーザーの商品は取引中の購入者にしか見せない
+	if seller.IsSuspended && (user.ID != item.BuyerID || item.BuyerID == 0) {
+		outputErrorMsg(w, http.StatusNotFound, "item not found")
+		return
+	}
+
 	itemDetail := ItemDetail{
 		ID:       item.ID,
 		SellerID: item.SellerID,
@@ -1196,6 +1487,20 @@ func postItemEdit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	buying, err := hasActiveBuyReservation(tx, targetItem.ID)
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+	if buying {
+		outputErrorMsg(w, http.StatusForbidden, "販売中の商品以外編集できません")
+		tx.Rollback()
+		return
+	}
+
 	_, err = tx.Exec("UPDATE `items` SET `price` = ?, `updated_at` = ? WHERE `id` = ?",
 		price,
 		time.Now(),
@@ -1209,6 +1514,21 @@ func postItemEdit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = addAuditLogs(tx, seller.ID, AuditActionItemEdit, AuditLog{
+		EntityType: AuditEntityItem,
+		EntityID:   targetItem.ID,
+		Field:      AuditFieldPrice,
+		OldValue:   strconv.Itoa(targetItem.Price),
+		NewValue:   strconv.Itoa(price),
+	})
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
 	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ?", itemID)
 	if err != nil {
 		log.Print(err)
@@ -1228,78 +1548,67 @@ func postItemEdit(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func getQRCode(w http.ResponseWriter, r *http.Request) {
-	transactionEvidenceIDStr := r.PathValue("transaction_evidence_id")
-	transactionEvidenceID, err := strconv.ParseInt(transactionEvidenceIDStr, 10, 64)
-	if err != nil || transactionEvidenceID <= 0 {
-		outputErrorMsg(w, http.StatusBadRequest, "incorrect transaction_evidence id")
-		return
-	}
-
-	seller, errCode, errMsg := getUser(r)
-	if errMsg != "" {
-		outputErrorMsg(w, errCode, errMsg)
-		return
-	}
-
-	transactionEvidence := TransactionEvidence{}
-	err = dbx.Get(&transactionEvidence, "SELECT * FROM `transaction_evidences` WHERE `id` = ?", transactionEvidenceID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "transaction_evidences not found")
-		return
-	}
-	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-		return
-	}
+// itemStatusTransitions は出品者が変更できる商品の状態。変更後の状態から変更前の状態を引く
+var itemStatusTransitions = map[string][]string{
+	ItemStatusStop:   {ItemStatusOnSale},
+	ItemStatusOnSale: {ItemStatusStop},
+	ItemStatusCancel: {ItemStatusOnSale, ItemStatusStop},
+}
 
-	if transactionEvidence.SellerID != seller.ID {
-		outputErrorMsg(w, http.StatusForbidden, "権限がありません")
-		return
-	}
+// isListedItemStatus は users.num_sell_items に数える状態かどうかを返す
+// ユーザーページに表示される状態と揃えている
+func isListedItemStatus(status string) bool {
+	return status == ItemStatusOnSale || status == ItemStatusTrading || status == ItemStatusSoldOut
+}
 
-	shipping := Shipping{}
-	err = dbx.Get(&shipping, "SELECT * FROM `shippings` WHERE `transaction_evidence_id` = ?", transactionEvidence.ID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "shippings not found")
-		return
+// updateNumSellItems は商品の状態の変更に合わせて users.num_sell_items を増減する
+func updateNumSellItems(tx *sqlx.Tx, sellerID int64, from, to string) error {
+	delta := 0
+	if isListedItemStatus(from) {
+		delta--
 	}
-	if err != nil {
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-		return
+	if isListedItemStatus(to) {
+		delta++
 	}
-
-	if shipping.Status != ShippingsStatusWaitPickup && shipping.Status != ShippingsStatusShipping {
-		outputErrorMsg(w, http.StatusForbidden, "qrcode not available")
-		return
+	if delta == 0 {
+		return nil
 	}
+	_, err := tx.Exec("UPDATE `users` SET `num_sell_items` = `num_sell_items` + ? WHERE `id` = ?",
+		delta,
+		sellerID,
+	)
+	return err
+}
 
-	if len(shipping.ImgBinary) == 0 {
-		outputErrorMsg(w, http.StatusInternalServerError, "empty qrcode image")
-		return
-	}
+// postItemStop は出品を一時停止する
+func postItemStop(w http.ResponseWriter, r *http.Request) {
+	changeItemStatus(w, r, ItemStatusStop)
+}
 
-	w.Header().Set("Content-Type", "image/png")
-	w.Write(shipping.ImgBinary)
+// postItemResume は一時停止した出品を再開する
+func postItemResume(w http.ResponseWriter, r *http.Request) {
+	changeItemStatus(w, r, ItemStatusOnSale)
 }
 
-func postBuy(w http.ResponseWriter, r *http.Request) {
-	rb := reqBuy{}
+// postItemCancel は出品を取り消す。取り消した商品は元に戻せない
+func postItemCancel(w http.ResponseWriter, r *http.Request) {
+	changeItemStatus(w, r, ItemStatusCancel)
+}
 
-	err := json.NewDecoder(r.Body).Decode(&rb)
+func changeItemStatus(w http.ResponseWriter, r *http.Request, status string) {
+	ris := reqItemStatus{}
+	err := json.NewDecoder(r.Body).Decode(&ris)
 	if err != nil {
 		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
 		return
 	}
 
-	if rb.CSRFToken != getCSRFToken(r) {
+	if ris.CSRFToken != getCSRFToken(r) {
 		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
-
 		return
 	}
 
-	buyer, errCode, errMsg := getUser(r)
+	seller, errCode, errMsg := getUser(r)
 	if errMsg != "" {
 		outputErrorMsg(w, errCode, errMsg)
 		return
@@ -1308,7 +1617,7 @@ func postBuy(w http.ResponseWriter, r *http.Request) {
 	tx := dbx.MustBegin()
 
 	targetItem := Item{}
-	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ? FOR UPDATE", rb.ItemID)
+	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ? FOR UPDATE", ris.ItemID)
 	if err == sql.ErrNoRows {
 		outputErrorMsg(w, http.StatusNotFound, "item not found")
 		tx.Rollback()
@@ -1322,25 +1631,26 @@ func postBuy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if targetItem.Status != ItemStatusOnSale {
-		outputErrorMsg(w, http.StatusForbidden, "item is not for sale")
+	if targetItem.SellerID != seller.ID {
+		outputErrorMsg(w, http.StatusForbidden, "自分の商品以外は編集できません")
 		tx.Rollback()
 		return
 	}
 
-	if targetItem.SellerID == buyer.ID {
-		outputErrorMsg(w, http.StatusForbidden, "自分の商品は買えません")
-		tx.Rollback()
-		return
+	allowed := false
+	for _, from := range itemStatusTransitions[status] {
+		if targetItem.Status == from {
+			allowed = true
+			break
+		}
 	}
-
-	seller := User{}
-	err = tx.Get(&seller, "SELECT * FROM `users` WHERE `id` = ? FOR UPDATE", targetItem.SellerID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "seller not found")
+	if !allowed {
+		outputErrorMsg(w, http.StatusForbidden, "この商品の状態は変更できません")
 		tx.Rollback()
 		return
 	}
+
+	buying, err := hasActiveBuyReservation(tx, targetItem.ID)
 	if err != nil {
 		log.Print(err)
 
@@ -1348,26 +1658,33 @@ func postBuy(w http.ResponseWriter, r *http.Request) {
 		tx.Rollback()
 		return
 	}
-
-	category, err := getCategoryByID(tx, targetItem.CategoryID)
-	if err != nil {
-		log.Print(err)
-
-		outputErrorMsg(w, http.StatusInternalServerError, "category id error")
+	if buying {
+		outputErrorMsg(w, http.StatusForbidden, "この商品の状態は変更できません")
 		tx.Rollback()
 		return
 	}
 
-	result, err := tx.Exec("INSERT INTO `transaction_evidences` (`seller_id`, `buyer_id`, `status`, `item_id`, `item_name`, `item_price`, `item_description`,`item_category_id`,`item_root_category_id`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		targetItem.SellerID,
-		buyer.ID,
-		TransactionEvidenceStatusWaitShipping,
+	if status == ItemStatusOnSale {
+		takenDown, err := isItemTakenDown(tx, targetItem.ID)
+		if err != nil {
+			log.Print(err)
+
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			tx.Rollback()
+			return
+		}
+		if takenDown {
+			outputErrorMsg(w, http.StatusForbidden, "運営により停止された商品は再開できません")
+			tx.Rollback()
+			return
+		}
+	}
+
+	now := time.Now()
+	_, err = tx.Exec("UPDATE `items` SET `status` = ?, `updated_at` = ? WHERE `id` = ?",
+		status,
+		now,
 		targetItem.ID,
-		targetItem.Name,
-		targetItem.Price,
-		targetItem.Description,
-		category.ID,
-		category.ParentID,
 	)
 	if err != nil {
 		log.Print(err)
@@ -1377,7 +1694,7 @@ func postBuy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	transactionEvidenceID, err := result.LastInsertId()
+	err = updateNumSellItems(tx, seller.ID, targetItem.Status, status)
 	if err != nil {
 		log.Print(err)
 
@@ -1386,12 +1703,7 @@ func postBuy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = tx.Exec("UPDATE `items` SET `buyer_id` = ?, `status` = ?, `updated_at` = ? WHERE `id` = ?",
-		buyer.ID,
-		ItemStatusTrading,
-		time.Now(),
-		targetItem.ID,
-	)
+	err = addAuditLogs(tx, seller.ID, AuditActionItemStatus, auditItemStatus(targetItem.ID, targetItem.Status, status))
 	if err != nil {
 		log.Print(err)
 
@@ -1400,64 +1712,245 @@ func postBuy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	scr, err := APIShipmentCreate(getShipmentServiceURL(), &APIShipmentCreateReq{
-		ToAddress:   buyer.Address,
-		ToName:      buyer.AccountName,
-		FromAddress: seller.Address,
-		FromName:    seller.AccountName,
+	tx.Commit()
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(&resItemStatus{
+		ItemID:        targetItem.ID,
+		ItemStatus:    status,
+		ItemUpdatedAt: now.Unix(),
 	})
+}
+
+func getQRCode(w http.ResponseWriter, r *http.Request) {
+	transactionEvidenceIDStr := r.PathValue("transaction_evidence_id")
+	transactionEvidenceID, err := strconv.ParseInt(transactionEvidenceIDStr, 10, 64)
+	if err != nil || transactionEvidenceID <= 0 {
+		outputErrorMsg(w, http.StatusBadRequest, "incorrect transaction_evidence id")
+		return
+	}
+
+	seller, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	transactionEvidence := TransactionEvidence{}
+	err = dbx.Get(&transactionEvidence, "SELECT * FROM `transaction_evidences` WHERE `id` = ?", transactionEvidenceID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "transaction_evidences not found")
+		return
+	}
 	if err != nil {
 		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "failed to request to shipment service")
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if transactionEvidence.SellerID != seller.ID {
+		outputErrorMsg(w, http.StatusForbidden, "権限がありません")
+		return
+	}
+
+	shipping := Shipping{}
+	err = dbx.Get(&shipping, "SELECT * FROM `shippings` WHERE `transaction_evidence_id` = ?", transactionEvidence.ID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "shippings not found")
+		return
+	}
+	if err != nil {
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if shipping.Status != ShippingsStatusWaitPickup && shipping.Status != ShippingsStatusShipping {
+		outputErrorMsg(w, http.StatusForbidden, "qrcode not available")
+		return
+	}
+
+	if shipping.ImgName != "" {
+		qrCodeStore.Serve(w, r, shipping.ImgName)
+		return
+	}
+
+	if len(shipping.ImgBinary) == 0 {
+		outputErrorMsg(w, http.StatusInternalServerError, "empty qrcode image")
+		return
+	}
+
+	// img_binary に残っている画像はこの場で保存先に移す
+	imgName, err := migrateQRCode(shipping)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "qrcode image error")
+		return
+	}
+	qrCodeStore.Serve(w, r, imgName)
+}
+
+func postBuy(w http.ResponseWriter, r *http.Request) {
+	rb := reqBuy{}
+
+	err := json.NewDecoder(r.Body).Decode(&rb)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if rb.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+
+		return
+	}
+
+	buyer, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	// 住所を指定しなければ既定の住所に送る
+	toAddress, toName := buyer.Address, buyer.AccountName
+	if rb.AddressID != 0 {
+		address := UserAddress{}
+		err = dbx.Get(&address, "SELECT * FROM `user_addresses` WHERE `id` = ? AND `user_id` = ?", rb.AddressID, buyer.ID)
+		if err == sql.ErrNoRows {
+			outputErrorMsg(w, http.StatusNotFound, "address not found")
+			return
+		}
+		if err != nil {
+			log.Print(err)
+
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		toAddress = address.Address
+		if address.Name != "" {
+			toName = address.Name
+		}
+	}
+
+	tx := dbx.MustBegin()
+
+	targetItem := Item{}
+	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ? FOR UPDATE", rb.ItemID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "item not found")
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	if targetItem.Status != ItemStatusOnSale {
+		outputErrorMsg(w, http.StatusForbidden, "item is not for sale")
 		tx.Rollback()
+		return
+	}
 
+	if targetItem.SellerID == buyer.ID {
+		outputErrorMsg(w, http.StatusForbidden, "自分の商品は買えません")
+		tx.Rollback()
 		return
 	}
 
-	pstr, err := APIPaymentToken(getPaymentServiceURL(), &APIPaymentServiceTokenReq{
-		ShopID: PaymentServiceIsucariShopID,
-		Token:  rb.Token,
-		APIKey: PaymentServiceIsucariAPIKey,
-		Price:  targetItem.Price,
-	})
+	// 他の購入者の手続き中なら売り切れと同じに扱う
+	buying, err := hasActiveBuyReservation(tx, targetItem.ID)
 	if err != nil {
 		log.Print(err)
 
-		outputErrorMsg(w, http.StatusInternalServerError, "payment service is failed")
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+	if buying {
+		outputErrorMsg(w, http.StatusForbidden, "item is not for sale")
+		tx.Rollback()
+		return
+	}
+
+	// 交渉が成立した商品は取り置き期限まで交渉相手しか買えず、合意した価格で決済する
+	price := targetItem.Price
+	offer, err := getReservedOffer(tx, targetItem.ID, time.Now())
+	if err != nil && err != sql.ErrNoRows {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+	if err == nil {
+		if offer.BuyerID != buyer.ID {
+			outputErrorMsg(w, http.StatusForbidden, "この商品は他の購入者に取り置き中です")
+			tx.Rollback()
+			return
+		}
+		price = offer.Price
+	}
+
+	seller := User{}
+	err = tx.Get(&seller, "SELECT * FROM `users` WHERE `id` = ?", targetItem.SellerID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "seller not found")
 		tx.Rollback()
 		return
 	}
+	if err != nil {
+		log.Print(err)
 
-	if pstr.Status == "invalid" {
-		outputErrorMsg(w, http.StatusBadRequest, "カード情報に誤りがあります")
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
 		tx.Rollback()
 		return
 	}
 
-	if pstr.Status == "fail" {
-		outputErrorMsg(w, http.StatusBadRequest, "カードの残高が足りません")
+	if seller.IsSuspended {
+		outputErrorMsg(w, http.StatusForbidden, "item is not for sale")
 		tx.Rollback()
 		return
 	}
 
-	if pstr.Status != "ok" {
-		outputErrorMsg(w, http.StatusBadRequest, "想定外のエラー")
+	_, err = getCategoryByID(tx, targetItem.CategoryID)
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "category id error")
 		tx.Rollback()
 		return
 	}
 
-	_, err = tx.Exec("INSERT INTO `shippings` (`transaction_evidence_id`, `status`, `item_name`, `item_id`, `reserve_id`, `reserve_time`, `to_address`, `to_name`, `from_address`, `from_name`, `img_binary`) VALUES (?,?,?,?,?,?,?,?,?,?,?)",
-		transactionEvidenceID,
-		ShippingsStatusInitial,
-		targetItem.Name,
-		targetItem.ID,
-		scr.ReserveID,
-		scr.ReserveTime,
-		buyer.Address,
-		buyer.AccountName,
-		seller.Address,
-		seller.AccountName,
-		"",
+	// 外部サービスを呼ぶ前に手続きだけを記録してロックを手放す
+	reservation := BuyReservation{
+		ItemID:      targetItem.ID,
+		BuyerID:     buyer.ID,
+		SellerID:    seller.ID,
+		OfferID:     offer.ID,
+		Price:       price,
+		Token:       rb.Token,
+		ToAddress:   toAddress,
+		ToName:      toName,
+		FromAddress: seller.Address,
+		FromName:    seller.AccountName,
+		Status:      BuyReservationStatusPending,
+	}
+	result, err := tx.Exec("INSERT INTO `buy_reservations` (`item_id`, `buyer_id`, `seller_id`, `offer_id`, `price`, `token`, `to_address`, `to_name`, `from_address`, `from_name`, `status`, `lease_until`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		reservation.ItemID,
+		reservation.BuyerID,
+		reservation.SellerID,
+		reservation.OfferID,
+		reservation.Price,
+		reservation.Token,
+		reservation.ToAddress,
+		reservation.ToName,
+		reservation.FromAddress,
+		reservation.FromName,
+		reservation.Status,
+		time.Now().Add(BuyReservationLease),
 	)
 	if err != nil {
 		log.Print(err)
@@ -1467,8 +1960,23 @@ func postBuy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	reservation.ID, err = result.LastInsertId()
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
 	tx.Commit()
 
+	transactionEvidenceID, errCode, errMsg := processBuyReservation(reservation, false)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	json.NewEncoder(w).Encode(resBuy{TransactionEvidenceID: transactionEvidenceID})
 }
@@ -1581,9 +2089,17 @@ func postShip(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = tx.Exec("UPDATE `shippings` SET `status` = ?, `img_binary` = ?, `updated_at` = ? WHERE `transaction_evidence_id` = ?",
+	imgName, err := qrCodeStore.Save(img)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "Saving qrcode image failed")
+		tx.Rollback()
+		return
+	}
+
+	_, err = tx.Exec("UPDATE `shippings` SET `status` = ?, `img_name` = ?, `updated_at` = ? WHERE `transaction_evidence_id` = ?",
 		ShippingsStatusWaitPickup,
-		img,
+		imgName,
 		time.Now(),
 		transactionEvidence.ID,
 	)
@@ -1595,6 +2111,15 @@ func postShip(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = addAuditLogs(tx, seller.ID, AuditActionShip, auditShippingStatus(transactionEvidence.ID, shipping.Status, ShippingsStatusWaitPickup))
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
 	tx.Commit()
 
 	rps := resPostShip{
@@ -1744,6 +2269,18 @@ func postShipDone(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = addAuditLogs(tx, seller.ID, AuditActionShipDone,
+		auditShippingStatus(transactionEvidence.ID, shipping.Status, ssr.Status),
+		auditTransactionEvidenceStatus(transactionEvidence.ID, transactionEvidence.Status, TransactionEvidenceStatusWaitDone),
+	)
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
 	tx.Commit()
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
@@ -1897,6 +2434,19 @@ func postComplete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = addAuditLogs(tx, buyer.ID, AuditActionComplete,
+		auditShippingStatus(transactionEvidence.ID, shipping.Status, ShippingsStatusDone),
+		auditTransactionEvidenceStatus(transactionEvidence.ID, transactionEvidence.Status, TransactionEvidenceStatusDone),
+		auditItemStatus(item.ID, item.Status, ItemStatusSoldOut),
+	)
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
 	tx.Commit()
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
@@ -1935,22 +2485,9 @@ func postSell(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if name == "" || description == "" || price == 0 || categoryID == 0 {
-		outputErrorMsg(w, http.StatusBadRequest, "all parameters are required")
-
-		return
-	}
-
-	if price < ItemMinPrice || price > ItemMaxPrice {
-		outputErrorMsg(w, http.StatusBadRequest, ItemPriceErrMsg)
-
-		return
-	}
-
-	category, err := getCategoryByID(dbx, categoryID)
-	if err != nil || category.ParentID == 0 {
-		log.Print(categoryID, category)
-		outputErrorMsg(w, http.StatusBadRequest, "Incorrect category ID")
+	category, errMsg := validateSellItem(dbx, name, description, price, categoryID)
+	if errMsg != "" {
+		outputErrorMsg(w, http.StatusBadRequest, errMsg)
 		return
 	}
 
@@ -1967,19 +2504,13 @@ func postSell(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ext := filepath.Ext(header.Filename)
-
-	if !(ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".gif") {
+	ext, ok := imageExt(header.Filename)
+	if !ok {
 		outputErrorMsg(w, http.StatusBadRequest, "unsupported image format error")
 		return
 	}
 
-	if ext == ".jpeg" {
-		ext = ".jpg"
-	}
-
-	imgName := fmt.Sprintf("%s%s", secureRandomStr(16), ext)
-	err = os.WriteFile(fmt.Sprintf("../public/upload/%s", imgName), img, 0644)
+	imgName, err := imageStorage.Save(img, ext)
 	if err != nil {
 		log.Print(err)
 		outputErrorMsg(w, http.StatusInternalServerError, "Saving image failed")
@@ -2044,6 +2575,40 @@ func postSell(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resSell{ID: itemID})
 }
 
+// validateSellItem は出品内容を確認し、誤りがあればエラーメッセージを返す
+func validateSellItem(q sqlx.Queryer, name, description string, price, categoryID int) (category Category, errMsg string) {
+	if name == "" || description == "" || price == 0 || categoryID == 0 {
+		return category, "all parameters are required"
+	}
+
+	if price < ItemMinPrice || price > ItemMaxPrice {
+		return category, ItemPriceErrMsg
+	}
+
+	category, err := getCategoryByID(q, categoryID)
+	if err != nil || category.ParentID == 0 {
+		log.Print(categoryID, category)
+		return category, "Incorrect category ID"
+	}
+
+	return category, ""
+}
+
+// imageExt は出品画像の拡張子を items.image_name に使う形にして返す
+func imageExt(filename string) (string, bool) {
+	ext := filepath.Ext(filename)
+
+	if !(ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".gif") {
+		return "", false
+	}
+
+	if ext == ".jpeg" {
+		ext = ".jpg"
+	}
+
+	return ext, true
+}
+
 func secureRandomStr(b int) string {
 	k := make([]byte, b)
 	if _, err := crand.Read(k); err != nil {
@@ -2139,7 +2704,13 @@ func postBump(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ?", itemID)
+	err = addAuditLogs(tx, seller.ID, AuditActionBump, AuditLog{
+		EntityType: AuditEntityItem,
+		EntityID:   targetItem.ID,
+		Field:      AuditFieldCreatedAt,
+		OldValue:   strconv.FormatInt(targetItem.CreatedAt.Unix(), 10),
+		NewValue:   strconv.FormatInt(now.Unix(), 10),
+	})
 	if err != nil {
 		log.Print(err)
 		outputErrorMsg(w, http.StatusInternalServerError, "db error")
@@ -2147,9 +2718,17 @@ func postBump(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tx.Commit()
-
-	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ?", itemID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	tx.Commit()
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	json.NewEncoder(w).Encode(&resItemEdit{
 		ItemID:        targetItem.ID,
 		ItemPrice:     targetItem.Price,
@@ -2202,9 +2781,17 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := loginLimiter.ClientIP(r)
+	if retryAfter, ok := loginLimiter.Allow(accountName, ip); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		outputErrorMsg(w, http.StatusTooManyRequests, "ログインの試行回数が多すぎます。しばらくしてからお試しください")
+		return
+	}
+
 	u := User{}
 	err = dbx.Get(&u, "SELECT * FROM `users` WHERE `account_name` = ?", accountName)
 	if err == sql.ErrNoRows {
+		loginLimiter.Fail(accountName, ip)
 		outputErrorMsg(w, http.StatusUnauthorized, "アカウント名かパスワードが間違えています")
 		return
 	}
@@ -2217,6 +2804,7 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 
 	err = bcrypt.CompareHashAndPassword(u.HashedPassword, []byte(password))
 	if err == bcrypt.ErrMismatchedHashAndPassword {
+		loginLimiter.Fail(accountName, ip)
 		outputErrorMsg(w, http.StatusUnauthorized, "アカウント名かパスワードが間違えています")
 		return
 	}
@@ -2226,10 +2814,17 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 		outputErrorMsg(w, http.StatusInternalServerError, "crypt error")
 		return
 	}
+	loginLimiter.Succeed(accountName)
+
+	if u.IsSuspended {
+		outputErrorMsg(w, http.StatusForbidden, UserSuspendedErrMsg)
+		return
+	}
 
 	session := getSession(r)
 
 	session.Values["user_id"] = u.ID
+	session.Values["session_version"] = u.SessionVersion
 	session.Values["csrf_token"] = secureRandomStr(20)
 	if err = session.Save(r, w); err != nil {
 		log.Print(err)
@@ -2268,7 +2863,9 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := dbx.Exec("INSERT INTO `users` (`account_name`, `hashed_password`, `address`) VALUES (?, ?, ?)",
+	tx := dbx.MustBegin()
+
+	result, err := tx.Exec("INSERT INTO `users` (`account_name`, `hashed_password`, `address`) VALUES (?, ?, ?)",
 		accountName,
 		hashedPassword,
 		address,
@@ -2277,6 +2874,7 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		log.Print(err)
 
 		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
 		return
 	}
 
@@ -2286,9 +2884,25 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		log.Print(err)
 
 		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	// 登録時の住所を住所録の既定の住所にしておき、別の住所を既定にしても残るようにする
+	_, err = tx.Exec("INSERT INTO `user_addresses` (`user_id`, `address`, `is_default`) VALUES (?, ?, 1)",
+		userID,
+		address,
+	)
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
 		return
 	}
 
+	tx.Commit()
+
 	u := User{
 		ID:          userID,
 		AccountName: accountName,
@@ -2297,6 +2911,7 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 
 	session := getSession(r)
 	session.Values["user_id"] = u.ID
+	session.Values["session_version"] = u.SessionVersion
 	session.Values["csrf_token"] = secureRandomStr(20)
 	if err = session.Save(r, w); err != nil {
 		log.Print(err)
@@ -2308,27 +2923,1154 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(u)
 }
 
-func getReports(w http.ResponseWriter, r *http.Request) {
-	transactionEvidences := make([]TransactionEvidence, 0)
-	err := dbx.Select(&transactionEvidences, "SELECT * FROM `transaction_evidences` WHERE `id` > 15007")
+func postLogout(w http.ResponseWriter, r *http.Request) {
+	rl := reqLogout{}
+	err := json.NewDecoder(r.Body).Decode(&rl)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if rl.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	session := getSession(r)
+	session.Options.MaxAge = -1
+	if err = session.Save(r, w); err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "session error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(struct{}{})
+}
+
+func postPassword(w http.ResponseWriter, r *http.Request) {
+	rp := reqPassword{}
+	err := json.NewDecoder(r.Body).Decode(&rp)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if rp.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	if rp.CurrentPassword == "" || rp.NewPassword == "" {
+		outputErrorMsg(w, http.StatusBadRequest, "all parameters are required")
+		return
+	}
+
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	// 乗っ取ったセッションから今のパスワードを総当たりされないように、ログインと同じく失敗を数える
+	ip := loginLimiter.ClientIP(r)
+	if retryAfter, ok := loginLimiter.Allow(user.AccountName, ip); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		outputErrorMsg(w, http.StatusTooManyRequests, "パスワードの試行回数が多すぎます。しばらくしてからお試しください")
+		return
+	}
+
+	tx := dbx.MustBegin()
+	err = tx.Get(&user, "SELECT * FROM `users` WHERE `id` = ? FOR UPDATE", user.ID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	err = bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(rp.CurrentPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		loginLimiter.Fail(user.AccountName, ip)
+		outputErrorMsg(w, http.StatusUnauthorized, "パスワードが間違えています")
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "crypt error")
+		tx.Rollback()
+		return
+	}
+
+	loginLimiter.Succeed(user.AccountName)
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(rp.NewPassword), BcryptCost)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "error")
+		tx.Rollback()
+		return
+	}
+
+	// session_version を上げて既存のセッションをすべて無効にする
+	_, err = tx.Exec("UPDATE `users` SET `hashed_password` = ?, `session_version` = ? WHERE `id` = ?",
+		hashedPassword,
+		user.SessionVersion+1,
+		user.ID,
+	)
 	if err != nil {
 		log.Print(err)
 		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	tx.Commit()
+
+	// サーバー側に保存しているセッションは中身も消す
+	err = store.RevokeUserSessions(user.ID)
+	if err != nil && err != errSessionStoreNotServerSide {
+		log.Print(err)
+	}
+
+	// 変更したリクエストのセッションは新しいセッションとして発行し直す
+	session := getSession(r)
+	session.ID = ""
+	session.Values["session_version"] = user.SessionVersion + 1
+	session.Values["csrf_token"] = secureRandomStr(20)
+	if err = session.Save(r, w); err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "session error")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	json.NewEncoder(w).Encode(transactionEvidences)
+	json.NewEncoder(w).Encode(resPassword{CSRFToken: session.Values["csrf_token"].(string)})
 }
 
-func outputErrorMsg(w http.ResponseWriter, status int, msg string) {
+func getUserSessions(w http.ResponseWriter, r *http.Request) {
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	recs, err := store.ListSessions(user.ID)
+	if err == errSessionStoreNotServerSide {
+		outputErrorMsg(w, http.StatusNotImplemented, "session store does not support listing sessions")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "session error")
+		return
+	}
+
+	currentID := getSession(r).ID
+	ress := make([]resSession, 0, len(recs))
+	for _, rec := range recs {
+		ress = append(ress, resSession{
+			ID:        sessionPublicID(rec.ID),
+			Current:   rec.ID == currentID,
+			CreatedAt: rec.CreatedAt.Unix(),
+			ExpiresAt: rec.ExpiresAt.Unix(),
+		})
+	}
+
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(ress)
+}
 
-	w.WriteHeader(status)
+func postRevokeSession(w http.ResponseWriter, r *http.Request) {
+	rr := reqRevokeSession{}
+	err := json.NewDecoder(r.Body).Decode(&rr)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
 
-	json.NewEncoder(w).Encode(struct {
-		Error string `json:"error"`
-	}{Error: msg})
+	if rr.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	recs, err := store.ListSessions(user.ID)
+	if err == errSessionStoreNotServerSide {
+		outputErrorMsg(w, http.StatusNotImplemented, "session store does not support revoking sessions")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "session error")
+		return
+	}
+
+	for _, rec := range recs {
+		if sessionPublicID(rec.ID) != rr.SessionID {
+			continue
+		}
+
+		err = store.RevokeSession(user.ID, rec.ID)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "session error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		json.NewEncoder(w).Encode(struct{}{})
+		return
+	}
+
+	outputErrorMsg(w, http.StatusNotFound, "session not found")
+}
+
+func postProfile(w http.ResponseWriter, r *http.Request) {
+	rp := reqProfile{}
+	err := json.NewDecoder(r.Body).Decode(&rp)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if rp.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	if utf8.RuneCountInString(rp.DisplayName) > DisplayNameMaxLength {
+		outputErrorMsg(w, http.StatusBadRequest, "表示名が長すぎます")
+		return
+	}
+
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	_, err = dbx.Exec("UPDATE `users` SET `display_name` = ? WHERE `id` = ?",
+		rp.DisplayName,
+		user.ID,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	user.DisplayName = rp.DisplayName
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(user)
+}
+
+func getAddresses(w http.ResponseWriter, r *http.Request) {
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	addresses := []UserAddress{}
+	err := dbx.Select(&addresses, "SELECT * FROM `user_addresses` WHERE `user_id` = ? ORDER BY `is_default` DESC, `id` ASC", user.ID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if len(addresses) == 0 {
+		tx := dbx.MustBegin()
+
+		err = tx.Get(&user, "SELECT * FROM `users` WHERE `id` = ? FOR UPDATE", user.ID)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			tx.Rollback()
+			return
+		}
+
+		_, err = backfillRegisteredAddress(tx, user)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Select(&addresses, "SELECT * FROM `user_addresses` WHERE `user_id` = ? ORDER BY `is_default` DESC, `id` ASC", user.ID)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			tx.Rollback()
+			return
+		}
+
+		tx.Commit()
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(addresses)
+}
+
+func postAddress(w http.ResponseWriter, r *http.Request) {
+	ra := reqAddress{}
+	err := json.NewDecoder(r.Body).Decode(&ra)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if ra.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	if ra.Address == "" {
+		outputErrorMsg(w, http.StatusBadRequest, "all parameters are required")
+		return
+	}
+
+	// 宛名は配送の to_name になる
+	if utf8.RuneCountInString(ra.Name) > AddressNameMaxLength {
+		outputErrorMsg(w, http.StatusBadRequest, "宛名が長すぎます")
+		return
+	}
+
+	if utf8.RuneCountInString(ra.Address) > AddressMaxLength {
+		outputErrorMsg(w, http.StatusBadRequest, "住所が長すぎます")
+		return
+	}
+
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	// 既定の住所の切り替えが競合しないようにユーザーをロックする
+	err = tx.Get(&user, "SELECT * FROM `users` WHERE `id` = ? FOR UPDATE", user.ID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	// 住所録より前に登録したユーザーは、登録時の住所を先に住所録に入れる
+	numAddresses, err := backfillRegisteredAddress(tx, user)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	if numAddresses >= UserAddressesMax {
+		outputErrorMsg(w, http.StatusBadRequest, "これ以上住所を登録できません")
+		tx.Rollback()
+		return
+	}
+
+	// 最初に登録した住所は既定の住所にする
+	address := UserAddress{
+		UserID:    user.ID,
+		Name:      ra.Name,
+		Address:   ra.Address,
+		IsDefault: ra.IsDefault || numAddresses == 0,
+	}
+
+	if address.IsDefault {
+		err = setDefaultAddress(tx, user.ID, address.Address)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			tx.Rollback()
+			return
+		}
+	}
+
+	result, err := tx.Exec("INSERT INTO `user_addresses` (`user_id`, `name`, `address`, `is_default`) VALUES (?, ?, ?, ?)",
+		address.UserID,
+		address.Name,
+		address.Address,
+		address.IsDefault,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	address.ID, err = result.LastInsertId()
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	tx.Commit()
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(address)
+}
+
+func postAddressEdit(w http.ResponseWriter, r *http.Request) {
+	ra := reqAddress{}
+	err := json.NewDecoder(r.Body).Decode(&ra)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if ra.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	if ra.Address == "" {
+		outputErrorMsg(w, http.StatusBadRequest, "all parameters are required")
+		return
+	}
+
+	// 宛名は配送の to_name になる
+	if utf8.RuneCountInString(ra.Name) > AddressNameMaxLength {
+		outputErrorMsg(w, http.StatusBadRequest, "宛名が長すぎます")
+		return
+	}
+
+	if utf8.RuneCountInString(ra.Address) > AddressMaxLength {
+		outputErrorMsg(w, http.StatusBadRequest, "住所が長すぎます")
+		return
+	}
+
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	err = tx.Get(&user, "SELECT * FROM `users` WHERE `id` = ? FOR UPDATE", user.ID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	address := UserAddress{}
+	err = tx.Get(&address, "SELECT * FROM `user_addresses` WHERE `id` = ? AND `user_id` = ?", ra.AddressID, user.ID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "address not found")
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	// 既定の住所は他の住所を既定にすることでしか外せない
+	address.Name = ra.Name
+	address.Address = ra.Address
+	address.IsDefault = address.IsDefault || ra.IsDefault
+
+	if address.IsDefault {
+		err = setDefaultAddress(tx, user.ID, address.Address)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			tx.Rollback()
+			return
+		}
+	}
+
+	_, err = tx.Exec("UPDATE `user_addresses` SET `name` = ?, `address` = ?, `is_default` = ? WHERE `id` = ?",
+		address.Name,
+		address.Address,
+		address.IsDefault,
+		address.ID,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	tx.Commit()
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(address)
+}
+
+func postAddressDelete(w http.ResponseWriter, r *http.Request) {
+	ra := reqAddress{}
+	err := json.NewDecoder(r.Body).Decode(&ra)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if ra.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	address := UserAddress{}
+	err = tx.Get(&address, "SELECT * FROM `user_addresses` WHERE `id` = ? AND `user_id` = ? FOR UPDATE", ra.AddressID, user.ID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "address not found")
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	if address.IsDefault {
+		outputErrorMsg(w, http.StatusBadRequest, "既定の住所は削除できません")
+		tx.Rollback()
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM `user_addresses` WHERE `id` = ?", address.ID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	tx.Commit()
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(address)
+}
+
+// backfillRegisteredAddress は住所録が空なら、登録時の住所(users.address)を既定の住所として入れ、住所録の件数を返す
+// 住所録より前に登録したユーザーが別の住所を既定にしたときに、登録時の住所が失われないようにする
+// 呼び出し側でユーザーをロックしておく
+func backfillRegisteredAddress(tx *sqlx.Tx, user User) (int, error) {
+	numAddresses := 0
+	err := tx.Get(&numAddresses, "SELECT COUNT(*) FROM `user_addresses` WHERE `user_id` = ?", user.ID)
+	if err != nil || numAddresses > 0 || user.Address == "" {
+		return numAddresses, err
+	}
+
+	_, err = tx.Exec("INSERT INTO `user_addresses` (`user_id`, `address`, `is_default`) VALUES (?, ?, 1)", user.ID, user.Address)
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// setDefaultAddress は既定の住所を外し、users.address を新しい既定の住所にする
+// 呼び出し側で新しい既定の住所の is_default を立てること
+func setDefaultAddress(tx *sqlx.Tx, userID int64, address string) error {
+	_, err := tx.Exec("UPDATE `user_addresses` SET `is_default` = 0 WHERE `user_id` = ? AND `is_default` = 1", userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE `users` SET `address` = ? WHERE `id` = ?", address, userID)
+	return err
+}
+
+// postOffer は購入希望者が出品者に価格を提示する
+func postOffer(w http.ResponseWriter, r *http.Request) {
+	ro := reqOffer{}
+	err := json.NewDecoder(r.Body).Decode(&ro)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if ro.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	if ro.Price < ItemMinPrice || ro.Price > ItemMaxPrice {
+		outputErrorMsg(w, http.StatusBadRequest, ItemPriceErrMsg)
+		return
+	}
+
+	buyer, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	targetItem := Item{}
+	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ? FOR UPDATE", ro.ItemID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "item not found")
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	if targetItem.Status != ItemStatusOnSale {
+		outputErrorMsg(w, http.StatusForbidden, "item is not for sale")
+		tx.Rollback()
+		return
+	}
+
+	if targetItem.SellerID == buyer.ID {
+		outputErrorMsg(w, http.StatusForbidden, "自分の商品には申し込めません")
+		tx.Rollback()
+		return
+	}
+
+	seller, err := getUserSimpleByID(tx, targetItem.SellerID)
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+	if seller.IsSuspended {
+		outputErrorMsg(w, http.StatusForbidden, "item is not for sale")
+		tx.Rollback()
+		return
+	}
+
+	offers := []Offer{}
+	err = tx.Select(&offers, "SELECT * FROM `offers` WHERE `item_id` = ? AND `buyer_id` = ? AND `status` IN (?, ?, ?)",
+		targetItem.ID,
+		buyer.ID,
+		OfferStatusPending,
+		OfferStatusCountered,
+		OfferStatusAccepted,
+	)
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	now := time.Now()
+	for _, o := range offers {
+		if offerStatus(o, now) != OfferStatusExpired {
+			outputErrorMsg(w, http.StatusForbidden, "この商品とは既に交渉中です")
+			tx.Rollback()
+			return
+		}
+	}
+
+	offer := Offer{
+		ItemID:    targetItem.ID,
+		SellerID:  targetItem.SellerID,
+		BuyerID:   buyer.ID,
+		Price:     ro.Price,
+		Status:    OfferStatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	result, err := tx.Exec("INSERT INTO `offers` (`item_id`, `seller_id`, `buyer_id`, `price`, `status`, `created_at`, `updated_at`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		offer.ItemID,
+		offer.SellerID,
+		offer.BuyerID,
+		offer.Price,
+		offer.Status,
+		offer.CreatedAt,
+		offer.UpdatedAt,
+	)
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	offer.ID, err = result.LastInsertId()
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	tx.Commit()
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(offerToRes(offer, now))
+}
+
+// postOfferAccept は提示された価格で合意し、一定時間商品を交渉相手のために取り置く
+func postOfferAccept(w http.ResponseWriter, r *http.Request) {
+	respondOffer(w, r, OfferStatusAccepted)
+}
+
+// postOfferReject は交渉を打ち切る
+func postOfferReject(w http.ResponseWriter, r *http.Request) {
+	respondOffer(w, r, OfferStatusRejected)
+}
+
+// postOfferCounter は別の価格を提示し返す
+func postOfferCounter(w http.ResponseWriter, r *http.Request) {
+	respondOffer(w, r, OfferStatusCountered)
+}
+
+// respondOffer は交渉に返答する。pending なら出品者、countered なら購入希望者の番で、
+// 出品者の提示は countered、購入希望者の提示は pending になる
+func respondOffer(w http.ResponseWriter, r *http.Request, status string) {
+	ra := reqOfferAction{}
+	err := json.NewDecoder(r.Body).Decode(&ra)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if ra.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	if status == OfferStatusCountered && (ra.Price < ItemMinPrice || ra.Price > ItemMaxPrice) {
+		outputErrorMsg(w, http.StatusBadRequest, ItemPriceErrMsg)
+		return
+	}
+
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	offer := Offer{}
+	err = dbx.Get(&offer, "SELECT * FROM `offers` WHERE `id` = ?", ra.OfferID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "offer not found")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if offer.SellerID != user.ID && offer.BuyerID != user.ID {
+		outputErrorMsg(w, http.StatusForbidden, "権限がありません")
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	// postBuy と同じく商品から先にロックする
+	targetItem := Item{}
+	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ? FOR UPDATE", offer.ItemID)
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Get(&offer, "SELECT * FROM `offers` WHERE `id` = ? FOR UPDATE", offer.ID)
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	var turn int64
+	switch offer.Status {
+	case OfferStatusPending:
+		turn = offer.SellerID
+	case OfferStatusCountered:
+		turn = offer.BuyerID
+	default:
+		outputErrorMsg(w, http.StatusForbidden, "この交渉は終了しています")
+		tx.Rollback()
+		return
+	}
+	if turn != user.ID {
+		outputErrorMsg(w, http.StatusForbidden, "相手の返答を待っています")
+		tx.Rollback()
+		return
+	}
+
+	if targetItem.Status != ItemStatusOnSale {
+		outputErrorMsg(w, http.StatusForbidden, "item is not for sale")
+		tx.Rollback()
+		return
+	}
+
+	now := time.Now()
+	switch status {
+	case OfferStatusAccepted:
+		_, err = getReservedOffer(tx, targetItem.ID, now)
+		if err == nil {
+			outputErrorMsg(w, http.StatusForbidden, "この商品は他の購入者に取り置き中です")
+			tx.Rollback()
+			return
+		}
+		if err != sql.ErrNoRows {
+			log.Print(err)
+
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			tx.Rollback()
+			return
+		}
+		offer.ReservedUntil = now.Add(OfferReservationPeriod)
+	case OfferStatusCountered:
+		if user.ID == offer.BuyerID {
+			status = OfferStatusPending
+		}
+		offer.Price = ra.Price
+	}
+	offer.Status = status
+	offer.UpdatedAt = now
+
+	_, err = tx.Exec("UPDATE `offers` SET `price` = ?, `status` = ?, `reserved_until` = ?, `updated_at` = ? WHERE `id` = ?",
+		offer.Price,
+		offer.Status,
+		offer.ReservedUntil,
+		offer.UpdatedAt,
+		offer.ID,
+	)
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	tx.Commit()
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(offerToRes(offer, now))
+}
+
+// getOffers は自分が当事者の交渉を新しい順に返す
+// item_id を指定すると、出品者にはその商品へのすべての交渉を、購入希望者には自分の交渉を返す
+func getOffers(w http.ResponseWriter, r *http.Request) {
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	var itemID int64
+	var err error
+	itemIDStr := r.URL.Query().Get("item_id")
+	if itemIDStr != "" {
+		itemID, err = strconv.ParseInt(itemIDStr, 10, 64)
+		if err != nil || itemID <= 0 {
+			outputErrorMsg(w, http.StatusBadRequest, "incorrect item id")
+			return
+		}
+	}
+
+	offers := []Offer{}
+	if itemID > 0 {
+		err = dbx.Select(&offers,
+			"SELECT * FROM `offers` WHERE `item_id` = ? AND (`seller_id` = ? OR `buyer_id` = ?) ORDER BY `updated_at` DESC, `id` DESC LIMIT ?",
+			itemID,
+			user.ID,
+			user.ID,
+			OffersPerPage,
+		)
+	} else {
+		err = dbx.Select(&offers,
+			"SELECT * FROM `offers` WHERE `seller_id` = ? OR `buyer_id` = ? ORDER BY `updated_at` DESC, `id` DESC LIMIT ?",
+			user.ID,
+			user.ID,
+			OffersPerPage,
+		)
+	}
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	now := time.Now()
+	res := make([]resOffer, 0, len(offers))
+	for _, o := range offers {
+		res = append(res, offerToRes(o, now))
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+// getReservedOffer は取り置き期限内の成立した交渉を返す。なければ sql.ErrNoRows を返す
+// 呼び出し側で商品をロックしておくこと
+func getReservedOffer(tx *sqlx.Tx, itemID int64, now time.Time) (offer Offer, err error) {
+	offers := []Offer{}
+	err = tx.Select(&offers, "SELECT * FROM `offers` WHERE `item_id` = ? AND `status` = ? FOR UPDATE", itemID, OfferStatusAccepted)
+	if err != nil {
+		return offer, err
+	}
+	for _, o := range offers {
+		if now.Before(o.ReservedUntil) {
+			return o, nil
+		}
+	}
+	return offer, sql.ErrNoRows
+}
+
+func offerStatus(offer Offer, now time.Time) string {
+	if offer.Status == OfferStatusAccepted && !now.Before(offer.ReservedUntil) {
+		return OfferStatusExpired
+	}
+	return offer.Status
+}
+
+func offerToRes(offer Offer, now time.Time) resOffer {
+	res := resOffer{
+		ID:        offer.ID,
+		ItemID:    offer.ItemID,
+		SellerID:  offer.SellerID,
+		BuyerID:   offer.BuyerID,
+		Price:     offer.Price,
+		Status:    offerStatus(offer, now),
+		CreatedAt: offer.CreatedAt.Unix(),
+		UpdatedAt: offer.UpdatedAt.Unix(),
+	}
+	if offer.Status == OfferStatusAccepted {
+		res.ReservedUntil = offer.ReservedUntil.Unix()
+	}
+	return res
+}
+
+// getUserStats は出品者としての売上の集計を返す
+// 日別の売上は取引が完了した日で数え、from と to(YYYY-MM-DD)で期間を指定できる
+// DBとの接続はUTCに揃えているので、日の区切りも DATE_FORMAT の日付もUTCになる
+func getUserStats(w http.ResponseWriter, r *http.Request) {
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	query := r.URL.Query()
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	if toStr := query.Get("to"); toStr != "" {
+		t, err := time.Parse(StatsDateFormat, toStr)
+		if err != nil {
+			outputErrorMsg(w, http.StatusBadRequest, "incorrect date")
+			return
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, -(StatsDefaultDays - 1))
+	if fromStr := query.Get("from"); fromStr != "" {
+		t, err := time.Parse(StatsDateFormat, fromStr)
+		if err != nil {
+			outputErrorMsg(w, http.StatusBadRequest, "incorrect date")
+			return
+		}
+		from = t
+	}
+	if to.Before(from) {
+		outputErrorMsg(w, http.StatusBadRequest, "incorrect date range")
+		return
+	}
+	if to.Sub(from) >= StatsMaxDays*24*time.Hour {
+		outputErrorMsg(w, http.StatusBadRequest, fmt.Sprintf("期間は%d日以内にしてください", StatsMaxDays))
+		return
+	}
+
+	res := resUserStats{
+		TransactionStatusCounts: map[string]int{
+			TransactionEvidenceStatusWaitShipping: 0,
+			TransactionEvidenceStatusWaitDone:     0,
+			TransactionEvidenceStatusDone:         0,
+		},
+		ShippingStatusCounts: map[string]int{
+			ShippingsStatusInitial:    0,
+			ShippingsStatusWaitPickup: 0,
+			ShippingsStatusShipping:   0,
+			ShippingsStatusDone:       0,
+		},
+		TopCategories: []resCategorySales{},
+		DailySales:    []resDailySales{},
+	}
+
+	statusCounts := []struct {
+		Status string `db:"status"`
+		Count  int    `db:"count"`
+		Sales  int64  `db:"sales"`
+	}{}
+	err := dbx.Select(&statusCounts,
+		"SELECT `status`, COUNT(*) AS `count`, COALESCE(SUM(`item_price`), 0) AS `sales` FROM `transaction_evidences` WHERE `seller_id` = ? GROUP BY `status`",
+		user.ID,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	for _, sc := range statusCounts {
+		res.TransactionStatusCounts[sc.Status] = sc.Count
+		if sc.Status == TransactionEvidenceStatusDone {
+			res.TotalSales = sc.Sales
+		}
+	}
+
+	shippingCounts := []struct {
+		Status string `db:"status"`
+		Count  int    `db:"count"`
+	}{}
+	err = dbx.Select(&shippingCounts,
+		"SELECT `s`.`status`, COUNT(*) AS `count` FROM `shippings` `s` JOIN `transaction_evidences` `t` ON `t`.`id` = `s`.`transaction_evidence_id` WHERE `t`.`seller_id` = ? GROUP BY `s`.`status`",
+		user.ID,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	for _, sc := range shippingCounts {
+		res.ShippingStatusCounts[sc.Status] = sc.Count
+	}
+
+	// 取引完了時に transaction_evidences.updated_at が更新される
+	err = dbx.Get(&res.AverageCompleteSeconds,
+		"SELECT COALESCE(AVG(TIMESTAMPDIFF(SECOND, `created_at`, `updated_at`)), 0) FROM `transaction_evidences` WHERE `seller_id` = ? AND `status` = ?",
+		user.ID,
+		TransactionEvidenceStatusDone,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	categorySales := []struct {
+		CategoryID int   `db:"item_category_id"`
+		NumSold    int   `db:"num_sold"`
+		Sales      int64 `db:"sales"`
+	}{}
+	err = dbx.Select(&categorySales,
+		"SELECT `item_category_id`, COUNT(*) AS `num_sold`, SUM(`item_price`) AS `sales` FROM `transaction_evidences` WHERE `seller_id` = ? AND `status` = ? GROUP BY `item_category_id` ORDER BY `sales` DESC, `item_category_id` ASC LIMIT ?",
+		user.ID,
+		TransactionEvidenceStatusDone,
+		StatsTopCategoriesNum,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	for _, cs := range categorySales {
+		category, err := getCategoryByID(dbx, cs.CategoryID)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		res.TopCategories = append(res.TopCategories, resCategorySales{
+			Category: &category,
+			NumSold:  cs.NumSold,
+			Sales:    cs.Sales,
+		})
+	}
+
+	dailySales := []resDailySales{}
+	err = dbx.Select(&dailySales,
+		"SELECT DATE_FORMAT(`updated_at`, '%Y-%m-%d') AS `date`, COUNT(*) AS `num_sold`, SUM(`item_price`) AS `sales` FROM `transaction_evidences` WHERE `seller_id` = ? AND `status` = ? AND `updated_at` >= ? AND `updated_at` < ? GROUP BY `date`",
+		user.ID,
+		TransactionEvidenceStatusDone,
+		from,
+		to.AddDate(0, 0, 1),
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	// 売上のない日も0として返す
+	salesByDate := make(map[string]resDailySales, len(dailySales))
+	for _, ds := range dailySales {
+		salesByDate[ds.Date] = ds
+	}
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		date := d.Format(StatsDateFormat)
+		ds, ok := salesByDate[date]
+		if !ok {
+			ds = resDailySales{Date: date}
+		}
+		res.DailySales = append(res.DailySales, ds)
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func getReports(w http.ResponseWriter, r *http.Request) {
+	transactionEvidences := make([]TransactionEvidence, 0)
+	err := dbx.Select(&transactionEvidences, "SELECT * FROM `transaction_evidences` WHERE `id` > 15007")
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(transactionEvidences)
+}
+
+func outputErrorMsg(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{Error: msg})
+}
+
+func getImage(w http.ResponseWriter, r *http.Request) {
+	imageStorage.ServeImage(w, r, r.PathValue("image_name"))
 }
 
 func getImageURL(imageName string) string {
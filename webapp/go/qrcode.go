@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+)
+
+const (
+	DefaultQRCodeDir = "../qrcode"
+	QRCodeS3Prefix   = "qrcode/"
+
+	QRCodeMigrateBatchSize = 100
+)
+
+// QRCodeStore は発送用のQRコード画像を ImageStorage に保存する
+// 複数台で動かしても、どのプロセスが保存した画像も同じ保存先から返せる
+// 画像は名前が同じなら内容も同じなので、名前を ETag にする
+type QRCodeStore struct {
+	storage ImageStorage
+}
+
+// newQRCodeStore は IMAGE_STORAGE と同じ種類の保存先を、出品画像とは別の場所に作る
+// ディスクに保存するときは内容のハッシュ値をファイル名にして QRCODE_DIR に、
+// s3 ならバケットの qrcode/ に保存する。出品者にしか見せないので S3_PUBLIC_URL へはリダイレクトしない
+func newQRCodeStore() (*QRCodeStore, error) {
+	switch os.Getenv("IMAGE_STORAGE") {
+	case ImageStorageS3:
+		s, err := newS3ImageStorage()
+		if err != nil {
+			return nil, err
+		}
+		s.prefix = QRCodeS3Prefix
+		s.publicURL = ""
+		return &QRCodeStore{storage: s}, nil
+	default:
+		dir := os.Getenv("QRCODE_DIR")
+		if dir == "" {
+			dir = DefaultQRCodeDir
+		}
+		s, err := newCASImageStorage(dir)
+		if err != nil {
+			return nil, err
+		}
+		return &QRCodeStore{storage: s}, nil
+	}
+}
+
+// Save は画像を保存して shippings.img_name に記録する名前を返す
+func (s *QRCodeStore) Save(img []byte) (string, error) {
+	return s.storage.Save(img, ".png")
+}
+
+// Serve は保存した画像を返す。見られるかどうかは取引の状態によって変わるので、
+// ブラウザには毎回確かめさせ、変わっていなければ 304 を返す。保存先になければ 404 を返す
+func (s *QRCodeStore) Serve(w http.ResponseWriter, r *http.Request, name string) {
+	setQRCodeHeaders(w, name)
+	s.storage.ServeImage(w, r, name)
+}
+
+func setQRCodeHeaders(w http.ResponseWriter, name string) {
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("ETag", `"`+name+`"`)
+	w.Header().Set("Cache-Control", "private, no-cache")
+}
+
+// migrateQRCodes は shippings.img_binary に入っている画像を保存先に移す。
+// 一度だけ実行すればよいが、途中で止めてもやり直せる
+func migrateQRCodes() error {
+	migrated := 0
+	for {
+		shippings := []Shipping{}
+		err := dbx.Select(&shippings, "SELECT * FROM `shippings` WHERE `img_name` = '' AND LENGTH(`img_binary`) > 0 LIMIT ?", QRCodeMigrateBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(shippings) == 0 {
+			break
+		}
+
+		for _, shipping := range shippings {
+			_, err := migrateQRCode(shipping)
+			if err != nil {
+				return err
+			}
+			migrated++
+		}
+		log.Printf("migrated %d qrcode images", migrated)
+	}
+
+	log.Printf("done: migrated %d qrcode images", migrated)
+	return nil
+}
+
+// migrateQRCode は1件の配送の画像を保存先に移して、shippings.img_name に記録する名前を返す
+// 移していない画像を表示するときにも呼ぶので、画像のハッシュ値を計算するのは1回だけで済む
+func migrateQRCode(shipping Shipping) (string, error) {
+	name, err := qrCodeStore.Save(shipping.ImgBinary)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = dbx.Exec("UPDATE `shippings` SET `img_name` = ?, `img_binary` = '' WHERE `transaction_evidence_id` = ? AND `img_name` = ''",
+		name,
+		shipping.TransactionEvidenceID,
+	)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultLoginAccountLimit = 10
+	// DefaultLoginIPLimit はIPごとの制限を無効にしておく
+	// ベンチマーカーはすべてのリクエストを1つのIPから送るので、ロックされるとどのユーザーもログインできなくなる
+	DefaultLoginIPLimit = 0
+	DefaultLoginWindow  = time.Minute
+	DefaultLoginLockout = time.Minute
+	DefaultRealIPHeader = "X-Real-IP"
+	// DefaultTrustedProxies は同じホストで動かすnginxからの接続だけを信頼する
+	DefaultTrustedProxies = "127.0.0.1/32,::1/128"
+
+	loginLimiterSweepInterval = time.Minute
+)
+
+// LoginLimiter はログインの失敗をアカウントごととIPごとに数え、
+// 一定時間内の失敗が上限に達したら一定時間ログインを受け付けない
+type LoginLimiter struct {
+	accounts *failureCounter
+	ips      *failureCounter
+
+	// realIPHeader は trustedProxies からの接続のときだけクライアントのIPとして使う
+	realIPHeader   string
+	trustedProxies []*net.IPNet
+}
+
+func newLoginLimiter() (*LoginLimiter, error) {
+	accountLimit, err := envInt("LOGIN_ACCOUNT_LIMIT", DefaultLoginAccountLimit)
+	if err != nil {
+		return nil, err
+	}
+	ipLimit, err := envInt("LOGIN_IP_LIMIT", DefaultLoginIPLimit)
+	if err != nil {
+		return nil, err
+	}
+	window, err := envDuration("LOGIN_WINDOW", DefaultLoginWindow)
+	if err != nil {
+		return nil, err
+	}
+	lockout, err := envDuration("LOGIN_LOCKOUT", DefaultLoginLockout)
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, err
+	}
+	realIPHeader := os.Getenv("REAL_IP_HEADER")
+	if realIPHeader == "" {
+		realIPHeader = DefaultRealIPHeader
+	}
+
+	l := &LoginLimiter{
+		accounts:       newFailureCounter(accountLimit, window, lockout),
+		ips:            newFailureCounter(ipLimit, window, lockout),
+		realIPHeader:   realIPHeader,
+		trustedProxies: trustedProxies,
+	}
+	go l.sweep(loginLimiterSweepInterval)
+
+	return l, nil
+}
+
+// Allow はログインを試行してよいかを返す。ロック中なら解除までの時間も返す
+func (l *LoginLimiter) Allow(accountName, ip string) (time.Duration, bool) {
+	now := time.Now()
+	retryAfter := max(l.accounts.lockedFor(accountName, now), l.ips.lockedFor(ip, now))
+	return retryAfter, retryAfter <= 0
+}
+
+// Fail はログインの失敗を記録する。存在しないアカウントへの試行も数える
+func (l *LoginLimiter) Fail(accountName, ip string) {
+	now := time.Now()
+	l.accounts.fail(accountName, now)
+	l.ips.fail(ip, now)
+}
+
+// Succeed はログインに成功したアカウントの失敗回数を消す
+// IPの失敗回数は自分のアカウントへのログインを挟んで総当たりされないように消さない
+func (l *LoginLimiter) Succeed(accountName string) {
+	l.accounts.reset(accountName)
+}
+
+// Reset はすべての記録を消す
+func (l *LoginLimiter) Reset() {
+	l.accounts.resetAll()
+	l.ips.resetAll()
+}
+
+func (l *LoginLimiter) sweep(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		l.accounts.sweep(now)
+		l.ips.sweep(now)
+	}
+}
+
+// failureCounter は固定ウィンドウで失敗回数を数える。limit が0以下なら制限しない
+type failureCounter struct {
+	limit   int
+	window  time.Duration
+	lockout time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*failureEntry
+}
+
+type failureEntry struct {
+	count       int
+	windowStart time.Time
+	lockedUntil time.Time
+}
+
+func newFailureCounter(limit int, window, lockout time.Duration) *failureCounter {
+	return &failureCounter{
+		limit:   limit,
+		window:  window,
+		lockout: lockout,
+		entries: make(map[string]*failureEntry),
+	}
+}
+
+func (c *failureCounter) lockedFor(key string, now time.Time) time.Duration {
+	if c.limit <= 0 {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return 0
+	}
+	return e.lockedUntil.Sub(now)
+}
+
+func (c *failureCounter) fail(key string, now time.Time) {
+	if c.limit <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		e = &failureEntry{}
+		c.entries[key] = e
+	}
+	if now.Sub(e.windowStart) >= c.window {
+		e.count = 0
+		e.windowStart = now
+	}
+
+	e.count++
+	if e.count >= c.limit {
+		e.lockedUntil = now.Add(c.lockout)
+		e.count = 0
+		e.windowStart = now
+	}
+}
+
+func (c *failureCounter) reset(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
+
+func (c *failureCounter) resetAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*failureEntry)
+}
+
+func (c *failureCounter) sweep(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, e := range c.entries {
+		if now.Sub(e.windowStart) >= c.window && !now.Before(e.lockedUntil) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// ClientIP はクライアントのIPを返す
+// 接続元が信頼するプロキシならnginxが付けたヘッダーを使い、そうでなければ直接の接続元を使う
+// プロキシを通さずに接続したクライアントがヘッダーで別のIPを名乗って制限を逃れないようにする
+func (l *LoginLimiter) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	remote := net.ParseIP(host)
+	if remote == nil || !slices.ContainsFunc(l.trustedProxies, func(n *net.IPNet) bool { return n.Contains(remote) }) {
+		return host
+	}
+	if ip := r.Header.Get(l.realIPHeader); ip != "" {
+		return ip
+	}
+	return host
+}
+
+// parseTrustedProxies はカンマ区切りのIPかCIDRを読む。空なら DefaultTrustedProxies を使う
+func parseTrustedProxies(v string) ([]*net.IPNet, error) {
+	if v == "" {
+		v = DefaultTrustedProxies
+	}
+
+	proxies := []*net.IPNet{}
+	for _, str := range strings.Split(v, ",") {
+		str = strings.TrimSpace(str)
+		if str == "" {
+			continue
+		}
+		if !strings.Contains(str, "/") {
+			ip := net.ParseIP(str)
+			if ip == nil {
+				return nil, fmt.Errorf("failed to read TRUSTED_PROXIES: %s is not IP", str)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(str)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TRUSTED_PROXIES: %w", err)
+		}
+		proxies = append(proxies, n)
+	}
+	return proxies, nil
+}
+
+func envInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return d, nil
+}
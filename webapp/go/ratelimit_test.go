@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFailureCounter(t *testing.T) {
+	const (
+		limit   = 3
+		window  = time.Minute
+		lockout = 30 * time.Second
+	)
+	start := time.Date(2019, 9, 7, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		// fails は start からの失敗した時刻
+		fails []time.Duration
+		at    time.Duration
+		want  time.Duration
+	}{
+		{"no failures", nil, 0, 0},
+		{"under limit", []time.Duration{0, time.Second}, 2 * time.Second, 0},
+		{"reach limit", []time.Duration{0, time.Second, 2 * time.Second}, 2 * time.Second, lockout},
+		{"locked for the rest of lockout", []time.Duration{0, time.Second, 2 * time.Second}, 12 * time.Second, lockout - 10*time.Second},
+		{"unlocked after lockout", []time.Duration{0, time.Second, 2 * time.Second}, 2*time.Second + lockout, 0},
+		// ウィンドウが切り替わると数え直す
+		{"window expired", []time.Duration{0, time.Second, window}, window, 0},
+		{"window expired just before", []time.Duration{0, time.Second, window - time.Nanosecond}, window, lockout - time.Nanosecond},
+		{"new window reaches limit", []time.Duration{0, window, window + time.Second, window + 2*time.Second}, window + 2*time.Second, lockout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFailureCounter(limit, window, lockout)
+			for _, d := range tt.fails {
+				c.fail("key", start.Add(d))
+			}
+			got := max(c.lockedFor("key", start.Add(tt.at)), 0)
+			if got != tt.want {
+				t.Errorf("lockedFor = %s, want %s", got, tt.want)
+			}
+			if other := c.lockedFor("other", start.Add(tt.at)); other > 0 {
+				t.Errorf("other key is locked for %s", other)
+			}
+		})
+	}
+}
+
+func TestFailureCounterDisabled(t *testing.T) {
+	now := time.Now()
+	c := newFailureCounter(0, time.Minute, time.Minute)
+	for range 100 {
+		c.fail("key", now)
+	}
+	if got := c.lockedFor("key", now); got > 0 {
+		t.Errorf("lockedFor = %s, want 0", got)
+	}
+}
+
+func TestFailureCounterResetAndSweep(t *testing.T) {
+	start := time.Now()
+	c := newFailureCounter(2, time.Minute, time.Minute)
+
+	c.fail("a", start)
+	c.fail("a", start)
+	c.reset("a")
+	if got := c.lockedFor("a", start); got > 0 {
+		t.Errorf("lockedFor after reset = %s, want 0", got)
+	}
+
+	c.fail("b", start)
+	c.fail("c", start)
+	c.fail("c", start)
+	c.sweep(start.Add(time.Minute))
+	if _, ok := c.entries["b"]; ok {
+		t.Error("expired entry was not swept")
+	}
+	if _, ok := c.entries["c"]; ok {
+		t.Error("unlocked entry was not swept")
+	}
+
+	c.fail("d", start)
+	c.fail("d", start)
+	c.sweep(start.Add(30 * time.Second))
+	if _, ok := c.entries["d"]; !ok {
+		t.Error("locked entry was swept")
+	}
+}
+
+func TestLoginLimiterClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8,192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &LoginLimiter{realIPHeader: DefaultRealIPHeader, trustedProxies: proxies}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		want       string
+	}{
+		{"direct", "198.51.100.1:1234", "", "198.51.100.1"},
+		{"untrusted header", "198.51.100.1:1234", "203.0.113.1", "198.51.100.1"},
+		{"trusted cidr", "10.1.2.3:1234", "203.0.113.1", "203.0.113.1"},
+		{"trusted ip", "192.0.2.1:1234", "203.0.113.1", "203.0.113.1"},
+		{"trusted without header", "10.1.2.3:1234", "", "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/login", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				r.Header.Set(DefaultRealIPHeader, tt.realIP)
+			}
+			if got := l.ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		v       string
+		n       int
+		wantErr bool
+	}{
+		{"", 2, false},
+		{"10.0.0.0/8", 1, false},
+		{"10.0.0.1, ::1", 2, false},
+		{"10.0.0.1,", 1, false},
+		{"not-ip", 0, true},
+		{"10.0.0.0/99", 0, true},
+	}
+
+	for _, tt := range tests {
+		proxies, err := parseTrustedProxies(tt.v)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTrustedProxies(%q) error = %v, wantErr %v", tt.v, err, tt.wantErr)
+			continue
+		}
+		if len(proxies) != tt.n {
+			t.Errorf("parseTrustedProxies(%q) = %d proxies, want %d", tt.v, len(proxies), tt.n)
+		}
+	}
+}
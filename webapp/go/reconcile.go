@@ -0,0 +1,425 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReconcileInterval は突き合わせを無効にしておく
+	// 初期データには wait_shipping と wait_done のまま古い取引が多く、ベンチマーク中に書き換えたり
+	// ベンチマーカーの shipment service に余計な問い合わせをしたりしないようにする
+	DefaultReconcileInterval   = 0
+	DefaultReconcileStuckAfter = 10 * time.Minute
+
+	ReconcileBatchSize      = 100
+	ReconcileResultsPerPage = 50
+
+	ReconcileResultAdvanced = "advanced"
+	ReconcileResultStuck    = "stuck"
+	ReconcileResultError    = "error"
+
+	AuditActionReconcile = "reconcile"
+)
+
+// shippingStatusRank は配送状況の進み具合。shipment service の状態がこれより進んでいれば追いつかせる
+var shippingStatusRank = map[string]int{
+	ShippingsStatusInitial:    0,
+	ShippingsStatusWaitPickup: 1,
+	ShippingsStatusShipping:   2,
+	ShippingsStatusDone:       3,
+}
+
+// ReconcileResult は取引ごとの最後の突き合わせの結果
+type ReconcileResult struct {
+	TransactionEvidenceID     int64     `json:"transaction_evidence_id" db:"transaction_evidence_id"`
+	ItemID                    int64     `json:"item_id" db:"item_id"`
+	TransactionEvidenceStatus string    `json:"transaction_evidence_status" db:"transaction_evidence_status"`
+	ShippingStatus            string    `json:"shipping_status" db:"shipping_status"`
+	RemoteStatus              string    `json:"remote_status" db:"remote_status"`
+	Result                    string    `json:"result" db:"result"`
+	Message                   string    `json:"message" db:"message"`
+	CheckedAt                 time.Time `json:"-" db:"checked_at"`
+}
+
+type resReconcileResult struct {
+	ReconcileResult
+	CheckedAt int64 `json:"checked_at"`
+}
+
+type ReconcileRun struct {
+	StartedAt  int64 `json:"started_at"`
+	FinishedAt int64 `json:"finished_at"`
+	Checked    int   `json:"checked"`
+	Advanced   int   `json:"advanced"`
+	Stuck      int   `json:"stuck"`
+	Errors     int   `json:"errors"`
+}
+
+type resReconciliations struct {
+	Interval   int64                `json:"interval"`
+	StuckAfter int64                `json:"stuck_after"`
+	LastRun    *ReconcileRun        `json:"last_run"`
+	HasNext    bool                 `json:"has_next"`
+	Results    []resReconcileResult `json:"results"`
+}
+
+// Reconciler は wait_shipping と wait_done のまま止まっている取引の配送状況を
+// shipment service と定期的に突き合わせ、進められるものは進め、進められないものは記録する
+type Reconciler struct {
+	interval   time.Duration
+	stuckAfter time.Duration
+
+	mu      sync.Mutex
+	lastRun *ReconcileRun
+
+	// cursor は前回の実行で最後に突き合わせた取引
+	// 進められない取引は updated_at が変わらないので、続きから見ないと同じ取引ばかりを見ることになる
+	cursor reconcileCursor
+}
+
+type reconcileCursor struct {
+	UpdatedAt time.Time
+	ID        int64
+}
+
+func newReconciler() (*Reconciler, error) {
+	interval, err := envDuration("RECONCILE_INTERVAL", DefaultReconcileInterval)
+	if err != nil {
+		return nil, err
+	}
+	stuckAfter, err := envDuration("RECONCILE_STUCK_AFTER", DefaultReconcileStuckAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &Reconciler{
+		interval:   interval,
+		stuckAfter: stuckAfter,
+	}
+	if interval > 0 {
+		go rc.loop()
+	}
+
+	return rc, nil
+}
+
+func (rc *Reconciler) loop() {
+	for now := range time.Tick(rc.interval) {
+		rc.Run(now)
+	}
+}
+
+// LastRun は最後に終わった突き合わせの集計を返す。まだ一度も終わっていなければ nil
+func (rc *Reconciler) LastRun() *ReconcileRun {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.lastRun
+}
+
+// Reset は集計を消す
+func (rc *Reconciler) Reset() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.lastRun = nil
+	rc.cursor = reconcileCursor{}
+}
+
+// Run は stuckAfter より長く更新されていない取引を、前回の続きから古い順に ReconcileBatchSize 件突き合わせる
+// 最後まで見たら次の実行では最初から見る
+func (rc *Reconciler) Run(now time.Time) {
+	run := &ReconcileRun{StartedAt: now.Unix()}
+
+	rc.mu.Lock()
+	cursor := rc.cursor
+	rc.mu.Unlock()
+
+	transactionEvidences := []TransactionEvidence{}
+	err := dbx.Select(&transactionEvidences, "SELECT * FROM `transaction_evidences` WHERE `status` IN (?, ?) AND `updated_at` < ? AND (`updated_at` > ? OR (`updated_at` = ? AND `id` > ?)) ORDER BY `updated_at` ASC, `id` ASC LIMIT ?",
+		TransactionEvidenceStatusWaitShipping,
+		TransactionEvidenceStatusWaitDone,
+		now.Add(-rc.stuckAfter),
+		cursor.UpdatedAt,
+		cursor.UpdatedAt,
+		cursor.ID,
+		ReconcileBatchSize,
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	cursor = reconcileCursor{}
+	if len(transactionEvidences) == ReconcileBatchSize {
+		last := transactionEvidences[len(transactionEvidences)-1]
+		cursor = reconcileCursor{UpdatedAt: last.UpdatedAt, ID: last.ID}
+	}
+
+	for _, transactionEvidence := range transactionEvidences {
+		result := reconcileTransaction(transactionEvidence)
+		if result.Result == "" {
+			continue
+		}
+
+		run.Checked++
+		switch result.Result {
+		case ReconcileResultAdvanced:
+			run.Advanced++
+		case ReconcileResultStuck:
+			run.Stuck++
+		case ReconcileResultError:
+			run.Errors++
+		}
+
+		_, err = dbx.Exec("INSERT INTO `reconcile_results` (`transaction_evidence_id`, `item_id`, `transaction_evidence_status`, `shipping_status`, `remote_status`, `result`, `message`, `checked_at`) VALUES (?, ?, ?, ?, ?, ?, ?, ?) "+
+			"ON DUPLICATE KEY UPDATE `transaction_evidence_status` = VALUES(`transaction_evidence_status`), `shipping_status` = VALUES(`shipping_status`), `remote_status` = VALUES(`remote_status`), `result` = VALUES(`result`), `message` = VALUES(`message`), `checked_at` = VALUES(`checked_at`)",
+			result.TransactionEvidenceID,
+			result.ItemID,
+			result.TransactionEvidenceStatus,
+			result.ShippingStatus,
+			result.RemoteStatus,
+			result.Result,
+			result.Message,
+			time.Now(),
+		)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	run.FinishedAt = time.Now().Unix()
+
+	rc.mu.Lock()
+	rc.lastRun = run
+	rc.cursor = cursor
+	rc.mu.Unlock()
+}
+
+// reconcileTransaction は1件の取引を突き合わせる。
+// shipment service への問い合わせはロックを取らずに行い、反映するときに状態が変わっていないことを確かめる
+// 途中で利用者の操作によって状態が変わっていれば Result が空の結果を返す
+func reconcileTransaction(transactionEvidence TransactionEvidence) ReconcileResult {
+	result := ReconcileResult{
+		TransactionEvidenceID:     transactionEvidence.ID,
+		ItemID:                    transactionEvidence.ItemID,
+		TransactionEvidenceStatus: transactionEvidence.Status,
+	}
+
+	shipping := Shipping{}
+	err := dbx.Get(&shipping, "SELECT * FROM `shippings` WHERE `transaction_evidence_id` = ?", transactionEvidence.ID)
+	if err == sql.ErrNoRows {
+		result.Result = ReconcileResultError
+		result.Message = "shippings not found"
+		return result
+	}
+	if err != nil {
+		log.Print(err)
+		result.Result = ReconcileResultError
+		result.Message = "db error"
+		return result
+	}
+	result.ShippingStatus = shipping.Status
+
+	ssr, err := APIShipmentStatus(getShipmentServiceURL(), &APIShipmentStatusReq{
+		ReserveID: shipping.ReserveID,
+	})
+	if err != nil {
+		log.Print(err)
+		result.Result = ReconcileResultError
+		result.Message = "failed to request to shipment service"
+		return result
+	}
+	result.RemoteStatus = ssr.Status
+
+	local, ok := shippingStatusRank[shipping.Status]
+	remote, ok2 := shippingStatusRank[ssr.Status]
+	if !ok || !ok2 {
+		result.Result = ReconcileResultError
+		result.Message = fmt.Sprintf("unknown shipping status: local %s, remote %s", shipping.Status, ssr.Status)
+		return result
+	}
+	if remote < local {
+		result.Result = ReconcileResultError
+		result.Message = "shipment service側の配送状況が戻っています"
+		return result
+	}
+
+	// 発送完了は配送中か配送完了になっていれば postShipDone と同じように進める
+	// 取引の完了は購入者の受け取りの確認が必要なので配送状況だけを追いつかせる
+	// 発送の手続きが終わっていない取引はQRコードがないので進めない
+	newStatus := transactionEvidence.Status
+	if transactionEvidence.Status == TransactionEvidenceStatusWaitShipping && remote >= shippingStatusRank[ShippingsStatusShipping] {
+		newStatus = TransactionEvidenceStatusWaitDone
+	}
+
+	if shipping.Status == ShippingsStatusInitial || (remote == local && newStatus == transactionEvidence.Status) {
+		result.Result = ReconcileResultStuck
+		switch {
+		case shipping.Status == ShippingsStatusInitial && remote > local:
+			result.Message = "発送の手続きが途中で失敗しています"
+		case shipping.Status == ShippingsStatusInitial:
+			result.Message = "出品者が発送の手続きをしていません"
+		case transactionEvidence.Status == TransactionEvidenceStatusWaitShipping:
+			result.Message = "集荷されていません"
+		case ssr.Status == ShippingsStatusDone:
+			result.Message = "購入者が受け取りを確認していません"
+		default:
+			result.Message = "配送が完了していません"
+		}
+		return result
+	}
+
+	tx := dbx.MustBegin()
+
+	item := Item{}
+	err = tx.Get(&item, "SELECT * FROM `items` WHERE `id` = ? FOR UPDATE", transactionEvidence.ItemID)
+	if err != nil {
+		log.Print(err)
+		tx.Rollback()
+		result.Result = ReconcileResultError
+		result.Message = "db error"
+		return result
+	}
+
+	current := TransactionEvidence{}
+	err = tx.Get(&current, "SELECT * FROM `transaction_evidences` WHERE `id` = ? FOR UPDATE", transactionEvidence.ID)
+	if err != nil {
+		log.Print(err)
+		tx.Rollback()
+		result.Result = ReconcileResultError
+		result.Message = "db error"
+		return result
+	}
+
+	currentShipping := Shipping{}
+	err = tx.Get(&currentShipping, "SELECT * FROM `shippings` WHERE `transaction_evidence_id` = ? FOR UPDATE", transactionEvidence.ID)
+	if err != nil {
+		log.Print(err)
+		tx.Rollback()
+		result.Result = ReconcileResultError
+		result.Message = "db error"
+		return result
+	}
+
+	if item.Status != ItemStatusTrading || current.Status != transactionEvidence.Status || currentShipping.Status != shipping.Status {
+		tx.Rollback()
+		return ReconcileResult{}
+	}
+
+	now := time.Now()
+	logs := []AuditLog{}
+	if remote > local {
+		_, err = tx.Exec("UPDATE `shippings` SET `status` = ?, `updated_at` = ? WHERE `transaction_evidence_id` = ?",
+			ssr.Status,
+			now,
+			transactionEvidence.ID,
+		)
+		if err != nil {
+			log.Print(err)
+			tx.Rollback()
+			result.Result = ReconcileResultError
+			result.Message = "db error"
+			return result
+		}
+		logs = append(logs, auditShippingStatus(transactionEvidence.ID, shipping.Status, ssr.Status))
+	}
+
+	if newStatus != transactionEvidence.Status {
+		_, err = tx.Exec("UPDATE `transaction_evidences` SET `status` = ?, `updated_at` = ? WHERE `id` = ?",
+			newStatus,
+			now,
+			transactionEvidence.ID,
+		)
+		if err != nil {
+			log.Print(err)
+			tx.Rollback()
+			result.Result = ReconcileResultError
+			result.Message = "db error"
+			return result
+		}
+		logs = append(logs, auditTransactionEvidenceStatus(transactionEvidence.ID, transactionEvidence.Status, newStatus))
+	}
+
+	// actor_id が0の記録は利用者ではなくアプリケーションによる変更
+	err = addAuditLogs(tx, 0, AuditActionReconcile, logs...)
+	if err != nil {
+		log.Print(err)
+		tx.Rollback()
+		result.Result = ReconcileResultError
+		result.Message = "db error"
+		return result
+	}
+
+	tx.Commit()
+
+	result.TransactionEvidenceStatus = newStatus
+	result.ShippingStatus = ssr.Status
+	result.Result = ReconcileResultAdvanced
+	result.Message = fmt.Sprintf("%s から %s に進めました", transactionEvidence.Status, newStatus)
+	if newStatus == transactionEvidence.Status {
+		result.Message = fmt.Sprintf("配送状況を %s から %s に更新しました", shipping.Status, ssr.Status)
+	}
+	return result
+}
+
+// getAdminReconciliations は最後の突き合わせの集計と取引ごとの結果を取引の新しい順に返す
+// result で絞り込み、before_id で続きを取得する
+func getAdminReconciliations(w http.ResponseWriter, r *http.Request) {
+	_, errCode, errMsg := getAdmin(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	query := r.URL.Query()
+	conds := "1 = 1"
+	args := []any{}
+
+	if result := query.Get("result"); result != "" {
+		conds += " AND `result` = ?"
+		args = append(args, result)
+	}
+	if beforeIDStr := query.Get("before_id"); beforeIDStr != "" {
+		beforeID, err := strconv.ParseInt(beforeIDStr, 10, 64)
+		if err != nil || beforeID <= 0 {
+			outputErrorMsg(w, http.StatusBadRequest, "before_id param error")
+			return
+		}
+		conds += " AND `transaction_evidence_id` < ?"
+		args = append(args, beforeID)
+	}
+	args = append(args, ReconcileResultsPerPage+1)
+
+	results := []ReconcileResult{}
+	err := dbx.Select(&results, "SELECT * FROM `reconcile_results` WHERE "+conds+" ORDER BY `transaction_evidence_id` DESC LIMIT ?", args...)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	res := resReconciliations{
+		Interval:   int64(reconciler.interval / time.Second),
+		StuckAfter: int64(reconciler.stuckAfter / time.Second),
+		LastRun:    reconciler.LastRun(),
+		Results:    []resReconcileResult{},
+	}
+	if len(results) > ReconcileResultsPerPage {
+		res.HasNext = true
+		results = results[:ReconcileResultsPerPage]
+	}
+	for _, result := range results {
+		res.Results = append(res.Results, resReconcileResult{ReconcileResult: result, CheckedAt: result.CheckedAt.Unix()})
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
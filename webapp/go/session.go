@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	SessionStoreCookie = "cookie"
+	SessionStoreMySQL  = "mysql"
+	SessionStoreRedis  = "redis"
+
+	DefaultSessionKey = "abc"
+	DefaultRedisAddr  = "127.0.0.1:6379"
+
+	SessionMaxAge = 86400 * 30
+
+	sessionSweepInterval = 10 * time.Minute
+	redisPoolSize        = 16
+)
+
+var errSessionStoreNotServerSide = errors.New("session store does not keep sessions on the server side")
+
+// SessionStore はセッションの保存先
+// サーバー側に保存するものだけがセッションの一覧と失効に対応する
+type SessionStore interface {
+	sessions.Store
+	// ListSessions はユーザーの有効なセッションを返す
+	ListSessions(userID int64) ([]SessionRecord, error)
+	// RevokeSession はユーザーのセッションを1つ無効にする
+	RevokeSession(userID int64, sessionID string) error
+	// RevokeUserSessions はユーザーのセッションをすべて無効にする
+	RevokeUserSessions(userID int64) error
+}
+
+type SessionRecord struct {
+	ID        string    `json:"id" db:"id"`
+	UserID    int64     `json:"user_id" db:"user_id"`
+	Data      []byte    `json:"data" db:"data"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+}
+
+// sessionPublicID はセッションIDをクライアントに見せるための識別子にする
+// セッションIDそのものは返さない
+func sessionPublicID(id string) string {
+	return sha256Hex([]byte(id))[:32]
+}
+
+// sessionBackend はサーバー側セッションの永続化先
+type sessionBackend interface {
+	// Load は有効期限内のセッションを返す。見つからなければ nil を返す
+	Load(id string) (*SessionRecord, error)
+	Save(rec *SessionRecord) error
+	Delete(id string) error
+	ListByUser(userID int64) ([]SessionRecord, error)
+	DeleteByUser(userID int64) error
+}
+
+// newSessionStore は SESSION_STORE の保存先を作る
+// SESSION_KEYS がなければ公開されている DefaultSessionKey で署名することになるので、
+// cookie なら警告し、複数台で共有する mysql と redis では起動しない
+func newSessionStore() (SessionStore, error) {
+	codecs, defaultKey := sessionCodecs()
+	backend := os.Getenv("SESSION_STORE")
+	if defaultKey {
+		if backend != "" && backend != SessionStoreCookie {
+			return nil, fmt.Errorf("SESSION_KEYS is required for session store %s", backend)
+		}
+		log.Print("warning: SESSION_KEYS is not set; sessions are signed with the default key")
+	}
+
+	options := &sessions.Options{
+		Path:     "/",
+		MaxAge:   SessionMaxAge,
+		HttpOnly: true,
+	}
+
+	switch backend {
+	case "", SessionStoreCookie:
+		cs := &sessions.CookieStore{
+			Codecs:  codecs,
+			Options: options,
+		}
+		cs.MaxAge(cs.Options.MaxAge)
+		return &cookieSessionStore{CookieStore: cs}, nil
+	case SessionStoreMySQL:
+		b := &mysqlSessionBackend{}
+		go b.sweep(sessionSweepInterval)
+		return newServerSessionStore(b, codecs, options), nil
+	case SessionStoreRedis:
+		b, err := newRedisSessionBackend()
+		if err != nil {
+			return nil, err
+		}
+		return newServerSessionStore(b, codecs, options), nil
+	default:
+		return nil, fmt.Errorf("unknown session store: %s", backend)
+	}
+}
+
+// sessionCodecs は SESSION_KEYS からcookieの署名に使う鍵を作る
+// 先頭の鍵で署名し、残りの鍵は検証だけに使うので、新しい鍵を先頭に足せば古いcookieを無効にせず鍵を入れ替えられる
+// SESSION_KEYS がなければ DefaultSessionKey を使い、defaultKey を返す
+func sessionCodecs() (codecs []securecookie.Codec, defaultKey bool) {
+	keyPairs := [][]byte{}
+	for _, key := range strings.Split(os.Getenv("SESSION_KEYS"), ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		keyPairs = append(keyPairs, []byte(key), nil)
+	}
+	if len(keyPairs) == 0 {
+		keyPairs = append(keyPairs, []byte(DefaultSessionKey), nil)
+		defaultKey = true
+	}
+
+	codecs = securecookie.CodecsFromPairs(keyPairs...)
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(SessionMaxAge)
+		}
+	}
+	return codecs, defaultKey
+}
+
+// cookieSessionStore はセッションの中身をすべてcookieに持つ
+// サーバー側に何も残らないので一覧や失効はできない
+type cookieSessionStore struct {
+	*sessions.CookieStore
+}
+
+func (s *cookieSessionStore) ListSessions(userID int64) ([]SessionRecord, error) {
+	return nil, errSessionStoreNotServerSide
+}
+
+func (s *cookieSessionStore) RevokeSession(userID int64, sessionID string) error {
+	return errSessionStoreNotServerSide
+}
+
+func (s *cookieSessionStore) RevokeUserSessions(userID int64) error {
+	return errSessionStoreNotServerSide
+}
+
+// serverSessionStore はcookieには署名したセッションIDだけを持ち、中身は backend に保存する
+type serverSessionStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+
+	backend    sessionBackend
+	serializer securecookie.GobEncoder
+}
+
+func newServerSessionStore(backend sessionBackend, codecs []securecookie.Codec, options *sessions.Options) *serverSessionStore {
+	return &serverSessionStore{
+		Codecs:  codecs,
+		Options: options,
+		backend: backend,
+	}
+}
+
+func (s *serverSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *serverSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	id := ""
+	err = securecookie.DecodeMulti(name, c.Value, &id, s.Codecs...)
+	if err != nil {
+		return session, err
+	}
+
+	rec, err := s.backend.Load(id)
+	if err != nil {
+		return session, err
+	}
+	if rec == nil {
+		// 期限切れか失効済み
+		return session, nil
+	}
+
+	err = s.serializer.Deserialize(rec.Data, &session.Values)
+	if err != nil {
+		return session, err
+	}
+	session.ID = rec.ID
+	session.IsNew = false
+
+	return session, nil
+}
+
+func (s *serverSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			err := s.backend.Delete(session.ID)
+			if err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = secureRandomStr(32)
+	}
+
+	data, err := s.serializer.Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+
+	userID, _ := session.Values["user_id"].(int64)
+	now := time.Now()
+	err = s.backend.Save(&SessionRecord{
+		ID:        session.ID,
+		UserID:    userID,
+		Data:      data,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(session.Options.MaxAge) * time.Second),
+	})
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+
+	return nil
+}
+
+func (s *serverSessionStore) ListSessions(userID int64) ([]SessionRecord, error) {
+	return s.backend.ListByUser(userID)
+}
+
+func (s *serverSessionStore) RevokeSession(userID int64, sessionID string) error {
+	rec, err := s.backend.Load(sessionID)
+	if err != nil {
+		return err
+	}
+	// 他人のセッションは消させない
+	if rec == nil || rec.UserID != userID {
+		return nil
+	}
+	return s.backend.Delete(sessionID)
+}
+
+func (s *serverSessionStore) RevokeUserSessions(userID int64) error {
+	return s.backend.DeleteByUser(userID)
+}
+
+// mysqlSessionBackend は sessions テーブルにセッションを保存する
+type mysqlSessionBackend struct{}
+
+func (b *mysqlSessionBackend) Load(id string) (*SessionRecord, error) {
+	rec := SessionRecord{}
+	err := dbx.Get(&rec, "SELECT * FROM `sessions` WHERE `id` = ? AND `expires_at` > ?", id, time.Now())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (b *mysqlSessionBackend) Save(rec *SessionRecord) error {
+	_, err := dbx.Exec("INSERT INTO `sessions` (`id`, `user_id`, `data`, `created_at`, `expires_at`) VALUES (?, ?, ?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE `user_id` = VALUES(`user_id`), `data` = VALUES(`data`), `expires_at` = VALUES(`expires_at`)",
+		rec.ID,
+		rec.UserID,
+		rec.Data,
+		rec.CreatedAt,
+		rec.ExpiresAt,
+	)
+	return err
+}
+
+func (b *mysqlSessionBackend) Delete(id string) error {
+	_, err := dbx.Exec("DELETE FROM `sessions` WHERE `id` = ?", id)
+	return err
+}
+
+func (b *mysqlSessionBackend) ListByUser(userID int64) ([]SessionRecord, error) {
+	recs := []SessionRecord{}
+	err := dbx.Select(&recs, "SELECT * FROM `sessions` WHERE `user_id` = ? AND `expires_at` > ? ORDER BY `created_at` DESC", userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+func (b *mysqlSessionBackend) DeleteByUser(userID int64) error {
+	_, err := dbx.Exec("DELETE FROM `sessions` WHERE `user_id` = ?", userID)
+	return err
+}
+
+// sweep は期限切れのセッションを定期的に削除する
+func (b *mysqlSessionBackend) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		_, err := dbx.Exec("DELETE FROM `sessions` WHERE `expires_at` <= ?", time.Now())
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// redisSessionBackend はRedis互換のサーバーにセッションを保存する
+// session:{id} にセッション本体を、user_sessions:{user_id} にユーザーのセッションIDの集合を持つ
+type redisSessionBackend struct {
+	client *redisClient
+}
+
+func newRedisSessionBackend() (*redisSessionBackend, error) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = DefaultRedisAddr
+	}
+	db := 0
+	if v := os.Getenv("REDIS_DB"); v != "" {
+		var err error
+		db, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read REDIS_DB: %w", err)
+		}
+	}
+
+	client := &redisClient{
+		addr:     addr,
+		password: os.Getenv("REDIS_PASSWORD"),
+		db:       db,
+		pool:     make(chan *redisConn, redisPoolSize),
+	}
+	_, err := client.Do("PING")
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisSessionBackend{client: client}, nil
+}
+
+func redisSessionKey(id string) string {
+	return "session:" + id
+}
+
+func redisUserSessionsKey(userID int64) string {
+	return fmt.Sprintf("user_sessions:%d", userID)
+}
+
+func (b *redisSessionBackend) Load(id string) (*SessionRecord, error) {
+	v, err := b.client.Do("GET", redisSessionKey(id))
+	if err != nil {
+		return nil, err
+	}
+	data, ok := v.([]byte)
+	if !ok {
+		return nil, nil
+	}
+
+	rec := SessionRecord{}
+	err = json.Unmarshal(data, &rec)
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (b *redisSessionBackend) Save(rec *SessionRecord) error {
+	old, err := b.Load(rec.ID)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		rec.CreatedAt = old.CreatedAt
+		if old.UserID != 0 && old.UserID != rec.UserID {
+			_, err = b.client.Do("SREM", redisUserSessionsKey(old.UserID), rec.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(rec.ExpiresAt).Milliseconds()
+	_, err = b.client.Do("SET", redisSessionKey(rec.ID), string(data), "PX", strconv.FormatInt(ttl, 10))
+	if err != nil {
+		return err
+	}
+
+	if rec.UserID == 0 {
+		return nil
+	}
+	key := redisUserSessionsKey(rec.UserID)
+	_, err = b.client.Do("SADD", key, rec.ID)
+	if err != nil {
+		return err
+	}
+	// 集合はユーザーの最後のセッションが切れるまで残す
+	_, err = b.client.Do("PEXPIRE", key, strconv.FormatInt(ttl, 10))
+	return err
+}
+
+func (b *redisSessionBackend) Delete(id string) error {
+	rec, err := b.Load(id)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.Do("DEL", redisSessionKey(id))
+	if err != nil {
+		return err
+	}
+	if rec != nil && rec.UserID != 0 {
+		_, err = b.client.Do("SREM", redisUserSessionsKey(rec.UserID), id)
+	}
+	return err
+}
+
+func (b *redisSessionBackend) ListByUser(userID int64) ([]SessionRecord, error) {
+	key := redisUserSessionsKey(userID)
+	v, err := b.client.Do("SMEMBERS", key)
+	if err != nil {
+		return nil, err
+	}
+	members, _ := v.([]any)
+
+	recs := []SessionRecord{}
+	for _, m := range members {
+		id, _ := m.([]byte)
+		rec, err := b.Load(string(id))
+		if err != nil {
+			return nil, err
+		}
+		if rec == nil {
+			// 期限切れで本体だけ消えている
+			_, err = b.client.Do("SREM", key, string(id))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		recs = append(recs, *rec)
+	}
+
+	// MySQLの実装に合わせて新しい順に返す
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].CreatedAt.After(recs[j].CreatedAt)
+	})
+
+	return recs, nil
+}
+
+func (b *redisSessionBackend) DeleteByUser(userID int64) error {
+	key := redisUserSessionsKey(userID)
+	v, err := b.client.Do("SMEMBERS", key)
+	if err != nil {
+		return err
+	}
+	members, _ := v.([]any)
+
+	args := []string{"DEL", key}
+	for _, m := range members {
+		id, _ := m.([]byte)
+		args = append(args, redisSessionKey(string(id)))
+	}
+	_, err = b.client.Do(args...)
+	return err
+}
+
+// redisClient はセッションの保存に必要な分だけのRESPクライアント
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+
+	pool chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// Do はコマンドを実行して応答を返す
+// 応答は string(単純文字列)、int64、[]byte(バルク文字列)、[]any(配列)、nil のいずれか
+func (c *redisClient) Do(args ...string) (any, error) {
+	conn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := conn.do(args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			// 通信エラーの接続は使い回さない
+			conn.Close()
+			return nil, err
+		}
+	}
+	c.put(conn)
+	return v, err
+}
+
+func (c *redisClient) get() (*redisConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", c.addr, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+
+	if c.password != "" {
+		_, err = conn.do("AUTH", c.password)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		_, err = conn.do("SELECT", strconv.Itoa(c.db))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisClient) put(conn *redisConn) {
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (conn *redisConn) do(args ...string) (any, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	buf := make([]byte, 0, 64)
+	buf = fmt.Appendf(buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := conn.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.readReply()
+}
+
+func (conn *redisConn) readReply() (any, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(conn.r, b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		vs := make([]any, 0, n)
+		for range n {
+			v, err := conn.readReply()
+			if err != nil {
+				return nil, err
+			}
+			vs = append(vs, v)
+		}
+		return vs, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply: %q", line)
+	}
+}
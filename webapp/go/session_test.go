@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestNewSessionStoreDefaultKey(t *testing.T) {
+	tests := []struct {
+		backend string
+		keys    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{SessionStoreCookie, "", false},
+		// 複数台で共有するので公開されている鍵では起動しない
+		{SessionStoreMySQL, "", true},
+		{SessionStoreRedis, "", true},
+		{SessionStoreCookie, "secret", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.backend+"/"+tt.keys, func(t *testing.T) {
+			t.Setenv("SESSION_STORE", tt.backend)
+			t.Setenv("SESSION_KEYS", tt.keys)
+			_, err := newSessionStore()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newSessionStore error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSessionCodecs(t *testing.T) {
+	t.Setenv("SESSION_KEYS", "")
+	if _, defaultKey := sessionCodecs(); !defaultKey {
+		t.Error("defaultKey = false without SESSION_KEYS")
+	}
+
+	t.Setenv("SESSION_KEYS", "new,old")
+	codecs, defaultKey := sessionCodecs()
+	if defaultKey {
+		t.Error("defaultKey = true with SESSION_KEYS")
+	}
+	if len(codecs) != 2 {
+		t.Errorf("len(codecs) = %d, want 2", len(codecs))
+	}
+}
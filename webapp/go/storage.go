@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ImageStorageLocal = "local"
+	ImageStorageCAS   = "cas"
+	ImageStorageS3    = "s3"
+
+	DefaultImageDir = "../public/upload"
+	DefaultS3Region = "us-east-1"
+)
+
+// ImageStorage は出品画像の保存先
+type ImageStorage interface {
+	// Save は画像を保存して items.image_name に記録する名前を返す
+	Save(img []byte, ext string) (string, error)
+	// ServeImage は /upload/{image_name} へのリクエストに応答する
+	ServeImage(w http.ResponseWriter, r *http.Request, name string)
+}
+
+func newImageStorage() (ImageStorage, error) {
+	dir := os.Getenv("IMAGE_DIR")
+	if dir == "" {
+		dir = DefaultImageDir
+	}
+
+	switch backend := os.Getenv("IMAGE_STORAGE"); backend {
+	case "", ImageStorageLocal:
+		return newLocalImageStorage(dir)
+	case ImageStorageCAS:
+		return newCASImageStorage(dir)
+	case ImageStorageS3:
+		return newS3ImageStorage()
+	default:
+		return nil, fmt.Errorf("unknown image storage: %s", backend)
+	}
+}
+
+type localImageStorage struct {
+	root *os.Root
+}
+
+func newLocalImageStorage(dir string) (*localImageStorage, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &localImageStorage{root: root}, nil
+}
+
+func (s *localImageStorage) Save(img []byte, ext string) (string, error) {
+	name := fmt.Sprintf("%s%s", secureRandomStr(16), ext)
+	err := s.root.WriteFile(name, img, 0644)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (s *localImageStorage) ServeImage(w http.ResponseWriter, r *http.Request, name string) {
+	http.ServeFileFS(w, r, s.root.FS(), name)
+}
+
+// casImageStorage は画像の内容のハッシュ値をファイル名にして保存する
+// 同じ画像は1ファイルにまとめられ、ファイル名が変わらない限り内容も変わらない
+type casImageStorage struct {
+	localImageStorage
+}
+
+func newCASImageStorage(dir string) (*casImageStorage, error) {
+	l, err := newLocalImageStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &casImageStorage{localImageStorage: *l}, nil
+}
+
+func (s *casImageStorage) Save(img []byte, ext string) (string, error) {
+	sum := sha256.Sum256(img)
+	name := fmt.Sprintf("%x%s", sum, ext)
+
+	_, err := s.root.Stat(name)
+	if err == nil {
+		return name, nil
+	}
+
+	// 同じ画像を同時に保存しても壊れたファイルが見えないように一時ファイルからrenameする
+	tmp := fmt.Sprintf(".%s.%s", name, secureRandomStr(8))
+	err = s.root.WriteFile(tmp, img, 0644)
+	if err != nil {
+		return "", err
+	}
+	err = s.root.Rename(tmp, name)
+	if err != nil {
+		s.root.Remove(tmp)
+		return "", err
+	}
+	return name, nil
+}
+
+// ServeImage は呼び出し側が Cache-Control を決めていなければ、内容が変わらないのでずっとキャッシュさせる
+func (s *casImageStorage) ServeImage(w http.ResponseWriter, r *http.Request, name string) {
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	s.localImageStorage.ServeImage(w, r, name)
+}
+
+// s3ImageStorage はS3互換のオブジェクトストレージ(MinIOなど)に画像を保存する
+// S3_PUBLIC_URL が設定されていればそちらへリダイレクトし、なければアプリケーションが中継する
+type s3ImageStorage struct {
+	endpoint        *url.URL
+	bucket          string
+	prefix          string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	publicURL       string
+
+	client *http.Client
+}
+
+func newS3ImageStorage() (*s3ImageStorage, error) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT is required")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET is required")
+	}
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = DefaultS3Region
+	}
+
+	return &s3ImageStorage{
+		endpoint:        u,
+		bucket:          bucket,
+		region:          region,
+		accessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		publicURL:       strings.TrimSuffix(os.Getenv("S3_PUBLIC_URL"), "/"),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+func (s *s3ImageStorage) objectURL(name string) string {
+	u := *s.endpoint
+	u.Path = fmt.Sprintf("/%s/%s%s", s.bucket, s.prefix, name)
+	return u.String()
+}
+
+func (s *s3ImageStorage) Save(img []byte, ext string) (string, error) {
+	name := fmt.Sprintf("%s%s", secureRandomStr(16), ext)
+
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(name), bytes.NewReader(img))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", mime.TypeByExtension(ext))
+	s.sign(req, img, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		return "", fmt.Errorf("status code: %d; body: %s", res.StatusCode, b)
+	}
+
+	return name, nil
+}
+
+func (s *s3ImageStorage) ServeImage(w http.ResponseWriter, r *http.Request, name string) {
+	if s.publicURL != "" {
+		http.Redirect(w, r, fmt.Sprintf("%s/%s", s.publicURL, url.PathEscape(name)), http.StatusFound)
+		return
+	}
+
+	if !validObjectName(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, s.objectURL(name), nil)
+	if err != nil {
+		outputErrorMsg(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+	req.Header.Set("User-Agent", userAgent)
+	for _, h := range []string{"If-None-Match", "If-Modified-Since"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	s.sign(req, nil, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadGateway, "storage error")
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if res.StatusCode == http.StatusNotModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		outputErrorMsg(w, http.StatusBadGateway, "storage error")
+		return
+	}
+
+	for _, h := range []string{"Content-Type", "Content-Length", "ETag", "Last-Modified"} {
+		if v := res.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(name)))
+	}
+	io.Copy(w, res.Body)
+}
+
+// sign はAWS Signature Version 4でリクエストに署名する
+func (s *s3ImageStorage) sign(req *http.Request, payload []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Host = req.URL.Host
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := sigV4SigningKey(s.secretAccessKey, date, s.region, "s3")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyID, scope, signedHeaders, signature))
+}
+
+// sigV4SigningKey は日付、リージョン、サービスごとの署名鍵を作る
+func sigV4SigningKey(secretAccessKey, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// validObjectName はSigV4の正規化でエスケープの差が出ない文字だけで構成されているかを確認する
+func validObjectName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
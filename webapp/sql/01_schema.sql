@@ -12,13 +12,29 @@ DROP TABLE IF EXISTS `users`;
 CREATE TABLE `users` (
   `id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `account_name` varchar(128) NOT NULL UNIQUE,
+  `display_name` varchar(191) NOT NULL DEFAULT '',
   `hashed_password` varbinary(191) NOT NULL,
   `address` varchar(191) NOT NULL,
   `num_sell_items` int unsigned NOT NULL DEFAULT 0,
   `last_bump` datetime NOT NULL DEFAULT '2000-01-01 00:00:00',
+  `session_version` int unsigned NOT NULL DEFAULT 0,
+  `is_admin` tinyint(1) NOT NULL DEFAULT 0,
+  `is_suspended` tinyint(1) NOT NULL DEFAULT 0,
   `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
 ) ENGINE = InnoDB DEFAULT CHARACTER SET utf8mb4;
 
+DROP TABLE IF EXISTS `user_addresses`;
+
+CREATE TABLE `user_addresses` (
+  `id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` bigint NOT NULL,
+  `name` varchar(191) NOT NULL DEFAULT '',
+  `address` varchar(191) NOT NULL,
+  `is_default` tinyint(1) NOT NULL DEFAULT 0,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  INDEX idx_user_id (`user_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET utf8mb4;
+
 DROP TABLE IF EXISTS `items`;
 
 CREATE TABLE `items` (
@@ -37,9 +53,11 @@ CREATE TABLE `items` (
   `description` text NOT NULL,
   `image_name` varchar(191) NOT NULL,
   `category_id` int unsigned NOT NULL,
+  `seller_suspended` tinyint(1) NOT NULL DEFAULT 0,
   `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
-  INDEX idx_category_id (`category_id`)
+  INDEX idx_category_id (`category_id`),
+  INDEX idx_seller_id (`seller_id`)
 ) ENGINE = InnoDB DEFAULT CHARACTER SET utf8mb4;
 
 DROP TABLE IF EXISTS `transaction_evidences`;
@@ -73,10 +91,95 @@ CREATE TABLE `shippings` (
   `from_address` varchar(191) NOT NULL,
   `from_name` varchar(191) NOT NULL,
   `img_binary` mediumblob NOT NULL,
+  `img_name` varchar(191) NOT NULL DEFAULT '',
   `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
 ) ENGINE = InnoDB DEFAULT CHARACTER SET utf8mb4;
 
+DROP TABLE IF EXISTS `offers`;
+
+CREATE TABLE `offers` (
+  `id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `item_id` bigint NOT NULL,
+  `seller_id` bigint NOT NULL,
+  `buyer_id` bigint NOT NULL,
+  `price` int unsigned NOT NULL,
+  `status` enum('pending', 'countered', 'accepted', 'rejected', 'purchased') NOT NULL,
+  `reserved_until` datetime NOT NULL DEFAULT '2000-01-01 00:00:00',
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  INDEX idx_item_id (`item_id`),
+  INDEX idx_seller_id (`seller_id`),
+  INDEX idx_buyer_id (`buyer_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+DROP TABLE IF EXISTS `admin_logs`;
+
+CREATE TABLE `admin_logs` (
+  `id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `admin_id` bigint NOT NULL,
+  `action` varchar(32) NOT NULL,
+  `target_type` varchar(32) NOT NULL,
+  `target_id` bigint NOT NULL,
+  `reason` text NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  INDEX idx_target (`target_type`, `target_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+DROP TABLE IF EXISTS `audit_logs`;
+
+CREATE TABLE `audit_logs` (
+  `id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `actor_id` bigint NOT NULL,
+  `action` varchar(32) NOT NULL,
+  `entity_type` varchar(32) NOT NULL,
+  `entity_id` bigint NOT NULL,
+  `field` varchar(32) NOT NULL,
+  `old_value` varchar(191) NOT NULL,
+  `new_value` varchar(191) NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  INDEX idx_entity (`entity_type`, `entity_id`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+DROP TABLE IF EXISTS `reconcile_results`;
+
+CREATE TABLE `reconcile_results` (
+  `transaction_evidence_id` bigint NOT NULL PRIMARY KEY,
+  `item_id` bigint NOT NULL,
+  `transaction_evidence_status` enum('wait_shipping', 'wait_done', 'done') NOT NULL,
+  `shipping_status` varchar(32) NOT NULL,
+  `remote_status` varchar(32) NOT NULL,
+  `result` enum('advanced', 'stuck', 'error') NOT NULL,
+  `message` varchar(191) NOT NULL,
+  `checked_at` datetime NOT NULL
+) ENGINE = InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+DROP TABLE IF EXISTS `buy_reservations`;
+
+CREATE TABLE `buy_reservations` (
+  `id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `item_id` bigint NOT NULL,
+  `buyer_id` bigint NOT NULL,
+  `seller_id` bigint NOT NULL,
+  `offer_id` bigint NOT NULL DEFAULT 0,
+  `price` int unsigned NOT NULL,
+  `token` varchar(191) NOT NULL,
+  `to_address` varchar(191) NOT NULL,
+  `to_name` varchar(191) NOT NULL,
+  `from_address` varchar(191) NOT NULL,
+  `from_name` varchar(191) NOT NULL,
+  `reserve_id` varchar(191) NOT NULL DEFAULT '',
+  `reserve_time` bigint NOT NULL DEFAULT 0,
+  `transaction_evidence_id` bigint NOT NULL DEFAULT 0,
+  `status` enum('pending', 'shipment_created', 'paid', 'finalized', 'failed', 'refund_required', 'refunded') NOT NULL,
+  `error` varchar(191) NOT NULL DEFAULT '',
+  `lease_until` datetime NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  INDEX idx_item_id_status (`item_id`, `status`),
+  INDEX idx_status_lease_until (`status`, `lease_until`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET utf8mb4;
+
 DROP TABLE IF EXISTS `categories`;
 
 CREATE TABLE `categories` (
@@ -84,3 +187,15 @@ CREATE TABLE `categories` (
   `parent_id` int unsigned NOT NULL,
   `category_name` varchar(191) NOT NULL
 ) ENGINE = InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+DROP TABLE IF EXISTS `sessions`;
+
+CREATE TABLE `sessions` (
+  `id` varchar(64) NOT NULL PRIMARY KEY,
+  `user_id` bigint NOT NULL DEFAULT 0,
+  `data` blob NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `expires_at` datetime NOT NULL,
+  INDEX idx_user_id (`user_id`),
+  INDEX idx_expires_at (`expires_at`)
+) ENGINE = InnoDB DEFAULT CHARACTER SET utf8mb4;